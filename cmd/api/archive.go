@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/archive"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"gorm.io/gorm"
+)
+
+// api export [-o file.tar] [-owner email]
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("o", "", "archive to write, - for stdout (default lm-export-<date>.tar)")
+	owner := flags.String("owner", "", "only export this user's library (email)")
+	_ = flags.Parse(args)
+
+	cfg := loadConfig("export", nil)
+	gdb := setup(cfg)
+	ctx := context.Background()
+
+	store, err := openStore(ctx, cfg)
+	if err != nil {
+		log.Fatal("object store:", err)
+	}
+
+	opts := archive.ExportOptions{}
+	if *owner != "" {
+		opts.OwnerID = userIDByEmail(gdb, *owner)
+	}
+
+	name := *out
+	if name == "" {
+		name = "lm-export-" + time.Now().Format("20060102-150405") + ".tar"
+	}
+	var w io.Writer = os.Stdout
+	if name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			log.Fatalf("export: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	man, err := archive.Export(ctx, gdb, store, w, opts)
+	if err != nil {
+		if name != "-" {
+			_ = os.Remove(name)
+		}
+		log.Fatalf("export: %v", err)
+	}
+	// Stdout may be the archive itself, the summary goes to stderr
+	fmt.Fprintf(os.Stderr, "exported %d users, %d photos (%d missing), %d variants, %d tags, %d albums to %s\n",
+		man.Users, man.Photos, man.Missing, man.Variants, man.Tags, man.Albums, name)
+}
+
+// api import [-owner email] <file.tar|->
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	owner := flags.String("owner", "", "give everything to this user (email) instead of matching users")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("usage: import [-owner email] <file.tar|->")
+	}
+
+	cfg := loadConfig("import", nil)
+	gdb := setup(cfg)
+	ctx := context.Background()
+
+	store, err := openStore(ctx, cfg)
+	if err != nil {
+		log.Fatal("object store:", err)
+	}
+	if err := store.EnsureBucket(ctx, store.PhotosBucket()); err != nil {
+		log.Fatalf("ensure bucket %v", err)
+	}
+
+	opts := archive.ImportOptions{}
+	if *owner != "" {
+		opts.OwnerID = userIDByEmail(gdb, *owner)
+	}
+
+	var r io.Reader = os.Stdin
+	if name := flags.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatalf("import: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	stats, err := archive.Import(ctx, gdb, store, r, opts)
+	if err != nil {
+		log.Fatalf("import: %v", err)
+	}
+	fmt.Println(stats.Summary())
+}
+
+func userIDByEmail(gdb *gorm.DB, email string) string {
+	var u db.User
+	if err := gdb.Where("email = ?", strings.ToLower(strings.TrimSpace(email))).First(&u).Error; err != nil {
+		log.Fatalf("user %s: %v", email, err)
+	}
+	return u.ID
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/AJMerr/little-moments-offline/internal/backup"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+)
+
+// api backup [list]
+func runBackup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	cfg := loadConfig("backup", nil)
+	ctx := context.Background()
+	store, err := openStore(ctx, cfg)
+	if err != nil {
+		log.Fatal("object store:", err)
+	}
+	opts := backup.OptionsFrom(cfg.Backup)
+
+	switch flags.Arg(0) {
+	case "":
+		gdb := setup(cfg)
+		defer db.CloseDB(gdb)
+		snap, err := backup.Create(ctx, gdb, store, opts)
+		if err != nil {
+			log.Fatalf("backup: %v", err)
+		}
+		fmt.Printf("wrote %s (%d bytes)\n", snap.Key, snap.Bytes)
+
+	case "list":
+		snaps, err := backup.List(ctx, store, opts)
+		if err != nil {
+			log.Fatalf("backup: %v", err)
+		}
+		for _, s := range snaps {
+			fmt.Printf("%s  %10d  %s\n", s.CreatedAt.Format("2006-01-02 15:04:05Z"), s.Bytes, s.Key)
+		}
+
+	default:
+		log.Fatalf("usage: backup [list]")
+	}
+}
+
+// api restore <key|latest>, run it with the server stopped
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("usage: restore <key|latest>")
+	}
+
+	cfg := loadConfig("restore", nil)
+	ctx := context.Background()
+	store, err := openStore(ctx, cfg)
+	if err != nil {
+		log.Fatal("object store:", err)
+	}
+
+	snap, err := backup.Restore(ctx, store, backup.OptionsFrom(cfg.Backup), flags.Arg(0), cfg.DBPath)
+	if err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	fmt.Printf("restored %s (taken %s) to %s\n", snap.Key, snap.CreatedAt.Format("2006-01-02 15:04:05Z"), cfg.DBPath)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/AJMerr/little-moments-offline/internal/config"
+)
+
+// api config print [serve flags], secrets are redacted
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		log.Fatal("usage: api config print [-config file] [-addr ...]")
+	}
+
+	// Load hands back an empty Config when the file or env can't be read,
+	// one that only fails validation is still printed so the bad value can be spotted
+	cfg, err := config.Load("config print", args[1:])
+	if cfg.Addr != "" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(cfg.Redacted())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/AJMerr/little-moments-offline/internal/backup"
+	"github.com/AJMerr/little-moments-offline/internal/fsck"
+)
+
+// api fsck [-repair] [-orphan-age 24h] [-json]
+func runFsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "delete old orphans, mark broken photos and drop dangling references")
+	orphanAge := flags.Duration("orphan-age", fsck.DefaultOrphanAge, "only delete orphans older than this")
+	asJSON := flags.Bool("json", false, "print the full report as JSON")
+	_ = flags.Parse(args)
+
+	cfg := loadConfig("fsck", nil)
+	gdb := setup(cfg)
+	ctx := context.Background()
+
+	store, err := openStore(ctx, cfg)
+	if err != nil {
+		log.Fatal("object store:", err)
+	}
+
+	rep, err := fsck.Run(ctx, gdb, store, fsck.Options{
+		Repair:       *repair,
+		OrphanAge:    *orphanAge,
+		SkipPrefixes: backup.OptionsFrom(cfg.Backup).SkipPrefixes(store.PhotosBucket()),
+	})
+	if err != nil {
+		log.Fatalf("fsck: %v", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(rep)
+	} else {
+		for _, is := range rep.Issues {
+			fmt.Printf("%-22s key=%s photo=%s album=%s repaired=%t %s\n",
+				is.Kind, is.Key, is.PhotoID, is.AlbumID, is.Repaired, is.Detail)
+		}
+		fmt.Println(rep.Summary())
+	}
+
+	// Non-zero exit when something is still wrong, handy for cron
+	if len(rep.Issues) > rep.Repaired {
+		os.Exit(1)
+	}
+}
@@ -2,25 +2,83 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/AJMerr/little-moments-offline/internal/api"
+	"github.com/AJMerr/little-moments-offline/internal/backup"
+	"github.com/AJMerr/little-moments-offline/internal/config"
 	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
+	"github.com/AJMerr/little-moments-offline/internal/metrics"
 	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"github.com/AJMerr/little-moments-offline/internal/trash"
+	"github.com/AJMerr/little-moments-offline/internal/webhooks"
+	"github.com/AJMerr/little-moments-offline/internal/worker"
 	"github.com/joho/godotenv"
+	"gorm.io/gorm"
 )
 
 func main() {
+	// Loads .env before anything reads the environment
+	_ = godotenv.Load()
+
+	// Subcommands, flags or nothing start the server
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "serve":
+		serve(args)
+	case "fsck":
+		runFsck(args)
+	case "migrate":
+		runMigrate(args)
+	case "export":
+		runExport(args)
+	case "import":
+		runImport(args)
+	case "config":
+		runConfig(args)
+	case "backup":
+		runBackup(args)
+	case "restore":
+		runRestore(args)
+	default:
+		log.Fatalf("unknown command %q (want serve, fsck, migrate, export, import, config, backup or restore)", cmd)
+	}
+}
+
+// Loads the effective config, subcommands pass no args and only see the file and env
+func loadConfig(name string, args []string) config.Config {
+	cfg, err := config.Load(name, args)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	return cfg
+}
 
-	// DB Connection and migrate if needed
-	gdb, dbErr := db.OpenDB("data/app.db")
+// Opens the DB, nothing is migrated yet
+func openDB(cfg config.Config) *gorm.DB {
+	gdb, dbErr := db.OpenDB(cfg.DBPath)
 	if dbErr != nil {
 		log.Fatal(dbErr)
 	}
+	return gdb
+}
+
+// Opens the DB, applies pending migrations and seeds the local user.
+// Refuses to continue if the DB was migrated by a newer binary.
+func setup(cfg config.Config) *gorm.DB {
+	gdb := openDB(cfg)
 
 	if dbErr := db.Migrate(gdb); dbErr != nil {
 		log.Fatalf("migrate: %v", dbErr)
@@ -30,47 +88,173 @@ func main() {
 	if dbErr := db.SeedLocalUser(gdb); dbErr != nil {
 		log.Fatalf("seed: %v", dbErr)
 	}
+	return gdb
+}
 
-	// Loads .env
-	_ = godotenv.Load()
-
-	// Sets up MinIO config
-	s3Config := storage.S3Config{
-		Endpoint:       os.Getenv("LM_S3_ENDPOINT"),
-		Region:         os.Getenv("LM_S3_REGION"),
-		AccessKey:      os.Getenv("LM_S3_ACCESS_KEY"),
-		SecretKey:      os.Getenv("LM_S3_SECRET_KEY"),
-		ForcePathStyle: true,
-		BucketPhotos:   os.Getenv("LM_S3_BUCKET_PHOTOS"),
-	}
+func serve(args []string) {
+	cfg := loadConfig("serve", args)
+	gdb := setup(cfg)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Starts MinIO Client
-	s3c, s3Err := storage.NewS3Client(ctx, s3Config)
-	if s3Err != nil {
-		log.Fatal("s3 client:", s3Err)
+	// Picks the blob store, MinIO/S3 by default or a local directory
+	store, storeErr := openStore(ctx, cfg)
+	if storeErr != nil {
+		log.Fatal("object store:", storeErr)
+	}
+
+	// Ensures bucket exists
+	if bucketErr := store.EnsureBucket(ctx, store.PhotosBucket()); bucketErr != nil {
+		log.Fatalf("ensure bucket %v", bucketErr)
 	}
 
 	// Health check for bucket
-	if s3Err := s3c.Health(ctx); s3Err != nil {
-		log.Printf("WARN (%s): %v", s3Config.BucketPhotos, s3Err)
+	if healthErr := store.Health(ctx); healthErr != nil {
+		log.Printf("WARN (%s): %v", store.PhotosBucket(), healthErr)
 	}
 
-	// Ensures bucket exists
-	if bucketErr := s3c.EnsureBucket(ctx, os.Getenv("LM_S3_BUCKET_PHOTOS")); bucketErr != nil {
-		log.Fatalf("ensure bucket %v", bucketErr)
+	if s3c, ok := store.(*storage.S3); ok {
+		_ = s3c.SetBucketCORS(ctx, s3c.Config.BucketPhotos)
+	}
+
+	// Prometheus metrics for queries and store calls, served on /metrics
+	if err := metrics.InstrumentDB(gdb); err != nil {
+		log.Fatalf("metrics: %v", err)
 	}
+	store = metrics.InstrumentStore(store)
 
-	_ = s3c.SetBucketCORS(ctx, os.Getenv("LM_S3_BUCKET_PHOTOS"))
+	// Webhook deliveries are queued with the event that triggers them
+	events.Default.AddHook(webhooks.Queue{})
+
+	// Background jobs, stopped together on shutdown
+	workers := worker.New()
+	// Trashed photos and albums are purged after the retention period
+	workers.Go("trash-purger", func(ctx context.Context) {
+		trash.RunPurger(ctx, gdb, store, cfg.TrashRetention.D(), time.Hour)
+	})
+	// Thumbnails and previews for confirmed uploads
+	workers.Go("variants", func(ctx context.Context) {
+		api.RunVariantWorker(ctx, gdb, store, 15*time.Minute)
+	})
+
+	// Content and perceptual hashes for photos from before duplicate detection
+	workers.Go("hash-backfill", func(ctx context.Context) {
+		api.RunHashBackfill(ctx, gdb, store, time.Hour)
+	})
+	// Multipart uploads nobody finished
+	workers.Go("upload-sweeper", func(ctx context.Context) {
+		api.RunUploadSweeper(ctx, gdb, store, cfg.UploadMaxAge.D(), time.Hour)
+	})
+	// Old entries of the change log behind GET /events
+	workers.Go("event-pruner", func(ctx context.Context) {
+		events.RunPruner(ctx, gdb, cfg.EventRetention.D(), time.Hour)
+	})
+	// Outgoing webhooks
+	workers.Go("webhooks", func(ctx context.Context) {
+		webhooks.RunDispatcher(ctx, gdb, webhooks.NewSender(cfg.Webhooks), cfg.EventRetention.D(), 15*time.Second)
+	})
+	// Database snapshots to the object store
+	if cfg.Backup.Interval > 0 {
+		workers.Go("backup", func(ctx context.Context) {
+			backup.RunScheduler(ctx, gdb, store, backup.OptionsFrom(cfg.Backup), cfg.Backup.Interval.D())
+		})
+	}
 
 	// Sets a var for the Router
-	router := api.RouterHandler(gdb, s3c)
+	router := api.RouterHandler(gdb, store, cfg)
 
-	fmt.Println("Server starting on 127.0.0.1:8173")
-	err := http.ListenAndServe(":8173", router)
-	if err != nil {
-		log.Fatalf("Server failed to start %v", err)
+	servers := []*http.Server{newServer(cfg, cfg.Addr, router)}
+	// Event streams never finish on their own, Shutdown would wait them out
+	servers[0].RegisterOnShutdown(events.Default.Close)
+	// Optional second listener for scrapers, no login needed there
+	if cfg.AdminAddr != "" {
+		servers = append(servers, newServer(cfg, cfg.AdminAddr, api.AdminHandler()))
+	}
+
+	serveErr := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() {
+			log.Printf("listening on %s", srv.Addr)
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serveErr <- fmt.Errorf("listen %s: %w", srv.Addr, err)
+			}
+		}()
+	}
+
+	// SIGTERM from docker compose down, SIGINT from a terminal
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	exitCode := 0
+	select {
+	case <-sigCtx.Done():
+		log.Printf("shutting down, waiting up to %s", cfg.HTTP.ShutdownTimeout.D())
+	case err := <-serveErr:
+		log.Printf("server failed: %v", err)
+		exitCode = 1
+	}
+	// A second signal kills the process the usual way
+	stop()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout.D())
+	defer cancelShutdown()
+
+	// Stop accepting and let in-flight requests finish, then cut off the rest
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown %s: %v, closing", srv.Addr, err)
+			_ = srv.Close()
+		}
+	}
+	// Requests can queue work, so workers stop after the servers
+	if err := workers.Stop(shutdownCtx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	if err := db.CloseDB(gdb); err != nil {
+		log.Printf("close db: %v", err)
+	}
+	log.Printf("stopped")
+	os.Exit(exitCode)
+}
+
+// Server with the configured timeouts, handlers that stream large bodies
+// lift the deadlines themselves
+func newServer(cfg config.Config, addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout.D(),
+		ReadTimeout:       cfg.HTTP.ReadTimeout.D(),
+		WriteTimeout:      cfg.HTTP.WriteTimeout.D(),
+		IdleTimeout:       cfg.HTTP.IdleTimeout.D(),
+	}
+}
+
+// Builds the object store selected by cfg.Storage ("s3" or "fs")
+func openStore(ctx context.Context, cfg config.Config) (storage.ObjectStore, error) {
+	switch cfg.Storage {
+	case "s3":
+		// Sets up MinIO config
+		s3Config := storage.S3Config{
+			Endpoint:       cfg.S3.Endpoint,
+			Region:         cfg.S3.Region,
+			AccessKey:      cfg.S3.AccessKey,
+			SecretKey:      cfg.S3.SecretKey,
+			ForcePathStyle: cfg.S3.ForcePathStyle,
+			BucketPhotos:   cfg.PhotosBucket,
+		}
+		return storage.NewS3Client(ctx, s3Config)
+
+	case "fs":
+		return storage.NewFSStore(storage.FSConfig{
+			Root:         cfg.FS.Root,
+			Secret:       cfg.FS.Secret,
+			PublicBase:   cfg.FS.PublicBase,
+			BucketPhotos: cfg.PhotosBucket,
+		})
+
+	default:
+		return nil, fmt.Errorf("unknown storage %q (want s3 or fs)", cfg.Storage)
 	}
 }
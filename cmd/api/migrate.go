@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+)
+
+// api migrate status | api migrate up [--to N]
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: api migrate status | up [--to N]")
+	}
+	gdb := openDB(loadConfig("migrate", nil))
+
+	switch args[0] {
+	case "status":
+		statuses, err := db.MigrationStatuses(gdb)
+		if err != nil {
+			log.Fatalf("migrate status: %v", err)
+		}
+		current, err := db.SchemaVersion(gdb)
+		if err != nil {
+			log.Fatalf("migrate status: %v", err)
+		}
+		known, err := db.Migrations()
+		if err != nil {
+			log.Fatalf("migrate status: %v", err)
+		}
+
+		for _, s := range statuses {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Local().Format(time.DateTime)
+			}
+			if s.Version > len(known) {
+				state += " (unknown to this binary)"
+			}
+			fmt.Printf("%04d %-24s %s\n", s.Version, s.Name, state)
+		}
+		fmt.Printf("database at %d, binary at %d\n", current, len(known))
+		if current > len(known) {
+			os.Exit(1)
+		}
+
+	case "up":
+		flags := flag.NewFlagSet("migrate up", flag.ExitOnError)
+		to := flags.Int("to", 0, "stop after this version (default: latest)")
+		_ = flags.Parse(args[1:])
+
+		before, err := db.SchemaVersion(gdb)
+		if err != nil {
+			log.Fatalf("migrate up: %v", err)
+		}
+		if err := db.MigrateTo(gdb, *to); err != nil {
+			log.Fatalf("migrate up: %v", err)
+		}
+		after, err := db.SchemaVersion(gdb)
+		if err != nil {
+			log.Fatalf("migrate up: %v", err)
+		}
+		fmt.Printf("migrated %d -> %d\n", before, after)
+
+	default:
+		log.Fatalf("unknown migrate command %q (want status or up)", args[0])
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/archive"
+	"github.com/AJMerr/little-moments-offline/internal/backup"
+	"github.com/AJMerr/little-moments-offline/internal/fsck"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"gorm.io/gorm"
+)
+
+type fsckReq struct {
+	Repair         bool `json:"repair"`
+	OrphanAgeHours int  `json:"orphan_age_hours"`
+}
+
+// Runs the bucket/database consistency check, the body is optional.
+// Keys under skip (database backups) aren't treated as orphans.
+func RunFsck(gdb *gorm.DB, store storage.ObjectStore, skip []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req fsckReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, "bad_json")
+			return
+		}
+		if req.OrphanAgeHours < 0 {
+			writeError(w, http.StatusBadRequest, "bad_orphan_age")
+			return
+		}
+
+		rep, err := fsck.Run(r.Context(), gdb, store, fsck.Options{
+			Repair:       req.Repair,
+			OrphanAge:    time.Duration(req.OrphanAgeHours) * time.Hour,
+			SkipPrefixes: skip,
+		})
+		if err != nil {
+			log.Printf("fsck: %v", err)
+			writeError(w, http.StatusInternalServerError, "fsck_failed")
+			return
+		}
+		log.Printf("fsck: %s", rep.Summary())
+		toJSON(w, http.StatusOK, rep)
+	}
+}
+
+// Streams a tar of the whole library, ?owner=me limits it to the caller's.
+// Errors after the headers are out can only be logged.
+func ExportLibrary(gdb *gorm.DB, store storage.ObjectStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts := archive.ExportOptions{}
+		switch r.URL.Query().Get("owner") {
+		case "":
+		case "me":
+			opts.OwnerID = ownerID(r)
+		default:
+			writeError(w, http.StatusBadRequest, "bad_owner")
+			return
+		}
+
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": "lm-export-" + time.Now().Format("20060102-150405") + ".tar",
+		}))
+
+		man, err := archive.Export(r.Context(), gdb, store, w, opts)
+		if err != nil {
+			log.Printf("export: %v", err)
+			return
+		}
+		log.Printf("export: %d photos, %d albums", man.Photos, man.Albums)
+	}
+}
+
+// Reads an archive from the request body, ?owner=me gives everything to the caller
+func ImportLibrary(gdb *gorm.DB, store storage.ObjectStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts := archive.ImportOptions{}
+		switch r.URL.Query().Get("owner") {
+		case "":
+		case "me":
+			opts.OwnerID = ownerID(r)
+		default:
+			writeError(w, http.StatusBadRequest, "bad_owner")
+			return
+		}
+
+		_ = http.NewResponseController(w).SetReadDeadline(time.Time{})
+		stats, err := archive.Import(r.Context(), gdb, store, r.Body, opts)
+		if err != nil {
+			log.Printf("import: %v", err)
+			writeError(w, http.StatusBadRequest, "import_failed")
+			return
+		}
+		log.Printf("import: %s", stats.Summary())
+		toJSON(w, http.StatusOK, stats)
+	}
+}
+
+// Lists the database snapshots in the object store, newest first
+func GetBackups(store storage.ObjectStore, opts backup.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snaps, err := backup.List(r.Context(), store, opts)
+		if err != nil {
+			log.Printf("backup list: %v", err)
+			writeError(w, http.StatusInternalServerError, "list_failed")
+			return
+		}
+		toJSON(w, http.StatusOK, map[string]any{"items": snaps})
+	}
+}
+
+// Takes a snapshot now, older ones beyond the keep count are rotated out
+func CreateBackup(gdb *gorm.DB, store storage.ObjectStore, opts backup.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		snap, err := backup.Create(r.Context(), gdb, store, opts)
+		if err != nil {
+			log.Printf("backup: %v", err)
+			writeError(w, http.StatusInternalServerError, "backup_failed")
+			return
+		}
+		log.Printf("backup: wrote %s (%d bytes)", snap.Key, snap.Bytes)
+		toJSON(w, http.StatusCreated, snap)
+	}
+}
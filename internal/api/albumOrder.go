@@ -0,0 +1,228 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
+	"gorm.io/gorm"
+)
+
+type albumOrderReq struct {
+	PhotoIDs []string `json:"photo_ids"`
+}
+
+type movePhotoReq struct {
+	// Exactly one of these, the photo the moved one goes before or after
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+var (
+	errOrderMismatch = errors.New("order does not match album")
+	errNotInAlbum    = errors.New("photo not in album")
+)
+
+// Every member of the album in its current sort mode, trashed photos included
+// so they get their old place back on restore
+func albumMembers(tx *gorm.DB, albumID, mode string) (ids []string, live map[string]bool, err error) {
+	if !validAlbumSort(mode) {
+		mode = db.AlbumSortAdded
+	}
+	var rows []struct {
+		ID      string
+		Trashed bool
+	}
+	if err := tx.Table("album_photos ap").
+		Select("p.id, p.deleted_at IS NOT NULL AS trashed").
+		Joins("JOIN photos p ON p.id = ap.photo_id").
+		Where("ap.album_id = ?", albumID).
+		Order(albumSortOrder[mode]).
+		Scan(&rows).Error; err != nil {
+		return nil, nil, err
+	}
+	live = make(map[string]bool, len(rows))
+	for _, r := range rows {
+		ids = append(ids, r.ID)
+		live[r.ID] = !r.Trashed
+	}
+	return ids, live, nil
+}
+
+// Rewrites pos as 0..n-1 in the given order and switches the album to manual
+func saveAlbumOrder(tx *gorm.DB, albumID string, ids []string) error {
+	for i, pid := range ids {
+		if err := tx.Table("album_photos").
+			Where("album_id = ? AND photo_id = ?", albumID, pid).
+			Update("pos", i).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Model(&db.Album{}).
+		Where("id = ?", albumID).
+		Updates(map[string]any{"sort_mode": db.AlbumSortManual, "updated_at": time.Now().UTC()}).Error
+}
+
+// Loads the caller's live album for the ordering endpoints
+func orderableAlbum(w http.ResponseWriter, r *http.Request, gdb *gorm.DB) (db.Album, bool) {
+	var a db.Album
+	if err := gdb.WithContext(r.Context()).
+		Where("id = ? AND owner_id = ?", r.PathValue("id"), ownerID(r)).
+		First(&a).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			writeError(w, http.StatusNotFound, "album_not_found")
+		} else {
+			writeError(w, http.StatusInternalServerError, "db_load_failed")
+		}
+		return a, false
+	}
+	return a, true
+}
+
+// Sets the full manual order. photo_ids must list every photo in the album
+// that isn't in the trash, exactly once.
+func SetAlbumOrder(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a, ok := orderableAlbum(w, r, gdb)
+		if !ok {
+			return
+		}
+
+		var req albumOrderReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_json")
+			return
+		}
+
+		err := gdb.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			ids, live, err := albumMembers(tx, a.ID, a.SortMode)
+			if err != nil {
+				return err
+			}
+
+			liveCount := 0
+			for _, ok := range live {
+				if ok {
+					liveCount++
+				}
+			}
+			if len(uniqueStrings(req.PhotoIDs)) != len(req.PhotoIDs) || len(req.PhotoIDs) != liveCount {
+				return errOrderMismatch
+			}
+			for _, pid := range req.PhotoIDs {
+				if !live[pid] {
+					return errOrderMismatch
+				}
+			}
+
+			// Trashed members keep their slots, the live ones fill the rest in
+			// the new order
+			order := make([]string, 0, len(ids))
+			next := 0
+			for _, pid := range ids {
+				if live[pid] {
+					pid = req.PhotoIDs[next]
+					next++
+				}
+				order = append(order, pid)
+			}
+			return saveAlbumOrder(tx, a.ID, order)
+		})
+		if err != nil {
+			if errors.Is(err, errOrderMismatch) {
+				writeError(w, http.StatusBadRequest, "order_mismatch")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "db_update_failed")
+			return
+		}
+		publish(r.Context(), gdb, a.OwnerID, events.AlbumReordered, a.ID, map[string]any{"album_id": a.ID, "sort_mode": db.AlbumSortManual})
+		toJSON(w, http.StatusOK, map[string]any{"sort_mode": db.AlbumSortManual, "count": len(req.PhotoIDs)})
+	}
+}
+
+// Moves one photo before or after another. The album switches to manual,
+// starting from the order it was showing.
+func MoveAlbumPhoto(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a, ok := orderableAlbum(w, r, gdb)
+		if !ok {
+			return
+		}
+		pid := r.PathValue("pid")
+
+		var req movePhotoReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_json")
+			return
+		}
+		target := req.Before
+		if (req.Before == "") == (req.After == "") {
+			writeError(w, http.StatusBadRequest, "want_before_or_after")
+			return
+		}
+		if target == "" {
+			target = req.After
+		}
+		if target == pid {
+			writeError(w, http.StatusBadRequest, "bad_target")
+			return
+		}
+
+		var pos int
+		err := gdb.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			ids, live, err := albumMembers(tx, a.ID, a.SortMode)
+			if err != nil {
+				return err
+			}
+			// Trashed photos can't be moved or moved next to
+			if !live[pid] || !live[target] {
+				return errNotInAlbum
+			}
+
+			// Takes the photo out, then puts it next to the target
+			rest := make([]string, 0, len(ids))
+			found := false
+			for _, id := range ids {
+				if id == pid {
+					found = true
+					continue
+				}
+				rest = append(rest, id)
+			}
+			at := -1
+			for i, id := range rest {
+				if id == target {
+					at = i
+					break
+				}
+			}
+			if !found || at < 0 {
+				return errNotInAlbum
+			}
+			if req.After != "" {
+				at++
+			}
+
+			order := make([]string, 0, len(ids))
+			order = append(order, rest[:at]...)
+			order = append(order, pid)
+			order = append(order, rest[at:]...)
+			pos = at
+			return saveAlbumOrder(tx, a.ID, order)
+		})
+		if err != nil {
+			if errors.Is(err, errNotInAlbum) {
+				writeError(w, http.StatusBadRequest, "photo_not_in_album")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "db_update_failed")
+			return
+		}
+		publish(r.Context(), gdb, a.OwnerID, events.AlbumReordered, a.ID, map[string]any{"album_id": a.ID, "sort_mode": db.AlbumSortManual})
+		toJSON(w, http.StatusOK, map[string]any{"sort_mode": db.AlbumSortManual, "pos": pos})
+	}
+}
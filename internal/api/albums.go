@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -14,7 +15,9 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 
+	"github.com/AJMerr/little-moments-offline/internal/config"
 	"github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
 )
 
 type createAlbumReq struct {
@@ -22,6 +25,8 @@ type createAlbumReq struct {
 	Description  string   `json:"description,omitempty"`
 	CoverPhotoID *string  `json:"cover_photo_id,omitempty"`
 	PhotoIDs     []string `json:"photo_ids,omitempty"`
+	// manual, added (default), captured or title
+	SortMode string `json:"sort_mode,omitempty"`
 }
 
 type albumRes struct {
@@ -29,6 +34,7 @@ type albumRes struct {
 	Title        string  `json:"title"`
 	Description  string  `json:"description"`
 	CoverPhotoID *string `json:"cover_photo_id"`
+	SortMode     string  `json:"sort_mode"`
 	CreatedAt    string  `json:"created_at"`
 }
 
@@ -47,8 +53,15 @@ func CreateAblum(gdb *gorm.DB) http.HandlerFunc {
 			writeError(w, http.StatusBadRequest, "missing_title")
 			return
 		}
+		if in.SortMode == "" {
+			in.SortMode = db.AlbumSortAdded
+		}
+		if !validAlbumSort(in.SortMode) {
+			writeError(w, http.StatusBadRequest, "bad_sort_mode")
+			return
+		}
 
-		const owner = "local_user" // DELETE LATER for auth user
+		owner := ownerID(r)
 		now := time.Now().UTC()
 
 		var created db.Album
@@ -59,6 +72,7 @@ func CreateAblum(gdb *gorm.DB) http.HandlerFunc {
 				Title:        in.Title,
 				Description:  in.Description,
 				CoverPhotoID: in.CoverPhotoID,
+				SortMode:     in.SortMode,
 				CreatedAt:    now,
 				UpdatedAt:    now,
 			}
@@ -66,6 +80,19 @@ func CreateAblum(gdb *gorm.DB) http.HandlerFunc {
 				return err
 			}
 
+			// A cover outside the photo list still has to be the owner's
+			if in.CoverPhotoID != nil {
+				var count int64
+				if err := tx.Model(&db.Photo{}).
+					Where("id = ? AND owner_id = ?", *in.CoverPhotoID, owner).
+					Count(&count).Error; err != nil {
+					return err
+				}
+				if count == 0 {
+					return fmt.Errorf("photo_not_found")
+				}
+			}
+
 			// Validate photo exists
 			if len(in.PhotoIDs) > 0 {
 				var count int64
@@ -121,13 +148,16 @@ func CreateAblum(gdb *gorm.DB) http.HandlerFunc {
 			return
 		}
 
-		toJSON(w, http.StatusCreated, albumRes{
+		out := albumRes{
 			ID:           created.ID,
 			Title:        created.Title,
 			Description:  created.Description,
 			CoverPhotoID: created.CoverPhotoID,
+			SortMode:     created.SortMode,
 			CreatedAt:    created.CreatedAt.Format(time.RFC3339),
-		})
+		}
+		publish(r.Context(), gdb, owner, events.AlbumCreated, out.ID, out)
+		toJSON(w, http.StatusCreated, out)
 	}
 }
 
@@ -152,7 +182,7 @@ func AddPhotoToAlbum(gdb *gorm.DB) http.HandlerFunc {
 		// Checks if album exists
 		var exists int64
 		if err := gdb.Table("albums").
-			Where("id = ? AND owner_id = ? AND deleted_at IS NULL", id, localuser).
+			Where("id = ? AND owner_id = ? AND deleted_at IS NULL", id, ownerID(r)).
 			Count(&exists).Error; err != nil || exists == 0 {
 			writeError(w, http.StatusBadRequest, "album_not_found")
 			return
@@ -168,23 +198,47 @@ func AddPhotoToAlbum(gdb *gorm.DB) http.HandlerFunc {
 			return
 		}
 
-		now := time.Now()
-		vals := make([]map[string]any, 0, len(req.PhotoIDs))
-		for _, pid := range req.PhotoIDs {
-			vals = append(vals, map[string]any{
-				"album_id": id, "photo_id": pid, "added_at": now,
-			})
+		// Only the caller's own photos can go in
+		var owned int64
+		if err := gdb.Model(&db.Photo{}).
+			Where("id IN ? AND owner_id = ?", req.PhotoIDs, ownerID(r)).
+			Count(&owned).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+		if int(owned) != len(uniqueStrings(req.PhotoIDs)) {
+			writeError(w, http.StatusBadRequest, "photo_not_found")
+			return
 		}
-		if err := gdb.Table("album_photos").Clauses(clause.OnConflict{DoNothing: true}).Create(&vals).Error; err != nil {
+
+		// New photos go to the end of the manual order, ones already in the album keep their place
+		now := time.Now()
+		ids := uniqueStrings(req.PhotoIDs)
+		if err := gdb.Transaction(func(tx *gorm.DB) error {
+			var maxPos int
+			if err := tx.Table("album_photos").
+				Where("album_id = ?", id).
+				Select("COALESCE(MAX(pos), -1)").
+				Scan(&maxPos).Error; err != nil {
+				return err
+			}
+			vals := make([]map[string]any, 0, len(ids))
+			for i, pid := range ids {
+				vals = append(vals, map[string]any{
+					"album_id": id, "photo_id": pid, "pos": maxPos + 1 + i, "added_at": now,
+				})
+			}
+			return tx.Table("album_photos").Clauses(clause.OnConflict{DoNothing: true}).Create(&vals).Error
+		}); err != nil {
 			writeError(w, http.StatusInternalServerError, "db_insert_failed")
 			return
 		}
-		toJSON(w, http.StatusOK, map[string]any{"added": len(vals)})
+		publish(r.Context(), gdb, ownerID(r), events.AlbumPhotosAdded, id, map[string]any{"album_id": id, "photo_ids": ids})
+		toJSON(w, http.StatusOK, map[string]any{"added": len(ids)})
 	}
 }
 
 // Sets up GET requests with simple cursor helpers
-const localuser = "local_user" // DELETE, use auth user later
 
 type albumCursor struct {
 	CreatedAt time.Time `json:"created_at"`
@@ -206,13 +260,19 @@ func decodeAlbumCursor(s string) (albumCursor, error) {
 	return c, err
 }
 
+// Position of the last photo on a page, which fields are set depends on the mode
 type albumPhotoCursor struct {
-	AddedAt time.Time `json:"added_at"`
-	PhotoID string    `json:"photo_id"`
+	// Empty in cursors from before sort modes, those were always "added"
+	Mode       string    `json:"m,omitempty"`
+	AddedAt    time.Time `json:"added_at"`
+	CapturedAt time.Time `json:"captured_at,omitempty"`
+	Pos        int       `json:"pos,omitempty"`
+	Title      string    `json:"title,omitempty"`
+	PhotoID    string    `json:"photo_id"`
 }
 
-func encodeAlbumPhotoCursor(t time.Time, pid string) string {
-	b, _ := json.Marshal(albumPhotoCursor{AddedAt: t, PhotoID: pid})
+func encodeAlbumPhotoCursor(c albumPhotoCursor) string {
+	b, _ := json.Marshal(c)
 	return base64.RawURLEncoding.EncodeToString(b)
 }
 
@@ -223,6 +283,9 @@ func decodeAlbumPhotoCursor(s string) (albumPhotoCursor, error) {
 		return c, err
 	}
 	err = json.Unmarshal(b, &c)
+	if c.Mode == "" {
+		c.Mode = db.AlbumSortAdded
+	}
 	return c, err
 }
 
@@ -232,6 +295,7 @@ type albumOut struct {
 	Title        string    `json:"title"`
 	Description  string    `json:"description"`
 	CoverPhotoID *string   `json:"cover_photo_id"`
+	SortMode     string    `json:"sort_mode"`
 	CreatedAt    time.Time `json:"created_at"`
 }
 
@@ -243,14 +307,15 @@ type photoOut struct {
 	ContentType string    `json:"content_type"`
 	Bytes       int64     `json:"bytes"`
 	CreatedAt   time.Time `json:"created_at"`
+	CapturedAt  time.Time `json:"captured_at"`
 }
 
 // Function to GET all albums
-func GetAllAlbums(gdb *gorm.DB) http.HandlerFunc {
+func GetAllAlbums(gdb *gorm.DB, pages config.Pages) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		limit := 25
+		limit := pages.Default
 		if s := r.URL.Query().Get("limit"); s != "" {
-			if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= 100 {
+			if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= pages.Max {
 				limit = n
 			}
 		}
@@ -267,7 +332,7 @@ func GetAllAlbums(gdb *gorm.DB) http.HandlerFunc {
 		ctx := r.Context()
 		var rows []db.Album
 		q := gdb.WithContext(ctx).
-			Where("owner_id = ? AND deleted_at IS NULL", localuser).
+			Where("owner_id = ? AND deleted_at IS NULL", ownerID(r)).
 			Order("created_at DESC, id DESC")
 
 		if after != nil {
@@ -290,6 +355,7 @@ func GetAllAlbums(gdb *gorm.DB) http.HandlerFunc {
 				Title:        a.Title,
 				Description:  a.Description,
 				CoverPhotoID: a.CoverPhotoID,
+				SortMode:     a.SortMode,
 				CreatedAt:    a.CreatedAt,
 			})
 		}
@@ -322,7 +388,7 @@ func pathID(r *http.Request, prefix string) (string, bool) {
 }
 
 // GET album by ID
-func GetAlbumByID(gdb *gorm.DB) http.HandlerFunc {
+func GetAlbumByID(gdb *gorm.DB, pages config.Pages) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			w.Header().Set("Allow", http.MethodGet)
@@ -342,7 +408,7 @@ func GetAlbumByID(gdb *gorm.DB) http.HandlerFunc {
 		// Load album meta
 		var a db.Album
 		if err := gdb.WithContext(ctx).Where(
-			"id = ? AND owner_id = ? AND deleted_at IS NULL", id, localuser,
+			"id = ? AND owner_id = ? AND deleted_at IS NULL", id, ownerID(r),
 		).First(&a).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
 				writeError(w, http.StatusBadRequest, "album_not_found")
@@ -357,49 +423,24 @@ func GetAlbumByID(gdb *gorm.DB) http.HandlerFunc {
 			Title:        a.Title,
 			Description:  a.Description,
 			CoverPhotoID: a.CoverPhotoID,
+			SortMode:     a.SortMode,
 			CreatedAt:    a.CreatedAt,
 		}
 
 		// Pagination params for photos
-		limit := 24
+		limit := pages.AlbumPhotos
 		if s := r.URL.Query().Get("limit"); s != "" {
-			if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= 100 {
+			if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= pages.Max {
 				limit = n
 			}
 		}
 
-		var after *albumPhotoCursor
-		if c := r.URL.Query().Get("cursor"); c != "" {
-			pc, err := decodeAlbumPhotoCursor(c)
-			if err != nil {
+		rows, next, err := listAlbumPhotos(ctx, gdb, id, a.SortMode, limit, r.URL.Query().Get("cursor"))
+		if err != nil {
+			if errors.Is(err, errBadCursor) {
 				writeError(w, http.StatusBadRequest, "bad_cursor")
 				return
 			}
-			after = &pc
-		}
-
-		// Join album_photos to photos, ordered by added_at then photo id (desc)
-		type row struct {
-			db.Photo
-			AddedAt time.Time
-		}
-		var rows []row
-
-		q := gdb.WithContext(ctx).
-			Table("album_photos ap").
-			Select("p.*, ap.added_at").
-			Joins("JOIN photos p ON p.id = ap.photo_id").
-			Where("ap.album_id = ? AND p.deleted_at IS NULL", id).
-			Order("ap.added_at DESC, p.id DESC")
-
-		if after != nil {
-			q = q.Where(`
-				ap.added_at < ? OR (ap.added_at = ? AND p.id < ?)`,
-				after.AddedAt, after.AddedAt, after.PhotoID,
-			)
-		}
-
-		if err := q.Limit(limit + 1).Scan(&rows).Error; err != nil {
 			writeError(w, http.StatusInternalServerError, "db_list_failed")
 			return
 		}
@@ -414,15 +455,10 @@ func GetAlbumByID(gdb *gorm.DB) http.HandlerFunc {
 				ContentType: r.Photo.ContentType,
 				Bytes:       r.Photo.Bytes,
 				CreatedAt:   r.Photo.CreatedAt,
+				CapturedAt:  r.Photo.CapturedAt,
 			})
 		}
 
-		next := ""
-		if len(rows) == limit {
-			last := rows[len(rows)-1]
-			next = encodeAlbumPhotoCursor(last.AddedAt, last.Photo.ID)
-		}
-
 		toJSON(w, http.StatusOK, map[string]any{
 			"album":       album,
 			"photos":      photos,
@@ -430,3 +466,86 @@ func GetAlbumByID(gdb *gorm.DB) http.HandlerFunc {
 		})
 	}
 }
+
+var errBadCursor = errors.New("bad cursor")
+
+type albumPhotoRow struct {
+	db.Photo
+	AddedAt time.Time
+	Pos     int
+}
+
+func validAlbumSort(mode string) bool {
+	switch mode {
+	case db.AlbumSortManual, db.AlbumSortAdded, db.AlbumSortCaptured, db.AlbumSortTitle:
+		return true
+	}
+	return false
+}
+
+// ORDER BY for each sort mode, photo id breaks ties
+var albumSortOrder = map[string]string{
+	db.AlbumSortManual:   "ap.pos ASC, p.id ASC",
+	db.AlbumSortAdded:    "ap.added_at DESC, p.id DESC",
+	db.AlbumSortCaptured: "p.captured_at DESC, p.id DESC",
+	db.AlbumSortTitle:    "p.title COLLATE NOCASE ASC, p.id ASC",
+}
+
+// One page of an album's live photos in the album's sort mode. Shared by
+// the owner's album view and public share links.
+func listAlbumPhotos(ctx context.Context, gdb *gorm.DB, albumID, mode string, limit int, cursor string) ([]albumPhotoRow, string, error) {
+	if !validAlbumSort(mode) {
+		mode = db.AlbumSortAdded
+	}
+
+	var after *albumPhotoCursor
+	if cursor != "" {
+		pc, err := decodeAlbumPhotoCursor(cursor)
+		if err != nil || pc.Mode != mode {
+			return nil, "", errBadCursor
+		}
+		after = &pc
+	}
+
+	var rows []albumPhotoRow
+	q := gdb.WithContext(ctx).
+		Table("album_photos ap").
+		Select("p.*, ap.added_at, ap.pos").
+		Joins("JOIN photos p ON p.id = ap.photo_id").
+		Where("ap.album_id = ? AND p.deleted_at IS NULL", albumID).
+		Order(albumSortOrder[mode])
+
+	// Rows strictly after the cursor in the same order
+	if after != nil {
+		switch mode {
+		case db.AlbumSortManual:
+			q = q.Where("ap.pos > ? OR (ap.pos = ? AND p.id > ?)", after.Pos, after.Pos, after.PhotoID)
+		case db.AlbumSortAdded:
+			q = q.Where("ap.added_at < ? OR (ap.added_at = ? AND p.id < ?)", after.AddedAt, after.AddedAt, after.PhotoID)
+		case db.AlbumSortCaptured:
+			q = q.Where("p.captured_at < ? OR (p.captured_at = ? AND p.id < ?)", after.CapturedAt, after.CapturedAt, after.PhotoID)
+		case db.AlbumSortTitle:
+			q = q.Where("p.title > ? COLLATE NOCASE OR (p.title = ? COLLATE NOCASE AND p.id > ?)", after.Title, after.Title, after.PhotoID)
+		}
+	}
+
+	// One extra row tells whether there is a next page
+	if err := q.Limit(limit + 1).Scan(&rows).Error; err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		next = encodeAlbumPhotoCursor(albumPhotoCursor{
+			Mode:       mode,
+			AddedAt:    last.AddedAt,
+			CapturedAt: last.Photo.CapturedAt,
+			Pos:        last.Pos,
+			Title:      last.Photo.Title,
+			PhotoID:    last.Photo.ID,
+		})
+	}
+	return rows, next, nil
+}
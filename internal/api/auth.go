@@ -0,0 +1,236 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/auth"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type registerReq struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	UserName string `json:"user_name,omitempty"`
+	IsAdmin  bool   `json:"is_admin,omitempty"`
+}
+
+type loginReq struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type userOut struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	UserName  string    `json:"user_name"`
+	IsAdmin   bool      `json:"is_admin"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func toUserOut(u db.User) userOut {
+	return userOut{
+		ID:        u.ID,
+		Email:     u.Email,
+		UserName:  u.UserName,
+		IsAdmin:   u.IsAdmin,
+		CreatedAt: u.CreatedAt,
+	}
+}
+
+var errEmailTaken = errors.New("email_taken")
+
+// Creates an account. The first account is open to anyone, becomes admin and
+// takes over local_user's photos and albums. After that only admins can add users.
+func Register(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in registerReq
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		in.Email = strings.ToLower(strings.TrimSpace(in.Email))
+		in.UserName = strings.TrimSpace(in.UserName)
+		if in.Email == "" || !strings.Contains(in.Email, "@") {
+			writeError(w, http.StatusBadRequest, "bad_email")
+			return
+		}
+
+		hash, err := auth.HashPassword(in.Password)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "weak_password")
+			return
+		}
+
+		caller, loggedIn := authUserFromCtx(r.Context())
+		u := db.User{
+			ID:           uuid.NewString(),
+			Email:        in.Email,
+			UserName:     in.UserName,
+			PasswordHash: hash,
+			CreatedAt:    time.Now().UTC(),
+		}
+
+		err = gdb.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			n, err := db.CountAccounts(tx)
+			if err != nil {
+				return err
+			}
+
+			if n == 0 {
+				// Bootstrap: first account is the admin and owns the existing library
+				u.IsAdmin = true
+			} else {
+				if !loggedIn || !caller.IsAdmin {
+					return errForbidden
+				}
+				u.IsAdmin = in.IsAdmin
+			}
+
+			var taken int64
+			if err := tx.Model(&db.User{}).Where("email = ?", u.Email).Count(&taken).Error; err != nil {
+				return err
+			}
+			if taken > 0 {
+				return errEmailTaken
+			}
+
+			if err := tx.Create(&u).Error; err != nil {
+				return err
+			}
+			if n == 0 {
+				return db.ClaimLocalData(tx, u.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			switch {
+			case errors.Is(err, errForbidden):
+				writeError(w, http.StatusForbidden, "admin_required")
+			case errors.Is(err, errEmailTaken):
+				writeError(w, http.StatusConflict, "email_taken")
+			default:
+				writeError(w, http.StatusInternalServerError, "db_insert_failed")
+			}
+			return
+		}
+
+		toJSON(w, http.StatusCreated, toUserOut(u))
+	}
+}
+
+// Checks the password and sets the session cookie
+func Login(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in loginReq
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		in.Email = strings.ToLower(strings.TrimSpace(in.Email))
+
+		var u db.User
+		err := gdb.WithContext(r.Context()).Where("email = ?", in.Email).First(&u).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+		if err != nil || !auth.CheckPassword(u.PasswordHash, in.Password) {
+			writeError(w, http.StatusUnauthorized, "invalid_credentials")
+			return
+		}
+
+		// Drops this user's expired sessions while we're here
+		now := time.Now().UTC()
+		gdb.WithContext(r.Context()).
+			Where("user_id = ? AND expires_at <= ?", u.ID, now).
+			Delete(&db.Session{})
+
+		token, err := auth.NewToken()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "session_failed")
+			return
+		}
+		sess := db.Session{
+			ID:         auth.HashToken(token),
+			UserID:     u.ID,
+			CreatedAt:  now,
+			ExpiresAt:  now.Add(auth.SessionTTL),
+			LastSeenAt: now,
+		}
+		if err := gdb.WithContext(r.Context()).Create(&sess).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "session_failed")
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     auth.SessionCookie,
+			Value:    token,
+			Path:     "/",
+			Expires:  sess.ExpiresAt,
+			HttpOnly: true,
+			Secure:   isHTTPS(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		toJSON(w, http.StatusOK, toUserOut(u))
+	}
+}
+
+// Deletes the session and clears the cookie
+func Logout(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(auth.SessionCookie); err == nil && c.Value != "" {
+			if err := gdb.WithContext(r.Context()).
+				Where("id = ?", auth.HashToken(c.Value)).
+				Delete(&db.Session{}).Error; err != nil {
+				writeError(w, http.StatusInternalServerError, "db_delete_failed")
+				return
+			}
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     auth.SessionCookie,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   isHTTPS(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Returns the logged in user
+func GetMe(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var u db.User
+		if err := gdb.WithContext(r.Context()).Where("id = ?", ownerID(r)).First(&u).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+		toJSON(w, http.StatusOK, toUserOut(u))
+	}
+}
+
+var errForbidden = errors.New("forbidden")
+
+// Wraps admin only handlers
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if u, ok := authUserFromCtx(r.Context()); !ok || !u.IsAdmin {
+			writeError(w, http.StatusForbidden, "admin_required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Behind Caddy TLS terminates at the proxy
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Keys never get new bytes (a regenerated variant changes its ETag), so
+// browsers may keep what they fetched
+const (
+	cacheImmutable = "private, max-age=31536000, immutable"
+	// The original standing in for a variant that isn't ready yet
+	cacheFallback = "private, no-cache"
+)
+
+// Streams the photo (or ?variant=thumb|preview) through the API. Range,
+// If-None-Match and If-Range are handled by http.ServeContent.
+func GetPhotoContent(gdb *gorm.DB, store storage.ObjectStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ps []db.Photo
+		if err := gdb.WithContext(r.Context()).
+			Where("id = ? AND owner_id = ?", r.PathValue("id"), ownerID(r)).
+			Limit(1).Find(&ps).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+		if len(ps) == 0 {
+			writeError(w, http.StatusNotFound, "not_found")
+			return
+		}
+
+		key, contentType, served, err := contentKey(r.Context(), gdb, ps[0], r.URL.Query().Get("variant"))
+		if err != nil {
+			if errors.Is(err, errBadVariant) {
+				writeError(w, http.StatusBadRequest, "bad_variant")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+		serveObject(w, r, store, key, contentType, served, r.URL.Query().Get("variant"))
+	}
+}
+
+// Public counterpart for share links. Renditions are always allowed, the
+// original only when the share allows downloads, also when it would stand
+// in for a variant that isn't ready.
+func GetSharedPhotoContent(gdb *gorm.DB, store storage.ObjectStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		share, ok := openShare(w, r, gdb)
+		if !ok {
+			return
+		}
+		variant := r.URL.Query().Get("variant")
+		if (variant == "" || variant == "original") && !share.AllowDownload {
+			writeError(w, http.StatusForbidden, "download_not_allowed")
+			return
+		}
+
+		// Only photos of the shared album, and neither may be in the trash
+		var ps []db.Photo
+		if err := gdb.WithContext(r.Context()).
+			Joins("JOIN album_photos ap ON ap.photo_id = photos.id").
+			Joins("JOIN albums a ON a.id = ap.album_id AND a.deleted_at IS NULL").
+			Where("photos.id = ? AND ap.album_id = ?", r.PathValue("id"), share.AlbumID).
+			Limit(1).Find(&ps).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+		if len(ps) == 0 {
+			writeError(w, http.StatusNotFound, "not_found")
+			return
+		}
+
+		key, contentType, served, err := contentKey(r.Context(), gdb, ps[0], variant)
+		if err != nil {
+			if errors.Is(err, errBadVariant) {
+				writeError(w, http.StatusBadRequest, "bad_variant")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+		if served == "original" && !share.AllowDownload {
+			w.Header().Set("Cache-Control", "no-store")
+			writeError(w, http.StatusNotFound, "variant_not_ready")
+			return
+		}
+		serveObject(w, r, store, key, contentType, served, variant)
+	}
+}
+
+var errBadVariant = errors.New("bad_variant")
+
+// The key to serve for variant ("" or "original" for the original). A
+// variant that isn't ready falls back to the original; served says which.
+func contentKey(ctx context.Context, gdb *gorm.DB, p db.Photo, variant string) (key, contentType, served string, err error) {
+	if variant == "" || variant == "original" {
+		return p.OriginKey, p.ContentType, "original", nil
+	}
+	if _, ok := variantSpecByName(variant); !ok {
+		return "", "", "", errBadVariant
+	}
+	var vs []db.PhotoVariant
+	if err := gdb.WithContext(ctx).
+		Where("photo_id = ? AND variant = ? AND status = ?", p.ID, variant, db.VariantReady).
+		Limit(1).Find(&vs).Error; err != nil {
+		return "", "", "", err
+	}
+	if len(vs) == 0 {
+		return p.OriginKey, p.ContentType, "original", nil
+	}
+	return vs[0].Key, vs[0].ContentType, variant, nil
+}
+
+// Writes the object with ETag, Last-Modified and caching headers. wanted is
+// the variant the client asked for, a fallback to the original isn't cached.
+func serveObject(w http.ResponseWriter, r *http.Request, store storage.ObjectStore, key, contentType, served, wanted string) {
+	info, err := store.Head(r.Context(), store.PhotosBucket(), key)
+	if err != nil {
+		if storage.IsNotFound(err) {
+			writeError(w, http.StatusNotFound, "object_missing")
+			return
+		}
+		writeError(w, http.StatusBadGateway, "storage_failed")
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("X-Variant", served)
+	if info.ETag != "" {
+		h.Set("ETag", info.ETag)
+	}
+	if wanted != "" && wanted != "original" && served == "original" {
+		h.Set("Cache-Control", cacheFallback)
+	} else {
+		h.Set("Cache-Control", cacheImmutable)
+	}
+
+	// Videos stream for as long as they play
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	body := &objectReader{ctx: r.Context(), store: store, key: key, size: info.Size}
+	defer body.Close()
+	http.ServeContent(w, r, "", info.LastModified, body)
+	if body.err != nil && r.Context().Err() == nil {
+		log.Printf("content %s: %v", key, body.err)
+	}
+}
+
+// objectReader is the io.ReadSeeker http.ServeContent wants. Seeking is free,
+// the ranged GET is only made on the first Read after a seek.
+type objectReader struct {
+	ctx   context.Context
+	store storage.ObjectStore
+	key   string
+	size  int64
+
+	off  int64
+	body io.ReadCloser
+	err  error
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.off
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("objectReader: bad whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("objectReader: negative position")
+	}
+	if offset != o.off {
+		o.Close()
+		o.off = offset
+	}
+	return offset, nil
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		o.body, o.err = o.store.GetObjectRange(o.ctx, o.store.PhotosBucket(), o.key, o.off, o.size-o.off)
+		if o.err != nil {
+			return 0, o.err
+		}
+	}
+	n, err := o.body.Read(p)
+	o.off += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		o.err = err
+	}
+	return n, err
+}
+
+func (o *objectReader) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
 	"gorm.io/gorm"
 )
 
@@ -54,34 +55,50 @@ func DeletePhotoFromAlbum(gdb *gorm.DB) http.HandlerFunc {
 			return
 		}
 
+		// Checks the album belongs to the caller
+		var exists int64
+		if err := gdb.Model(&db.Album{}).
+			Where("id = ? AND owner_id = ?", id, ownerID(r)).
+			Count(&exists).Error; err != nil || exists == 0 {
+			writeError(w, http.StatusBadRequest, "album_not_found")
+			return
+		}
+
 		if err := gdb.Table("album_photos").
 			Where("album_id = ? AND photo_id IN ?", id, req.PhotoIDs).
 			Delete(nil).Error; err != nil {
 			writeError(w, http.StatusInternalServerError, "db_delete_failed")
 			return
 		}
+		publish(r.Context(), gdb, ownerID(r), events.AlbumPhotosRemoved, id, map[string]any{"album_id": id, "photo_ids": req.PhotoIDs})
 		toJSON(w, http.StatusOK, map[string]any{"removed": len(req.PhotoIDs)})
 	}
 }
 
-// Deletes an album
+// Moves an album to the trash, its photos and cover are kept for restore
 func DeleteAlbum(gdb *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodDelete {
 			w.Header().Set("Allow", http.MethodDelete)
 			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+			return
 		}
 		id, ok := pathID(r, "/albums/")
 		if !ok {
 			writeError(w, http.StatusBadRequest, "bad_path")
 			return
 		}
-		if err := gdb.Model(&db.Album{}).
-			Where("id = ? AND owner_id = ? AND deleted_at IS NULL", id, localuser).
-			Updates(map[string]any{"deleted_at": time.Now(), "cover_photo_id": nil}).Error; err != nil {
+		res := gdb.Model(&db.Album{}).
+			Where("id = ? AND owner_id = ? AND deleted_at IS NULL", id, ownerID(r)).
+			Update("deleted_at", time.Now())
+		if res.Error != nil {
 			writeError(w, http.StatusInternalServerError, "db_delete_failed")
 			return
 		}
+		// Deleting twice is fine but only the first one is news
+		if res.RowsAffected > 0 {
+			publish(r.Context(), gdb, ownerID(r), events.AlbumDeleted, id, map[string]any{"id": id})
+		}
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -4,17 +4,17 @@ import (
 	"net/http"
 
 	db "github.com/AJMerr/little-moments-offline/internal/db"
-	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"github.com/AJMerr/little-moments-offline/internal/events"
 	"gorm.io/gorm"
 )
 
-func DeletePhotoByID(gdb *gorm.DB, s3 *storage.S3) http.HandlerFunc {
+func DeletePhotoByID(gdb *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
 
 		var p db.Photo
 		if err := gdb.WithContext(r.Context()).
-			Where("id = ? AND owner_id = ?", id, "local_user"). // DELETE Later, using auth user
+			Where("id = ? AND owner_id = ?", id, ownerID(r)).
 			First(&p).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
 				w.WriteHeader(http.StatusNoContent)
@@ -24,14 +24,12 @@ func DeletePhotoByID(gdb *gorm.DB, s3 *storage.S3) http.HandlerFunc {
 			return
 		}
 
-		// Soft delete
+		// Moves the photo to the trash, the blob stays until it is purged
 		if err := gdb.WithContext(r.Context()).Delete(&p).Error; err != nil {
 			writeError(w, http.StatusInternalServerError, "db_delete_failed")
 			return
 		}
-
-		if err := s3.DeleteObject(r.Context(), s3.Config.BucketPhotos, p.OriginKey); err != nil {
-		}
+		publish(r.Context(), gdb, p.OwnerID, events.PhotoDeleted, p.ID, map[string]any{"id": p.ID})
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
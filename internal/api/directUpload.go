@@ -0,0 +1,225 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/config"
+	"github.com/AJMerr/little-moments-offline/internal/events"
+	"github.com/AJMerr/little-moments-offline/internal/media"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Files accepted in one POST /photos
+const maxDirectFiles = 50
+
+// Text fields are short, anything longer is not a title
+const maxFormField = 4 << 10
+
+// One file of a direct upload, either Photo or Error is set
+type directItem struct {
+	Filename  string         `json:"filename"`
+	Status    int            `json:"status"`
+	Photo     map[string]any `json:"photo,omitempty"`
+	Duplicate bool           `json:"duplicate,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	// The existing photo when on_duplicate=reject
+	PhotoID string `json:"photo_id,omitempty"`
+}
+
+// Form fields that apply to the files after them
+type directFields struct {
+	Title       string
+	Description string
+	OnDuplicate string
+}
+
+// Uploads photos through the server for clients that can't PUT to the
+// store: multipart/form-data with one or more "file" parts. Each file is
+// spooled to disk while it is hashed, checked like ConfirmPhoto and stored.
+// title, description and on_duplicate fields apply to the files after them.
+func UploadPhotos(gdb *gorm.DB, store storage.ObjectStore, uploads config.Uploads) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "multipart_required")
+			return
+		}
+
+		// Large files take as long as they take
+		rc := http.NewResponseController(w)
+		_ = rc.SetReadDeadline(time.Time{})
+		_ = rc.SetWriteDeadline(time.Time{})
+
+		fields := directFields{OnDuplicate: dupLink}
+		items := []directItem{}
+		// Files before the bad part are already stored, the client still
+		// learns what became of them
+		fail := func(code int, msg string) {
+			if len(items) == 0 {
+				writeError(w, code, msg)
+				return
+			}
+			toJSON(w, code, map[string]any{"error": msg, "items": items})
+		}
+		for {
+			part, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				fail(http.StatusBadRequest, "bad_multipart")
+				return
+			}
+
+			if part.FileName() == "" {
+				if msg := readDirectField(part, &fields); msg != "" {
+					fail(http.StatusBadRequest, msg)
+					return
+				}
+				continue
+			}
+			if len(items) == maxDirectFiles {
+				fail(http.StatusRequestEntityTooLarge, "too_many_files")
+				return
+			}
+			items = append(items, storeDirectFile(r.Context(), gdb, store, uploads, ownerID(r), part, fields))
+		}
+		if len(items) == 0 {
+			writeError(w, http.StatusBadRequest, "no_files")
+			return
+		}
+
+		// 201 if anything was stored, otherwise the first file's status so a
+		// single-file curl gets a meaningful code
+		code := items[0].Status
+		for _, it := range items {
+			if it.Status == http.StatusCreated {
+				code = http.StatusCreated
+			}
+		}
+		toJSON(w, code, map[string]any{"items": items})
+	}
+}
+
+// Reads a text field into fields, returns the error code for a bad one
+func readDirectField(part *multipart.Part, fields *directFields) string {
+	b, err := io.ReadAll(io.LimitReader(part, maxFormField+1))
+	if err != nil {
+		return "bad_multipart"
+	}
+	if len(b) > maxFormField {
+		return "field_too_long"
+	}
+	v := strings.TrimSpace(string(b))
+	switch part.FormName() {
+	case "title":
+		fields.Title = v
+	case "description":
+		fields.Description = v
+	case "on_duplicate":
+		switch v {
+		case "":
+			v = dupLink
+		case dupLink, dupReject, dupKeep:
+		default:
+			return "bad_on_duplicate"
+		}
+		fields.OnDuplicate = v
+	}
+	return ""
+}
+
+func storeDirectFile(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, uploads config.Uploads, owner string, part *multipart.Part, fields directFields) directItem {
+	item := directItem{Filename: part.FileName()}
+	fail := func(err error) directItem {
+		item.Status, item.Error = uploadErrorStatus(err)
+		return item
+	}
+
+	tmp, err := os.CreateTemp("", "lm-upload-")
+	if err != nil {
+		log.Printf("upload: %v", err)
+		item.Status, item.Error = http.StatusInternalServerError, "spool_failed"
+		return item
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// One byte past the limit is enough to know it's too big
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(part, int64(uploads.MaxBytes)+1))
+	if err != nil {
+		item.Status, item.Error = http.StatusBadRequest, "read_failed"
+		return item
+	}
+	if size == 0 {
+		return fail(errBytesRequired)
+	}
+	if size > int64(uploads.MaxBytes) {
+		return fail(errTooLarge)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	head := make([]byte, min(size, media.ExifHeadBytes))
+	if _, err := tmp.ReadAt(head, 0); err != nil {
+		item.Status, item.Error = http.StatusInternalServerError, "spool_failed"
+		return item
+	}
+	obj := verifiedObject{Bytes: size, ContentType: media.Sniff(head), Head: head}
+	if !uploads.Allows(obj.ContentType) {
+		return fail(errUnsupportedType)
+	}
+
+	// Duplicates are settled before anything is written to the store
+	if fields.OnDuplicate != dupKeep {
+		dup, err := findDuplicate(ctx, gdb, owner, sum, "")
+		if err != nil {
+			return fail(err)
+		}
+		if dup != nil {
+			if fields.OnDuplicate == dupReject {
+				item.Status, item.Error, item.PhotoID = http.StatusConflict, "duplicate", dup.ID
+				return item
+			}
+			item.Status, item.Photo, item.Duplicate = http.StatusOK, confirmOut(*dup), true
+			return item
+		}
+	}
+	if err := checkQuota(ctx, gdb, uploads, owner, "", size); err != nil {
+		return fail(err)
+	}
+
+	key, _ := uploadTarget(part.FileName(), obj.ContentType)
+	if err := store.PutObjectFrom(ctx, store.PhotosBucket(), key, obj.ContentType, tmp, size); err != nil {
+		log.Printf("upload: put %s: %v", key, err)
+		item.Status, item.Error = http.StatusBadGateway, "storage_failed"
+		return item
+	}
+
+	title := fields.Title
+	if title == "" {
+		title = part.FileName()
+	}
+	photo := newPhotoRow(owner, key, title, fields.Description, obj, sum)
+	if err := gdb.WithContext(ctx).Create(&photo).Error; err != nil {
+		_ = store.DeleteObject(context.WithoutCancel(ctx), store.PhotosBucket(), key)
+		item.Status, item.Error = http.StatusInternalServerError, "db_insert_failed"
+		return item
+	}
+	queueVariants(gdb, store, photo)
+	publish(ctx, gdb, owner, events.PhotoCreated, photo.ID, confirmOut(photo))
+
+	item.Status, item.Photo = http.StatusCreated, confirmOut(photo)
+	return item
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Name of the metadata file written at the end of every archive
+const manifestName = "manifest.json"
+
+type downloadReq struct {
+	PhotoIDs []string `json:"photo_ids"`
+}
+
+type manifestPhoto struct {
+	File        string    `json:"file"`
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	ContentType string    `json:"content_type"`
+	Bytes       int64     `json:"bytes"`
+	CreatedAt   time.Time `json:"created_at"`
+	CapturedAt  time.Time `json:"captured_at"`
+	// The blob couldn't be read, the entry is in the manifest only
+	Missing bool `json:"missing,omitempty"`
+}
+
+type manifest struct {
+	GeneratedAt time.Time       `json:"generated_at"`
+	Album       *albumOut       `json:"album,omitempty"`
+	Photos      []manifestPhoto `json:"photos"`
+}
+
+// Streams an album's live photos as a ZIP, in the album's sort order
+func DownloadAlbum(gdb *gorm.DB, store storage.ObjectStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var a db.Album
+		if err := gdb.WithContext(r.Context()).
+			Where("id = ? AND owner_id = ?", r.PathValue("id"), ownerID(r)).
+			First(&a).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				writeError(w, http.StatusNotFound, "album_not_found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "db_load_failed")
+			return
+		}
+
+		mode := a.SortMode
+		if !validAlbumSort(mode) {
+			mode = db.AlbumSortAdded
+		}
+		var photos []db.Photo
+		if err := gdb.WithContext(r.Context()).
+			Table("album_photos ap").
+			Select("p.*").
+			Joins("JOIN photos p ON p.id = ap.photo_id").
+			Where("ap.album_id = ? AND p.deleted_at IS NULL", a.ID).
+			Order(albumSortOrder[mode]).
+			Scan(&photos).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_list_failed")
+			return
+		}
+
+		album := albumOut{
+			ID:           a.ID,
+			Title:        a.Title,
+			Description:  a.Description,
+			CoverPhotoID: a.CoverPhotoID,
+			SortMode:     a.SortMode,
+			CreatedAt:    a.CreatedAt,
+		}
+		streamZip(w, r, store, a.Title, &album, photos)
+	}
+}
+
+// Streams a selection of the caller's photos as a ZIP, in the order given
+func DownloadPhotos(gdb *gorm.DB, store storage.ObjectStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req downloadReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_json")
+			return
+		}
+		ids := uniqueStrings(req.PhotoIDs)
+		if len(ids) == 0 {
+			writeError(w, http.StatusBadRequest, "missing_fields")
+			return
+		}
+
+		var rows []db.Photo
+		if err := gdb.WithContext(r.Context()).
+			Where("id IN ? AND owner_id = ?", ids, ownerID(r)).
+			Find(&rows).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_list_failed")
+			return
+		}
+		if len(rows) != len(ids) {
+			writeError(w, http.StatusBadRequest, "photo_not_found")
+			return
+		}
+
+		byID := make(map[string]db.Photo, len(rows))
+		for _, p := range rows {
+			byID[p.ID] = p
+		}
+		photos := make([]db.Photo, 0, len(ids))
+		for _, id := range ids {
+			photos = append(photos, byID[id])
+		}
+		streamZip(w, r, store, "photos", nil, photos)
+	}
+}
+
+// Writes the archive straight to the client, one object at a time, so memory
+// stays flat no matter how big the album is. Once the headers are out errors
+// can only be logged, the client sees a truncated archive.
+func streamZip(w http.ResponseWriter, r *http.Request, store storage.ObjectStore, name string, album *albumOut, photos []db.Photo) {
+	ctx := r.Context()
+
+	// Big archives take longer than any sane write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": safeFileName(name, "download") + ".zip",
+	}))
+	w.WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(w)
+	// The manifest's name is taken before any photo is named
+	names := fileNamer{manifestName: true}
+	man := manifest{GeneratedAt: time.Now().UTC(), Album: album, Photos: make([]manifestPhoto, 0, len(photos))}
+
+	for _, p := range photos {
+		if err := ctx.Err(); err != nil {
+			return
+		}
+
+		entry := manifestPhoto{
+			File:        names.name(p),
+			ID:          p.ID,
+			Title:       p.Title,
+			Description: p.Description,
+			ContentType: p.ContentType,
+			Bytes:       p.Bytes,
+			CreatedAt:   p.CreatedAt,
+			CapturedAt:  p.CapturedAt,
+		}
+
+		err := copyObject(ctx, zw, store, p, entry.File)
+		if errors.Is(err, errSkipObject) {
+			entry.Missing = true
+		} else if err != nil {
+			log.Printf("download: %s: %v", p.ID, err)
+			return
+		}
+		man.Photos = append(man.Photos, entry)
+	}
+
+	mw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     manifestName,
+		Method:   zip.Deflate,
+		Modified: man.GeneratedAt,
+	})
+	if err != nil {
+		return
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(man); err != nil {
+		return
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("download: close: %v", err)
+	}
+}
+
+var errSkipObject = errors.New("object missing")
+
+// Copies one blob into the archive. Photos are already compressed so entries are stored as is.
+func copyObject(ctx context.Context, zw *zip.Writer, store storage.ObjectStore, p db.Photo, name string) error {
+	body, err := store.GetObject(ctx, store.PhotosBucket(), p.OriginKey)
+	if err != nil {
+		if storage.IsNotFound(err) {
+			return errSkipObject
+		}
+		return err
+	}
+	defer body.Close()
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: p.CapturedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, ctxReader{ctx: ctx, r: body})
+	return err
+}
+
+// Stops a copy as soon as the request is cancelled, whatever the store does with ctx
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Hands out archive file names from photo titles, "name (2).jpg" on clashes
+type fileNamer map[string]bool
+
+func (f fileNamer) name(p db.Photo) string {
+	ext := strings.ToLower(path.Ext(p.OriginKey))
+	if ext == "" {
+		if exts, _ := mime.ExtensionsByType(p.ContentType); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	// Titles that are file names ("IMG_0001.jpg") don't get the extension twice
+	title := p.Title
+	if ext != "" && strings.EqualFold(path.Ext(title), ext) {
+		title = title[:len(title)-len(ext)]
+	}
+	base := safeFileName(title, p.ID)
+
+	name := base + ext
+	for n := 2; f[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	f[strings.ToLower(name)] = true
+	return name
+}
+
+// Keeps a title usable as a file name on every OS, fallback when nothing is left
+func safeFileName(s, fallback string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case strings.ContainsRune(`/\:*?"<>|`, r), unicode.IsControl(r):
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(s))
+	s = strings.Trim(s, ". ")
+	if len([]rune(s)) > 100 {
+		s = string([]rune(s)[:100])
+	}
+	if s == "" {
+		return fallback
+	}
+	return s
+}
@@ -0,0 +1,489 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/config"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
+	"github.com/AJMerr/little-moments-offline/internal/media"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Hex SHA-256 of an object, read in one pass
+func hashObject(ctx context.Context, store storage.ObjectStore, key string) (string, error) {
+	body, err := store.GetObject(ctx, store.PhotosBucket(), key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Hashes photos confirmed before hashes existed (or imported without a
+// thumbnail yet) every interval until ctx is cancelled
+func RunHashBackfill(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Photos that failed are only retried after a restart
+	failed := map[string]bool{}
+	for {
+		if n := backfillHashes(ctx, gdb, store, failed); n > 0 {
+			log.Printf("hashes: backfilled %d photos", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func backfillHashes(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, failed map[string]bool) int {
+	done := 0
+	after := ""
+	for ctx.Err() == nil {
+		var photos []db.Photo
+		if err := gdb.WithContext(ctx).Preload("Exif").
+			Where("id > ? AND (sha256 = '' OR (dhash IS NULL AND content_type LIKE 'image/%'))", after).
+			Order("id").Limit(50).Find(&photos).Error; err != nil {
+			if ctx.Err() == nil {
+				log.Printf("hashes: %v", err)
+			}
+			return done
+		}
+		if len(photos) == 0 {
+			return done
+		}
+		for _, p := range photos {
+			after = p.ID
+			if failed[p.ID] {
+				continue
+			}
+			if err := backfillPhoto(ctx, gdb, store, p); err != nil {
+				if ctx.Err() != nil {
+					return done
+				}
+				log.Printf("hashes %s: %v", p.ID, err)
+				failed[p.ID] = true
+				continue
+			}
+			done++
+		}
+	}
+	return done
+}
+
+func backfillPhoto(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, p db.Photo) error {
+	updates := map[string]any{}
+	if p.SHA256 == "" {
+		sum, err := hashObject(ctx, store, p.OriginKey)
+		if err != nil {
+			return err
+		}
+		updates["sha256"] = sum
+	}
+	if p.DHash == nil && strings.HasPrefix(p.ContentType, "image/") {
+		h, err := dhashPhoto(ctx, gdb, store, p)
+		if err != nil {
+			return err
+		}
+		updates["dhash"] = h
+	}
+	return gdb.WithContext(ctx).Model(&db.Photo{}).Where("id = ?", p.ID).Updates(updates).Error
+}
+
+// Decodes the thumbnail when there is one, it is already upright and far
+// smaller than the original
+func dhashPhoto(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, p db.Photo) (int64, error) {
+	key, orientation := p.OriginKey, 0
+	if p.Exif != nil {
+		orientation = p.Exif.Orientation
+	}
+	var thumbs []db.PhotoVariant
+	if err := gdb.WithContext(ctx).
+		Where("photo_id = ? AND variant = ? AND status = ?", p.ID, "thumb", db.VariantReady).
+		Limit(1).Find(&thumbs).Error; err != nil {
+		return 0, err
+	}
+	if len(thumbs) > 0 {
+		key, orientation = thumbs[0].Key, 0
+	}
+
+	body, err := store.GetObject(ctx, store.PhotosBucket(), key)
+	if err != nil {
+		return 0, err
+	}
+	img, err := media.Decode(body)
+	body.Close()
+	if err != nil {
+		return 0, err
+	}
+	return int64(media.DHash(img, orientation)), nil
+}
+
+// Duplicate search modes, similar includes exact matches
+const (
+	dupModeExact   = "exact"
+	dupModeSimilar = "similar"
+)
+
+// Bits two dHashes may differ by and still count as the same picture
+const (
+	defaultDupDistance = 6
+	maxDupDistance     = 16
+)
+
+type dupRow struct {
+	ID          string
+	Title       string
+	Description string
+	OriginKey   string
+	ContentType string
+	Bytes       int64
+	CreatedAt   time.Time
+	CapturedAt  time.Time
+	SHA256      string `gorm:"column:sha256"`
+	DHash       *int64 `gorm:"column:dhash"`
+	Albums      int
+}
+
+type dupPhotoOut struct {
+	photoOut
+	SHA256 string `json:"sha256"`
+	Albums int    `json:"albums"`
+	// Bits from the keeper's dHash, omitted when either has none
+	Distance *int `json:"distance,omitempty"`
+	dhash    *int64
+}
+
+type dupCluster struct {
+	// exact when every photo has the same bytes, similar otherwise
+	Kind   string        `json:"kind"`
+	KeepID string        `json:"keep_id"`
+	Photos []dupPhotoOut `json:"photos"`
+}
+
+// Reads ?mode= and ?distance= (or the same fields of a resolve body)
+func dupParams(mode, distance string) (string, int, bool) {
+	if mode == "" {
+		mode = dupModeSimilar
+	}
+	if mode != dupModeExact && mode != dupModeSimilar {
+		return "", 0, false
+	}
+	d := defaultDupDistance
+	if distance != "" {
+		n, err := strconv.Atoi(distance)
+		if err != nil || n < 0 || n > maxDupDistance {
+			return "", 0, false
+		}
+		d = n
+	}
+	return mode, d, true
+}
+
+// Groups the owner's live photos by identical content and, in similar mode,
+// by dHash distance. Every cluster has at least two photos.
+func findDuplicates(ctx context.Context, gdb *gorm.DB, owner, mode string, distance int) ([]dupCluster, error) {
+	var rows []dupRow
+	if err := gdb.WithContext(ctx).Raw(`
+		SELECT p.id, p.title, p.description, p.origin_key, p.content_type, p.bytes,
+			p.created_at, p.captured_at, p.sha256, p.dhash,
+			(SELECT COUNT(*) FROM album_photos ap JOIN albums a ON a.id = ap.album_id
+				WHERE ap.photo_id = p.id AND a.deleted_at IS NULL) AS albums
+		FROM photos p
+		WHERE p.owner_id = ? AND p.deleted_at IS NULL AND (p.sha256 <> '' OR p.dhash IS NOT NULL)
+		ORDER BY p.id`, owner).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	// Union-find over row indexes
+	parent := make([]int, len(rows))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(a, b int) { parent[find(a)] = find(b) }
+
+	bySum := map[string]int{}
+	for i, r := range rows {
+		if r.SHA256 == "" {
+			continue
+		}
+		if j, ok := bySum[r.SHA256]; ok {
+			union(i, j)
+		} else {
+			bySum[r.SHA256] = i
+		}
+	}
+	if mode == dupModeSimilar {
+		// Pairwise, a few thousand photos compare in milliseconds
+		for i := range rows {
+			if rows[i].DHash == nil {
+				continue
+			}
+			for j := i + 1; j < len(rows); j++ {
+				if rows[j].DHash != nil && media.Hamming(uint64(*rows[i].DHash), uint64(*rows[j].DHash)) <= distance {
+					union(i, j)
+				}
+			}
+		}
+	}
+
+	groups := map[int][]dupRow{}
+	for i, r := range rows {
+		root := find(i)
+		groups[root] = append(groups[root], r)
+	}
+
+	clusters := []dupCluster{}
+	for _, g := range groups {
+		if len(g) < 2 {
+			continue
+		}
+		clusters = append(clusters, newDupCluster(g))
+	}
+	// Biggest clusters first, then newest capture
+	sort.Slice(clusters, func(i, j int) bool {
+		a, b := clusters[i], clusters[j]
+		if len(a.Photos) != len(b.Photos) {
+			return len(a.Photos) > len(b.Photos)
+		}
+		if !a.Photos[0].CapturedAt.Equal(b.Photos[0].CapturedAt) {
+			return a.Photos[0].CapturedAt.After(b.Photos[0].CapturedAt)
+		}
+		return a.KeepID < b.KeepID
+	})
+	return clusters, nil
+}
+
+// Picks the photo to keep and lists it first. Exact copies keep the one in
+// the most albums, near-duplicates the largest file; the oldest upload breaks ties.
+func newDupCluster(g []dupRow) dupCluster {
+	exact := true
+	for _, r := range g {
+		if r.SHA256 == "" || r.SHA256 != g[0].SHA256 {
+			exact = false
+		}
+	}
+	sort.Slice(g, func(i, j int) bool {
+		a, b := g[i], g[j]
+		if !exact && a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		if a.Albums != b.Albums {
+			return a.Albums > b.Albums
+		}
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	})
+
+	c := dupCluster{Kind: dupModeSimilar, KeepID: g[0].ID}
+	if exact {
+		c.Kind = dupModeExact
+	}
+	for _, r := range g {
+		out := dupPhotoOut{
+			photoOut: photoOut{
+				ID:          r.ID,
+				Title:       r.Title,
+				Description: r.Description,
+				OriginKey:   r.OriginKey,
+				ContentType: r.ContentType,
+				Bytes:       r.Bytes,
+				CreatedAt:   r.CreatedAt,
+				CapturedAt:  r.CapturedAt,
+			},
+			SHA256: r.SHA256,
+			Albums: r.Albums,
+			dhash:  r.DHash,
+		}
+		if g[0].DHash != nil && r.DHash != nil {
+			d := media.Hamming(uint64(*g[0].DHash), uint64(*r.DHash))
+			out.Distance = &d
+		}
+		c.Photos = append(c.Photos, out)
+	}
+	return c
+}
+
+// Lists clusters of duplicate photos, ?mode=exact|similar, ?distance=0-16
+func GetDuplicates(gdb *gorm.DB, pages config.Pages) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		mode, distance, ok := dupParams(q.Get("mode"), q.Get("distance"))
+		if !ok {
+			writeError(w, http.StatusBadRequest, "bad_params")
+			return
+		}
+		limit := pages.Default
+		if s := q.Get("limit"); s != "" {
+			if n, err := strconv.Atoi(s); err == nil && n > 0 {
+				limit = min(n, pages.Max)
+			}
+		}
+
+		clusters, err := findDuplicates(r.Context(), gdb, ownerID(r), mode, distance)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_query_failed")
+			return
+		}
+		total := len(clusters)
+		toJSON(w, http.StatusOK, map[string]any{
+			"clusters": clusters[:min(limit, total)],
+			"total":    total,
+		})
+	}
+}
+
+type resolveDupReq struct {
+	// exact unless the body asks for similar
+	Mode     string `json:"mode"`
+	Distance *int   `json:"distance"`
+	// Photos to keep instead of each cluster's keep_id. When set, only the
+	// clusters containing one of them are resolved.
+	Keep []string `json:"keep"`
+}
+
+// Whether p may be trashed in favour of keeper: the same bytes, or in similar
+// mode a dHash within distance of the keeper's own. Clusters are chained
+// pair by pair, so their far ends can be different pictures.
+func sameAsKeeper(keeper, p dupPhotoOut, mode string, distance int) bool {
+	if keeper.SHA256 != "" && keeper.SHA256 == p.SHA256 {
+		return true
+	}
+	return mode == dupModeSimilar && keeper.dhash != nil && p.dhash != nil &&
+		media.Hamming(uint64(*keeper.dhash), uint64(*p.dhash)) <= distance
+}
+
+// Keeps one photo per cluster and moves its copies to the trash, only exact
+// ones unless the body asks for similar. Album membership, covers and tags
+// of the trashed copies carry over to the keeper.
+func ResolveDuplicates(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req resolveDupReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, "bad_json")
+			return
+		}
+		distance := ""
+		if req.Distance != nil {
+			distance = strconv.Itoa(*req.Distance)
+		}
+		// Trashing is the one place a loose match costs photos
+		if req.Mode == "" {
+			req.Mode = dupModeExact
+		}
+		mode, d, ok := dupParams(req.Mode, distance)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "bad_params")
+			return
+		}
+
+		clusters, err := findDuplicates(r.Context(), gdb, ownerID(r), mode, d)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_query_failed")
+			return
+		}
+
+		keep := map[string]bool{}
+		for _, id := range req.Keep {
+			keep[id] = true
+		}
+		kept := []string{}
+		var trashedIDs []string
+		err = gdb.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			for _, c := range clusters {
+				keeper := c.Photos[0]
+				if len(keep) > 0 {
+					found := false
+					for _, p := range c.Photos {
+						if keep[p.ID] {
+							keeper, found = p, true
+							break
+						}
+					}
+					if !found {
+						continue
+					}
+				}
+				var rest []string
+				for _, p := range c.Photos {
+					if p.ID != keeper.ID && sameAsKeeper(keeper, p, mode, d) {
+						rest = append(rest, p.ID)
+					}
+				}
+				if len(rest) == 0 {
+					continue
+				}
+				if err := mergeDuplicates(tx, keeper.ID, rest); err != nil {
+					return err
+				}
+				kept = append(kept, keeper.ID)
+				trashedIDs = append(trashedIDs, rest...)
+			}
+			return nil
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_update_failed")
+			return
+		}
+		// The keepers picked up the albums and tags of the rest
+		for _, id := range trashedIDs {
+			publish(r.Context(), gdb, ownerID(r), events.PhotoDeleted, id, map[string]any{"id": id})
+		}
+		for _, id := range kept {
+			publish(r.Context(), gdb, ownerID(r), events.PhotoUpdated, id, map[string]any{"id": id})
+		}
+		toJSON(w, http.StatusOK, map[string]any{"kept": kept, "trashed": len(trashedIDs)})
+	}
+}
+
+func mergeDuplicates(tx *gorm.DB, keeper string, rest []string) error {
+	if err := tx.Exec(`
+		INSERT INTO album_photos (album_id, photo_id, pos, added_at)
+		SELECT album_id, ?, MIN(pos), MIN(added_at) FROM album_photos
+		WHERE photo_id IN ? GROUP BY album_id
+		ON CONFLICT DO NOTHING`, keeper, rest).Error; err != nil {
+		return err
+	}
+	if err := tx.Exec(`
+		INSERT INTO photo_tags (photo_id, tag_id, created_at)
+		SELECT ?, tag_id, MIN(created_at) FROM photo_tags
+		WHERE photo_id IN ? GROUP BY tag_id
+		ON CONFLICT DO NOTHING`, keeper, rest).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&db.Album{}).Unscoped().
+		Where("cover_photo_id IN ?", rest).
+		Update("cover_photo_id", keeper).Error; err != nil {
+		return err
+	}
+	return tx.Where("id IN ?", rest).Delete(&db.Photo{}).Error
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/events"
+	"gorm.io/gorm"
+)
+
+// Comment lines keep proxies and the browser from timing the stream out
+const eventHeartbeat = 25 * time.Second
+
+// Events replayed per query when a client catches up
+const eventReplayPage = 500
+
+// Records a change for GET /events. The write already happened, so a
+// failure is only logged.
+func publish(ctx context.Context, gdb *gorm.DB, owner, typ, subject string, data any) {
+	if _, err := events.Default.Publish(context.WithoutCancel(ctx), gdb, owner, typ, subject, data); err != nil {
+		log.Printf("events: publish %s %s: %v", typ, subject, err)
+	}
+}
+
+// Streams the caller's changes as Server-Sent Events. A reconnecting client
+// sends Last-Event-ID (or ?last_event_id=) and gets what it missed from the
+// log first. ?types= narrows the stream to types like photo.created, or to
+// whole kinds like album. A "reset" event means the log no longer goes back
+// far enough and the client should reload.
+func GetEvents(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lastID := int64(0)
+		last := r.Header.Get("Last-Event-ID")
+		if last == "" {
+			last = r.URL.Query().Get("last_event_id")
+		}
+		if last != "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				writeError(w, http.StatusBadRequest, "bad_last_event_id")
+				return
+			}
+			lastID = n
+		}
+		var types []string
+		if s := r.URL.Query().Get("types"); s != "" {
+			for _, t := range strings.Split(s, ",") {
+				types = append(types, strings.TrimSpace(t))
+			}
+		}
+		wanted := func(ev events.Event) bool { return events.Match(types, ev.Type) }
+
+		// Subscribed before the replay so nothing falls in between
+		owner := ownerID(r)
+		sub := events.Default.Subscribe(owner)
+		defer sub.Close()
+
+		rc := http.NewResponseController(w)
+		_ = rc.SetWriteDeadline(time.Time{})
+		h := w.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		h.Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		send := func(ev events.Event) error {
+			_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, ev.Data)
+			return err
+		}
+
+		if lastID > 0 {
+			oldest, err := events.Oldest(r.Context(), gdb)
+			if err != nil {
+				log.Printf("events: %v", err)
+				return
+			}
+			if oldest > lastID+1 {
+				if _, err := fmt.Fprintf(w, "event: reset\ndata: {}\n\n"); err != nil {
+					return
+				}
+			}
+			for {
+				page, err := events.Since(r.Context(), gdb, owner, lastID, eventReplayPage)
+				if err != nil {
+					if r.Context().Err() == nil {
+						log.Printf("events: replay: %v", err)
+					}
+					return
+				}
+				for _, ev := range page {
+					if wanted(ev) {
+						if err := send(ev); err != nil {
+							return
+						}
+					}
+					lastID = ev.ID
+				}
+				if len(page) < eventReplayPage {
+					break
+				}
+			}
+		}
+		// Tells the browser how soon to reconnect when the stream ends
+		if _, err := fmt.Fprintf(w, "retry: 3000\n\n"); err != nil {
+			return
+		}
+		_ = rc.Flush()
+
+		heartbeat := time.NewTicker(eventHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case ev, ok := <-sub.C:
+				if !ok {
+					// Too far behind or shutting down, the client reconnects and replays
+					if sub.Dropped() {
+						log.Printf("events: %s fell behind, stream closed", owner)
+					}
+					return
+				}
+				// Already sent by the replay
+				if ev.ID <= lastID || !wanted(ev) {
+					continue
+				}
+				lastID = ev.ID
+				if err := send(ev); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprintf(w, ": ping\n\n"); err != nil {
+					return
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
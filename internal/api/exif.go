@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/media"
+	"gorm.io/gorm"
+)
+
+type exifOut struct {
+	TakenAt      *time.Time `json:"taken_at,omitempty"`
+	CameraMake   string     `json:"camera_make,omitempty"`
+	CameraModel  string     `json:"camera_model,omitempty"`
+	LensModel    string     `json:"lens_model,omitempty"`
+	ExposureTime string     `json:"exposure_time,omitempty"`
+	FNumber      float64    `json:"f_number,omitempty"`
+	ISO          int        `json:"iso,omitempty"`
+	FocalLength  float64    `json:"focal_length,omitempty"`
+	Width        int        `json:"width,omitempty"`
+	Height       int        `json:"height,omitempty"`
+	Orientation  int        `json:"orientation,omitempty"`
+}
+
+// Parses EXIF from the leading bytes of the object, best effort
+func exifFromHead(head []byte) (*db.PhotoExif, bool) {
+	x, err := media.ReadExif(head)
+	if err != nil && x.Width == 0 {
+		return nil, false
+	}
+	return &db.PhotoExif{
+		TakenAt:      x.TakenAt,
+		CameraMake:   x.CameraMake,
+		CameraModel:  x.CameraModel,
+		LensModel:    x.LensModel,
+		ExposureTime: x.ExposureTime,
+		FNumber:      x.FNumber,
+		ISO:          x.ISO,
+		FocalLength:  x.FocalLength,
+		Width:        x.Width,
+		Height:       x.Height,
+		Orientation:  x.Orientation,
+	}, true
+}
+
+func toExifOut(e *db.PhotoExif) *exifOut {
+	if e == nil {
+		return nil
+	}
+	return &exifOut{
+		TakenAt:      e.TakenAt,
+		CameraMake:   e.CameraMake,
+		CameraModel:  e.CameraModel,
+		LensModel:    e.LensModel,
+		ExposureTime: e.ExposureTime,
+		FNumber:      e.FNumber,
+		ISO:          e.ISO,
+		FocalLength:  e.FocalLength,
+		Width:        e.Width,
+		Height:       e.Height,
+		Orientation:  e.Orientation,
+	}
+}
+
+// Loads EXIF rows for a page of photos in one query
+func loadExif(ctx context.Context, gdb *gorm.DB, ids []string) (map[string]*exifOut, error) {
+	out := make(map[string]*exifOut, len(ids))
+	if len(ids) == 0 {
+		return out, nil
+	}
+	var rows []db.PhotoExif
+	if err := gdb.WithContext(ctx).Where("photo_id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		out[rows[i].PhotoID] = toExifOut(&rows[i])
+	}
+	return out, nil
+}
@@ -21,3 +21,17 @@ func toJSON(w http.ResponseWriter, code int, v any) {
 func writeError(w http.ResponseWriter, code int, message string) {
 	toJSON(w, code, map[string]any{"error": message})
 }
+
+// Drops duplicate IDs, keeping the first occurrence
+func uniqueStrings(in []string) []string {
+	seen := make(map[string]struct{}, len(in))
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		out = append(out, s)
+	}
+	return out
+}
@@ -6,12 +6,19 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/auth"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/metrics"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"gorm.io/gorm"
 )
 
 // X-Request-ID middleware
@@ -84,19 +91,31 @@ func (rw *resMeta) Write(p []byte) (int, error) {
 	return n, err
 }
 
-// Logs data from rec and returns the data as JSON via os.Stdout when a request is made
-func logger(next http.Handler) http.Handler {
+// Lets http.ResponseController reach Flush and the write deadlines underneath
+func (rw *resMeta) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Logs data from rec and returns the data as JSON via os.Stdout when a request is made.
+// Also records the request metrics, labelled by the mux pattern so /photos/{id} is one series.
+func logger(routes *http.ServeMux, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		wrapped := &resMeta{ResponseWriter: w, status: 200}
 		next.ServeHTTP(wrapped, r)
+		route := routePattern(routes, r)
+		status := strconv.Itoa(wrapped.status)
+		metrics.HTTPRequests.Inc(r.Method, route, status)
+		metrics.HTTPDuration.Observe(time.Since(start).Seconds(), r.Method, route, status)
+
 		id, _ := reqIDFromCtx(r.Context())
 		rec := map[string]any{
 			"ts":         time.Now().Format(time.RFC3339Nano),
 			"level":      "info",
 			"request_id": id,
 			"method":     r.Method,
-			"path":       r.URL.Path,
+			"path":       logPath(r),
+			"route":      route,
 			"status":     wrapped.status,
 			"bytes":      wrapped.bytes,
 			"latency_ms": time.Since(start).Milliseconds(),
@@ -107,6 +126,33 @@ func logger(next http.Handler) http.Handler {
 	})
 }
 
+// The pattern that matches r without the method, "unmatched" for 404s and
+// preflights so unknown paths can't blow up the label set
+func routePattern(routes *http.ServeMux, r *http.Request) string {
+	_, pattern := routes.Handler(r)
+	if pattern == "" {
+		return "unmatched"
+	}
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		pattern = pattern[i+1:]
+	}
+	return pattern
+}
+
+// The request path with share tokens masked, only their hash is stored so
+// the logs mustn't hold them either
+func logPath(r *http.Request) string {
+	rest, ok := strings.CutPrefix(r.URL.Path, sharePathPrefix)
+	if !ok {
+		return r.URL.Path
+	}
+	_, tail, _ := strings.Cut(rest, "/")
+	if tail != "" {
+		tail = "/" + tail
+	}
+	return sharePathPrefix + "{token}" + tail
+}
+
 // Panic recovery
 // This will return a JSON log with a status of 500 as well as a stack trace
 func panicRecovery(next http.Handler) http.Handler {
@@ -123,7 +169,7 @@ func panicRecovery(next http.Handler) http.Handler {
 					"panic":      fmt.Sprint(rec),
 					"stack":      string(debug.Stack()),
 					"method":     r.Method,
-					"path":       r.URL.Path,
+					"path":       logPath(r),
 				}
 				_ = json.NewEncoder(os.Stdout).Encode(errRec)
 
@@ -139,47 +185,138 @@ func panicRecovery(next http.Handler) http.Handler {
 }
 
 // CORS Middleware for the front end
-var allowedOrigins = map[string]struct{}{
-	"http://localhost:5173": {},
-	"http://127.0.0.1:5173": {},
-}
+// Adds headers for the configured origins and short circuits preflight
+func cors(origins []string) func(http.Handler) http.Handler {
+	allowedOrigins := make(map[string]struct{}, len(origins))
+	for _, o := range origins {
+		allowedOrigins[strings.TrimSuffix(o, "/")] = struct{}{}
+	}
 
-// Adds headers and short circuits preflight
-func cors(next http.Handler) http.Handler {
-	allowedMethods := "GET,POST,PATCH,DELETE,OPTIONS"
-	allowedHeaders := "Content-Type, Authorization, X-Request-ID"
+	allowedMethods := "GET,POST,PUT,PATCH,DELETE,OPTIONS"
+	allowedHeaders := "Content-Type, Authorization, X-Request-ID, " + sharePasswordHeader
 	exposeHeader := "ETag, X-Request-ID"
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-
-		w.Header().Add("Vary", "Origin")
-		w.Header().Add("Vary", "Access-Control-Request-Method")
-		w.Header().Add("Vary", "Access-Control-Request-Headers")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
 
-		// If req has an origin and is allowed, set CORS header
-		if origin != "" {
-			if _, ok := allowedOrigins[origin]; ok {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-				w.Header().Set("Access-Control-Expose-Header", exposeHeader)
-			}
-		}
+			w.Header().Add("Vary", "Origin")
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
 
-		// Preflight
-		if r.Method == http.MethodOptions {
-			// Only answer preflight for allowed origins
+			// If req has an origin and is allowed, set CORS header
 			if origin != "" {
 				if _, ok := allowedOrigins[origin]; ok {
-					w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
-					w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
-					w.Header().Set("Access-Control-Max-Age", "300")
-					w.WriteHeader(http.StatusNoContent)
-					return
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+					w.Header().Set("Access-Control-Expose-Header", exposeHeader)
 				}
 			}
-			w.WriteHeader(http.StatusNoContent)
-		}
 
-		next.ServeHTTP(w, r)
-	})
+			// Preflight
+			if r.Method == http.MethodOptions {
+				// Only answer preflight for allowed origins
+				if origin != "" {
+					if _, ok := allowedOrigins[origin]; ok {
+						w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+						w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+						w.Header().Set("Access-Control-Max-Age", "300")
+						w.WriteHeader(http.StatusNoContent)
+						return
+					}
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Auth middleware
+// Resolves the session cookie to a user and stores it in ctx
+type authUserKey struct{}
+
+type authUser struct {
+	ID      string
+	Email   string
+	IsAdmin bool
+}
+
+func storeAuthUser(ctx context.Context, u authUser) context.Context {
+	return context.WithValue(ctx, authUserKey{}, u)
+}
+
+// authUserFromCtx retrieves the logged in user from ctx
+func authUserFromCtx(ctx context.Context) (authUser, bool) {
+	u, ok := ctx.Value(authUserKey{}).(authUser)
+	return u, ok
+}
+
+// ownerID is the user every query is scoped to, only empty on public routes
+func ownerID(r *http.Request) string {
+	u, _ := authUserFromCtx(r.Context())
+	return u.ID
+}
+
+// Routes reachable without a session. Anything under /blob/ is protected by its URL signature.
+func isPublicPath(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/healthz", "/version", "/auth/login", "/auth/register", "/auth/logout":
+		return true
+	}
+	return strings.HasPrefix(r.URL.Path, storage.BlobPathPrefix) ||
+		strings.HasPrefix(r.URL.Path, sharePathPrefix)
+}
+
+// Looks up the session from the cookie, public routes still get the user when there is one
+func requireAuth(gdb *gorm.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if u, ok := sessionUser(r, gdb); ok {
+				r = r.WithContext(storeAuthUser(r.Context(), u))
+			} else if !isPublicPath(r) {
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// A session's last_seen_at is only written when it is older than this,
+// not on every request
+const lastSeenEvery = 5 * time.Minute
+
+func sessionUser(r *http.Request, gdb *gorm.DB) (authUser, bool) {
+	c, err := r.Cookie(auth.SessionCookie)
+	if err != nil || c.Value == "" {
+		return authUser{}, false
+	}
+
+	id := auth.HashToken(c.Value)
+	now := time.Now()
+	var row struct {
+		UserID     string
+		Email      string
+		IsAdmin    bool
+		LastSeenAt *time.Time
+	}
+	err = gdb.WithContext(r.Context()).
+		Table("sessions s").
+		Select("s.user_id, u.email, u.is_admin, s.last_seen_at").
+		Joins("JOIN users u ON u.id = s.user_id").
+		Where("s.id = ? AND s.expires_at > ?", id, now).
+		Take(&row).Error
+	if err != nil {
+		return authUser{}, false
+	}
+	if row.LastSeenAt == nil || now.Sub(*row.LastSeenAt) > lastSeenEvery {
+		if err := gdb.WithContext(r.Context()).Model(&db.Session{}).
+			Where("id = ?", id).UpdateColumn("last_seen_at", now).Error; err != nil {
+			log.Printf("session: last seen: %v", err)
+		}
+	}
+	return authUser{ID: row.UserID, Email: row.Email, IsAdmin: row.IsAdmin}, true
 }
@@ -5,19 +5,20 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/AJMerr/little-moments-offline/internal/config"
 	db "github.com/AJMerr/little-moments-offline/internal/db"
 	"github.com/AJMerr/little-moments-offline/internal/storage"
 	"gorm.io/gorm"
 )
 
-func GetPhotoUrl(gdb *gorm.DB, s3 *storage.S3) http.HandlerFunc {
+func GetPhotoUrl(gdb *gorm.DB, store storage.ObjectStore, presign config.Presign) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
 
 		// Photo Lookup
 		var p db.Photo
 		if err := gdb.WithContext(r.Context()).
-			Where("id = ? AND owner_id = ?", id, "local_user"). // DELETE LATER will use Auth
+			Where("id = ? AND owner_id = ?", id, ownerID(r)).
 			First(&p).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
 				writeError(w, http.StatusNotFound, "not_found")
@@ -27,24 +28,41 @@ func GetPhotoUrl(gdb *gorm.DB, s3 *storage.S3) http.HandlerFunc {
 			return
 		}
 
-		_ = r.URL.Query().Get("variant") //
+		// Serves a rendition when asked for one, falling back to the original while it is generated
 		key := p.OriginKey
+		served := "original"
+		pending := false
+		if variant := r.URL.Query().Get("variant"); variant != "" && variant != "original" {
+			if _, ok := variantSpecByName(variant); !ok {
+				writeError(w, http.StatusBadRequest, "bad_variant")
+				return
+			}
+
+			var v db.PhotoVariant
+			err := gdb.WithContext(r.Context()).
+				Where("photo_id = ? AND variant = ?", p.ID, variant).
+				First(&v).Error
+			switch {
+			case err == nil && v.Status == db.VariantReady:
+				key = v.Key
+				served = variant
+			case err == nil:
+				pending = v.Status == db.VariantPending
+			case err != gorm.ErrRecordNotFound:
+				writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+				return
+			}
+		}
 
 		// TTL
-		ttl := 5 * time.Minute
+		ttl := presign.Download.D()
 		if raw := r.URL.Query().Get("ttl"); raw != "" {
 			if secs, err := strconv.Atoi(raw); err == nil {
-				if secs < 10 {
-					secs = 10
-				}
-				if secs > 3000 {
-					secs = 3000
-				}
-				ttl = time.Duration(secs) * time.Second
+				ttl = min(max(time.Duration(secs)*time.Second, presign.MinDownload.D()), presign.MaxDownload.D())
 			}
 		}
 
-		url, err := s3.PresignGetObject(r.Context(), s3.Config.BucketPhotos, key, ttl)
+		url, err := store.PresignGetObject(r.Context(), store.PhotosBucket(), key, ttl)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, "presign_failed")
 			return
@@ -52,6 +70,8 @@ func GetPhotoUrl(gdb *gorm.DB, s3 *storage.S3) http.HandlerFunc {
 
 		toJSON(w, http.StatusOK, map[string]any{
 			"url":        url,
+			"variant":    served,
+			"pending":    pending,
 			"expires_at": time.Now().Add(ttl).UTC(),
 		})
 	}
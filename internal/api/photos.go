@@ -1,8 +1,11 @@
 package api
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"log"
 	"mime"
 	"net/http"
 	"path/filepath"
@@ -10,7 +13,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/AJMerr/little-moments-offline/internal/config"
 	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
+	"github.com/AJMerr/little-moments-offline/internal/media"
 	"github.com/AJMerr/little-moments-offline/internal/storage"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -19,6 +25,8 @@ import (
 type presignReq struct {
 	Filename    string `json:"filename"`
 	ContentType string `json:"content_type"`
+	// Exact size of the file, signed into the URL
+	Bytes int64 `json:"bytes"`
 }
 
 type presignRes struct {
@@ -27,8 +35,9 @@ type presignRes struct {
 	Headers map[string]string `json:"headers"`
 }
 
-// Presign handler to close over the MinIO client
-func PresignPhoto(s3 *storage.S3) http.HandlerFunc {
+// Presign handler to close over the MinIO client. The upload policy is checked
+// before signing and the store rejects a body of any other size.
+func PresignPhoto(gdb *gorm.DB, store storage.ObjectStore, ttl time.Duration, uploads config.Uploads) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var in presignReq
 		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
@@ -36,31 +45,24 @@ func PresignPhoto(s3 *storage.S3) http.HandlerFunc {
 			return
 		}
 
-		// Sanitizes filename
-		in.Filename = filepath.Clean(filepath.Base(strings.TrimSpace(in.Filename)))
-		content := strings.TrimSpace(in.ContentType)
-		if content == "" && in.Filename != "" {
-			if extension := strings.ToLower(filepath.Ext(in.Filename)); extension != "" {
-				if guess := mime.TypeByExtension(extension); guess != "" {
-					content = guess
-				}
-			}
-		}
+		key, content := uploadTarget(in.Filename, in.ContentType)
 		if content == "" {
 			writeError(w, http.StatusBadRequest, "content_type_required")
 			return
 		}
+		if !writeUploadError(w, checkUpload(r.Context(), gdb, uploads, ownerID(r), content, in.Bytes)) {
+			return
+		}
 
-		// UUID
-		id := uuid.NewString()
-		extension := strings.ToLower(filepath.Ext(in.Filename))
-		key := id + extension
-
-		url, headers, err := s3.PresignPut(r.Context(), s3.Config.BucketPhotos, key, content, 10*time.Minute)
+		url, headers, err := store.PresignPut(r.Context(), store.PhotosBucket(), key, content, in.Bytes, ttl)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, "presign_failed")
 			return
 		}
+		if err := issueUploadKey(r.Context(), gdb, ownerID(r), key); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_insert_failed")
+			return
+		}
 
 		toJSON(w, http.StatusOK, presignRes{
 			URL:     url,
@@ -70,93 +72,309 @@ func PresignPhoto(s3 *storage.S3) http.HandlerFunc {
 	}
 }
 
+// New object key and the content type, guessed from the file's extension
+// when the client sent none. The type is "" if unknown. The key's extension
+// comes from the type, never the client's file name, so a key can't claim
+// to be something like .html.
+func uploadTarget(filename, contentType string) (string, string) {
+	// Sanitizes filename
+	filename = filepath.Clean(filepath.Base(strings.TrimSpace(filename)))
+	extension := strings.ToLower(filepath.Ext(filename))
+	content := strings.TrimSpace(contentType)
+	if content == "" && extension != "" {
+		content = mime.TypeByExtension(extension)
+	}
+	base, _, _ := strings.Cut(content, ";")
+	return uuid.NewString() + media.Extension(strings.ToLower(strings.TrimSpace(base))), content
+}
+
+// Bytes and content_type are accepted for older clients but the values
+// observed in the bucket are what gets stored
 type confirmReq struct {
-	Key         string `json:"key"`
-	Bytes       int64  `json:"bytes"`
-	ContentType string `json:"content_type"`
+	Key string `json:"key"`
+	// A multipart upload from POST /photos/uploads, completed here when given
+	UploadID    string `json:"upload_id,omitempty"`
+	Bytes       int64  `json:"bytes,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
 	Title       string `json:"title,omitempty"`
 	Description string `json:"description,omitempty"`
+	// What to do when the caller already has a photo with the same bytes:
+	// "link" (default) returns it, "reject" answers 409, "keep" stores a copy
+	OnDuplicate string `json:"on_duplicate,omitempty"`
 }
 
+const (
+	dupLink   = "link"
+	dupReject = "reject"
+	dupKeep   = "keep"
+)
+
 // Function to confirm that a photo exists in MinIO
-func ConfirmPhoto(gdb *gorm.DB, s3 *storage.S3) http.HandlerFunc {
+func ConfirmPhoto(gdb *gorm.DB, store storage.ObjectStore, uploads config.Uploads) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var in confirmReq
 		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
 			writeError(w, http.StatusBadRequest, "bad_request")
 			return
 		}
+		if in.UploadID != "" {
+			up, ok := findUpload(w, r, gdb, in.UploadID)
+			if !ok {
+				return
+			}
+			if !writeCompleteError(w, completeUpload(r.Context(), gdb, store, uploads, up, nil)) {
+				return
+			}
+			in.Key = up.ObjectKey
+		}
 		in.Key = strings.TrimSpace(in.Key)
-		in.ContentType = strings.TrimSpace(in.ContentType)
-		if in.Key == "" || in.ContentType == "" || in.Bytes < 0 {
+		if in.Key == "" {
 			writeError(w, http.StatusBadRequest, "missing_fields")
 			return
 		}
+		if !validUploadKey(in.Key) {
+			writeError(w, http.StatusBadRequest, "bad_key")
+			return
+		}
+		switch in.OnDuplicate {
+		case "":
+			in.OnDuplicate = dupLink
+		case dupLink, dupReject, dupKeep:
+		default:
+			writeError(w, http.StatusBadRequest, "bad_on_duplicate")
+			return
+		}
 
-		photo := db.Photo{
-			ID:          uuid.NewString(),
-			OwnerID:     "local_user", // TEMPORARY, WILL ADD AUTH USER
-			Title:       in.Title,
-			Description: in.Description,
-			OriginKey:   in.Key,
-			ContentType: in.ContentType,
-			Bytes:       in.Bytes,
-			CreatedAt:   time.Now(),
+		// A retried confirm returns the row it made, even after the sweeper
+		// dropped the issued key. Nothing below runs for a registered key, it
+		// could delete the blob the row points at.
+		existing, err := photoByKey(r.Context(), gdb, in.Key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+		if existing != nil {
+			// Someone else's key, answered like any key not issued to the caller
+			if existing.OwnerID != ownerID(r) {
+				writeError(w, http.StatusForbidden, "key_not_issued")
+				return
+			}
+			toJSON(w, http.StatusOK, confirmOut(*existing))
+			return
+		}
+		if err := checkUploadKey(r.Context(), gdb, ownerID(r), in.Key); err != nil {
+			if errors.Is(err, errKeyNotIssued) {
+				writeError(w, http.StatusForbidden, "key_not_issued")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+
+		// Checks the upload actually landed and is an image or video
+		obj, err := verifyObject(r.Context(), store, in.Key, uploads)
+		if err != nil {
+			switch {
+			case errors.Is(err, errObjectMissing):
+				writeError(w, http.StatusNotFound, "object_missing")
+			case errors.Is(err, errUnsupportedType):
+				writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type")
+			default:
+				writeError(w, http.StatusBadGateway, "storage_failed")
+			}
+			return
+		}
+
+		// The presigned size was only a promise for multipart uploads and older clients
+		if obj.Bytes > int64(uploads.MaxBytes) {
+			dropUpload(r.Context(), gdb, store, in.Key)
+			writeUploadError(w, errTooLarge)
+			return
+		}
+
+		// The whole object is read for its hash, large videos can take a while
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		sum, err := hashObject(r.Context(), store, in.Key)
+		if err != nil {
+			if storage.IsNotFound(err) {
+				writeError(w, http.StatusNotFound, "object_missing")
+				return
+			}
+			writeError(w, http.StatusBadGateway, "storage_failed")
+			return
 		}
 
+		// Same bytes already in the library
+		if in.OnDuplicate != dupKeep {
+			dup, err := findDuplicate(r.Context(), gdb, ownerID(r), sum, in.Key)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+				return
+			}
+			if dup != nil {
+				// The new upload is never referenced, drop it now rather than leave an orphan
+				dropUpload(r.Context(), gdb, store, in.Key)
+				if in.OnDuplicate == dupReject {
+					toJSON(w, http.StatusConflict, map[string]any{"error": "duplicate", "photo_id": dup.ID})
+					return
+				}
+				out := confirmOut(*dup)
+				out["duplicate"] = true
+				toJSON(w, http.StatusOK, out)
+				return
+			}
+		}
+
+		// Linking a duplicate costs nothing, only new bytes count against the quota
+		if err := checkQuota(r.Context(), gdb, uploads, ownerID(r), in.Key, obj.Bytes); err != nil {
+			if errors.Is(err, errQuotaExceeded) {
+				dropUpload(r.Context(), gdb, store, in.Key)
+			}
+			writeUploadError(w, err)
+			return
+		}
+
+		photo := newPhotoRow(ownerID(r), in.Key, in.Title, in.Description, obj, sum)
+
 		// Creates a row or returns existing key if it exists
 		if err := gdb.WithContext(r.Context()).Create(&photo).Error; err != nil {
-			// Tries to get existing key
-			var existingKey db.Photo
-			tx := gdb.WithContext(r.Context()).First(&existingKey, "origin_key = ?", in.Key)
-			if tx.Error == nil {
-				toJSON(w, http.StatusOK, map[string]any{
-					"id":           existingKey.ID,
-					"title":        existingKey.Title,
-					"description":  existingKey.Description,
-					"origin_key":   existingKey.OriginKey,
-					"content_type": existingKey.ContentType,
-					"bytes":        existingKey.Bytes,
-					"created_at":   existingKey.CreatedAt,
-				})
+			// A concurrent confirm of the key won, only the caller's own row is returned
+			existing, err := photoByKey(r.Context(), gdb, in.Key)
+			if err != nil || existing == nil {
+				writeError(w, http.StatusInternalServerError, "db_insert_failed")
 				return
 			}
-			writeError(w, http.StatusInternalServerError, "db_insert_failed")
+			if existing.OwnerID != ownerID(r) {
+				writeError(w, http.StatusConflict, "key_in_use")
+				return
+			}
+			toJSON(w, http.StatusOK, confirmOut(*existing))
 			return
 		}
-		toJSON(w, http.StatusCreated, map[string]any{
-			"id":           photo.ID,
-			"title":        photo.Title,
-			"description":  photo.Description,
-			"origin_key":   photo.OriginKey,
-			"content_type": photo.ContentType,
-			"bytes":        photo.Bytes,
-			"created_at":   photo.CreatedAt,
-		})
+
+		// Thumbnail and preview renditions are generated in the background
+		queueVariants(gdb, store, photo)
+		publish(r.Context(), gdb, photo.OwnerID, events.PhotoCreated, photo.ID, confirmOut(photo))
+
+		toJSON(w, http.StatusCreated, confirmOut(photo))
+	}
+}
+
+// The row with key as its original, trashed ones included, nil if none
+func photoByKey(ctx context.Context, gdb *gorm.DB, key string) (*db.Photo, error) {
+	var rows []db.Photo
+	if err := gdb.WithContext(ctx).Unscoped().Preload("Exif").
+		Where("origin_key = ?", key).Limit(1).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return &rows[0], nil
+}
+
+// Deletes a refused upload. A key some row points at is left alone, even
+// one registered by a confirm that ran meanwhile.
+func dropUpload(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, key string) {
+	var n int64
+	if err := gdb.WithContext(ctx).Model(&db.Photo{}).Unscoped().
+		Where("origin_key = ?", key).Count(&n).Error; err != nil || n > 0 {
+		return
 	}
+	if err := store.DeleteObject(ctx, store.PhotosBucket(), key); err != nil && !storage.IsNotFound(err) {
+		log.Printf("confirm: delete upload %s: %v", key, err)
+	}
+}
+
+// The caller's oldest photo with these bytes other than key, nil if none
+func findDuplicate(ctx context.Context, gdb *gorm.DB, owner, sum, key string) (*db.Photo, error) {
+	var dups []db.Photo
+	if err := gdb.WithContext(ctx).Preload("Exif").
+		Where("owner_id = ? AND sha256 = ? AND origin_key <> ?", owner, sum, key).
+		Order("created_at").Limit(1).Find(&dups).Error; err != nil {
+		return nil, err
+	}
+	if len(dups) == 0 {
+		return nil, nil
+	}
+	return &dups[0], nil
 }
 
-// Makes Created at + id base64 URL encoded
+// Builds the row for a verified original. EXIF is saved with it and the
+// capture date replaces upload time when present.
+func newPhotoRow(owner, key, title, description string, obj verifiedObject, sum string) db.Photo {
+	now := time.Now()
+	photo := db.Photo{
+		ID:          uuid.NewString(),
+		OwnerID:     owner,
+		Title:       title,
+		Description: description,
+		OriginKey:   key,
+		ContentType: obj.ContentType,
+		Bytes:       obj.Bytes,
+		SHA256:      sum,
+		CreatedAt:   now,
+		CapturedAt:  now,
+	}
+	if strings.HasPrefix(obj.ContentType, "image/") {
+		if meta, ok := exifFromHead(obj.Head); ok {
+			meta.PhotoID = photo.ID
+			photo.Exif = meta
+			if meta.TakenAt != nil {
+				photo.CapturedAt = *meta.TakenAt
+			}
+		}
+	}
+	return photo
+}
+
+func confirmOut(p db.Photo) map[string]any {
+	return map[string]any{
+		"id":           p.ID,
+		"title":        p.Title,
+		"description":  p.Description,
+		"origin_key":   p.OriginKey,
+		"content_type": p.ContentType,
+		"bytes":        p.Bytes,
+		"sha256":       p.SHA256,
+		"created_at":   p.CreatedAt,
+		"captured_at":  p.CapturedAt,
+		"exif":         toExifOut(p.Exif),
+	}
+}
+
+// Sort modes for GET /photos, captured_at is the default
+const (
+	sortCaptured = "captured"
+	sortCreated  = "created"
+)
+
+// Makes the sort time + id base64 URL encoded, S records which field T came from
 type cursorPayload struct {
 	T  int64  `json:"t"`
 	ID string `json:"id"`
+	S  string `json:"s,omitempty"`
 }
 
-func encodeCursor(t time.Time, id string) string {
-	b, _ := json.Marshal(cursorPayload{T: t.UnixNano(), ID: id})
+func encodeCursor(sort string, t time.Time, id string) string {
+	b, _ := json.Marshal(cursorPayload{T: t.UnixNano(), ID: id, S: sort})
 	return base64.RawURLEncoding.EncodeToString(b)
 }
 
-func decodeCursor(s string) (time.Time, string, error) {
+func decodeCursor(s string) (string, time.Time, string, error) {
 	var p cursorPayload
 	b, err := base64.RawURLEncoding.DecodeString(s)
 	if err != nil {
-		return time.Time{}, "", err
+		return "", time.Time{}, "", err
 	}
 	if err := json.Unmarshal(b, &p); err != nil {
-		return time.Time{}, "", err
+		return "", time.Time{}, "", err
+	}
+	// Cursors from before sort modes were created_at based
+	if p.S == "" {
+		p.S = sortCreated
 	}
-	return time.Unix(0, p.T), p.ID, nil
+	return p.S, time.Unix(0, p.T), p.ID, nil
 }
 
 type photoItem struct {
@@ -167,6 +385,10 @@ type photoItem struct {
 	ContentType string    `json:"content_type"`
 	Bytes       int64     `json:"bytes"`
 	CreatedAt   time.Time `json:"created_at"`
+	CapturedAt  time.Time `json:"captured_at"`
+	Broken      bool      `json:"broken,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Exif        *exifOut  `json:"exif,omitempty"`
 }
 
 type listRes struct {
@@ -175,38 +397,70 @@ type listRes struct {
 }
 
 // Function to GET all photos
-func GetAllPhotos(gdb *gorm.DB) http.HandlerFunc {
+func GetAllPhotos(gdb *gorm.DB, pages config.Pages) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Limits to 25, clamp 1 - 100
-		limit := 25
+		// Default page size, clamp 1 - max
+		limit := pages.Default
 		if s := r.URL.Query().Get("limit"); s != "" {
 			if n, err := strconv.Atoi(s); err == nil {
 				if n < 1 {
 					n = 1
 				}
-				if n > 100 {
-					n = 100
+				if n > pages.Max {
+					n = pages.Max
 				}
 				limit = n
 			}
 		}
 
+		// Newest capture date first unless asked for upload order
+		sort := sortCaptured
+		col := "captured_at"
+		switch r.URL.Query().Get("sort") {
+		case "", sortCaptured:
+		case sortCreated:
+			sort = sortCreated
+			col = "created_at"
+		default:
+			writeError(w, http.StatusBadRequest, "bad_sort")
+			return
+		}
+
+		// ?tag=beach&tag=2024 keeps photos with all of them, tag_mode=any with either
+		tags, err := normalizeTags(r.URL.Query()["tag"])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_tag")
+			return
+		}
+		tagMode := r.URL.Query().Get("tag_mode")
+		switch tagMode {
+		case "":
+			tagMode = tagModeAll
+		case tagModeAll, tagModeAny:
+		default:
+			writeError(w, http.StatusBadRequest, "bad_tag_mode")
+			return
+		}
+
 		// Base query
 		q := gdb.WithContext(r.Context()).
-			Where("owner_id = ?", "local_user"). // REMOVE: will be auth user
-			Order("created_at DESC").
+			Where("owner_id = ?", ownerID(r)).
+			Order(col + " DESC").
 			Order("id DESC").
 			Limit(limit)
+		if len(tags) > 0 {
+			q = filterByTags(q, ownerID(r), tags, tagMode)
+		}
 
 		// If a cursor exists, connect it via WHERE
-		if c := r.URL.Query().Get("curosr"); c != "" {
-			t, lastID, err := decodeCursor(c)
-			if err != nil {
+		if c := r.URL.Query().Get("cursor"); c != "" {
+			cs, t, lastID, err := decodeCursor(c)
+			if err != nil || cs != sort {
 				writeError(w, http.StatusBadRequest, "bad_cursor")
 				return
 			}
 			// Get rows after the last item seen
-			q = q.Where("(created_at < ?) OR (created_at = ? AND id < ?)", t, t, lastID)
+			q = q.Where("("+col+" < ?) OR ("+col+" = ? AND id < ?)", t, t, lastID)
 		}
 
 		// Runs query
@@ -216,6 +470,21 @@ func GetAllPhotos(gdb *gorm.DB) http.HandlerFunc {
 			return
 		}
 
+		ids := make([]string, 0, len(rows))
+		for _, p := range rows {
+			ids = append(ids, p.ID)
+		}
+		exifByID, err := loadExif(r.Context(), gdb, ids)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_list_failed")
+			return
+		}
+		tagsByID, err := loadTags(r.Context(), gdb, ids)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_list_failed")
+			return
+		}
+
 		// Maps DB rows to API
 		items := make([]photoItem, 0, len(rows))
 		for _, p := range rows {
@@ -227,6 +496,10 @@ func GetAllPhotos(gdb *gorm.DB) http.HandlerFunc {
 				ContentType: p.ContentType,
 				Bytes:       p.Bytes,
 				CreatedAt:   p.CreatedAt,
+				CapturedAt:  p.CapturedAt,
+				Broken:      p.Broken,
+				Tags:        tagsByID[p.ID],
+				Exif:        exifByID[p.ID],
 			})
 		}
 
@@ -234,7 +507,11 @@ func GetAllPhotos(gdb *gorm.DB) http.HandlerFunc {
 		out := listRes{Items: items}
 		if len(rows) == limit {
 			last := rows[len(rows)-1]
-			out.NextCursor = encodeCursor(last.CreatedAt, last.ID)
+			t := last.CapturedAt
+			if sort == sortCreated {
+				t = last.CreatedAt
+			}
+			out.NextCursor = encodeCursor(sort, t, last.ID)
 		}
 
 		toJSON(w, http.StatusOK, out)
@@ -248,7 +525,8 @@ func GetPhotoByID(gdb *gorm.DB) http.HandlerFunc {
 
 		var p db.Photo
 		err := gdb.WithContext(r.Context()).
-			Where("id = ? AND owner_id = ?", id, "local_user"). /// DELETE Later, will use Auth user
+			Preload("Exif").
+			Where("id = ? AND owner_id = ?", id, ownerID(r)).
 			First(&p).Error
 
 		if err != nil {
@@ -260,6 +538,12 @@ func GetPhotoByID(gdb *gorm.DB) http.HandlerFunc {
 			return
 		}
 
+		tagsByID, err := loadTags(r.Context(), gdb, []string{p.ID})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+
 		out := photoItem{
 			ID:          p.ID,
 			Title:       p.Title,
@@ -268,6 +552,10 @@ func GetPhotoByID(gdb *gorm.DB) http.HandlerFunc {
 			ContentType: p.ContentType,
 			Bytes:       p.Bytes,
 			CreatedAt:   p.CreatedAt,
+			CapturedAt:  p.CapturedAt,
+			Broken:      p.Broken,
+			Tags:        tagsByID[p.ID],
+			Exif:        toExifOut(p.Exif),
 		}
 		toJSON(w, http.StatusOK, out)
 	}
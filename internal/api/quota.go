@@ -0,0 +1,160 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/AJMerr/little-moments-offline/internal/config"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"gorm.io/gorm"
+)
+
+var (
+	errBytesRequired = errors.New("bytes_required")
+	errTooLarge      = errors.New("too_large")
+	errQuotaExceeded = errors.New("quota_exceeded")
+)
+
+// The caller's limit, the server default unless an admin set one. 0 is unlimited.
+func userQuota(ctx context.Context, gdb *gorm.DB, uploads config.Uploads, owner string) (int64, error) {
+	var users []db.User
+	if err := gdb.WithContext(ctx).Select("id", "quota_bytes").
+		Where("id = ?", owner).Limit(1).Find(&users).Error; err != nil {
+		return 0, err
+	}
+	if len(users) == 0 || users[0].QuotaBytes == nil {
+		return int64(uploads.Quota), nil
+	}
+	return *users[0].QuotaBytes, nil
+}
+
+// Bytes of the owner's originals, trashed ones included as their blobs are
+// still stored. except leaves out one key so a retried confirm isn't counted twice.
+func usedBytes(ctx context.Context, gdb *gorm.DB, owner, except string) (int64, error) {
+	var used int64
+	err := gdb.WithContext(ctx).Unscoped().Model(&db.Photo{}).
+		Where("owner_id = ? AND origin_key <> ?", owner, except).
+		Select("COALESCE(SUM(bytes), 0)").Scan(&used).Error
+	return used, err
+}
+
+// Checks an upload the client announced against the policy and the owner's quota
+func checkUpload(ctx context.Context, gdb *gorm.DB, uploads config.Uploads, owner, contentType string, bytes int64) error {
+	switch {
+	case bytes <= 0:
+		return errBytesRequired
+	case !uploads.Allows(contentType):
+		return errUnsupportedType
+	case bytes > int64(uploads.MaxBytes):
+		return errTooLarge
+	}
+	return checkQuota(ctx, gdb, uploads, owner, "", bytes)
+}
+
+func checkQuota(ctx context.Context, gdb *gorm.DB, uploads config.Uploads, owner, except string, bytes int64) error {
+	quota, err := userQuota(ctx, gdb, uploads, owner)
+	if err != nil || quota == 0 {
+		return err
+	}
+	used, err := usedBytes(ctx, gdb, owner, except)
+	if err != nil {
+		return err
+	}
+	if used+bytes > quota {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// Reports false after writing the response for an upload the policy refused
+func writeUploadError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+	code, msg := uploadErrorStatus(err)
+	writeError(w, code, msg)
+	return false
+}
+
+func uploadErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errBytesRequired):
+		return http.StatusBadRequest, "bytes_required"
+	case errors.Is(err, errUnsupportedType):
+		return http.StatusUnsupportedMediaType, "unsupported_media_type"
+	case errors.Is(err, errTooLarge):
+		return http.StatusRequestEntityTooLarge, "too_large"
+	case errors.Is(err, errQuotaExceeded):
+		return http.StatusRequestEntityTooLarge, "quota_exceeded"
+	default:
+		return http.StatusInternalServerError, "db_lookup_failed"
+	}
+}
+
+type usageOut struct {
+	Photos    int64 `json:"photos"`
+	UsedBytes int64 `json:"used_bytes"`
+	// Nil when unlimited
+	QuotaBytes     *int64   `json:"quota_bytes"`
+	RemainingBytes *int64   `json:"remaining_bytes"`
+	MaxUploadBytes int64    `json:"max_upload_bytes"`
+	AllowedTypes   []string `json:"allowed_types"`
+}
+
+// Storage used by the caller against their quota, plus the upload limits
+func GetUsage(gdb *gorm.DB, uploads config.Uploads) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var out usageOut
+		if err := gdb.WithContext(r.Context()).Unscoped().Model(&db.Photo{}).
+			Where("owner_id = ?", ownerID(r)).
+			Select("COUNT(*) AS photos, COALESCE(SUM(bytes), 0) AS used_bytes").
+			Scan(&out).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+		quota, err := userQuota(r.Context(), gdb, uploads, ownerID(r))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+		out.MaxUploadBytes, out.AllowedTypes = int64(uploads.MaxBytes), uploads.AllowedTypes
+		if quota > 0 {
+			remaining := max(quota-out.UsedBytes, 0)
+			out.QuotaBytes, out.RemainingBytes = &quota, &remaining
+		}
+		toJSON(w, http.StatusOK, out)
+	}
+}
+
+type quotaReq struct {
+	// Bytes, 0 for unlimited, null to go back to the server default
+	QuotaBytes *int64 `json:"quota_bytes"`
+}
+
+// Sets one user's storage limit
+func SetUserQuota(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in quotaReq
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		if in.QuotaBytes != nil && *in.QuotaBytes < 0 {
+			writeError(w, http.StatusBadRequest, "bad_quota")
+			return
+		}
+		res := gdb.WithContext(r.Context()).Model(&db.User{}).
+			Where("id = ?", r.PathValue("id")).Update("quota_bytes", in.QuotaBytes)
+		if res.Error != nil {
+			writeError(w, http.StatusInternalServerError, "db_update_failed")
+			return
+		}
+		if res.RowsAffected == 0 {
+			writeError(w, http.StatusNotFound, "user_not_found")
+			return
+		}
+		toJSON(w, http.StatusOK, map[string]any{"id": r.PathValue("id"), "quota_bytes": in.QuotaBytes})
+	}
+}
@@ -3,29 +3,95 @@ package api
 import (
 	"net/http"
 
+	"github.com/AJMerr/little-moments-offline/internal/backup"
+	"github.com/AJMerr/little-moments-offline/internal/config"
+	"github.com/AJMerr/little-moments-offline/internal/metrics"
 	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"github.com/AJMerr/little-moments-offline/internal/webhooks"
 	"gorm.io/gorm"
 )
 
-func RouterHandler(gdb *gorm.DB, s3 *storage.S3) http.Handler {
+func RouterHandler(gdb *gorm.DB, store storage.ObjectStore, cfg config.Config) http.Handler {
 	mux := http.NewServeMux()
 
+	// The filesystem store serves its own signed upload/download URLs
+	if h, ok := store.(http.Handler); ok {
+		mux.Handle("GET "+storage.BlobPathPrefix, h)
+		mux.Handle("PUT "+storage.BlobPathPrefix, h)
+	}
+
 	mux.HandleFunc("GET /healthz", healthzHandler)
 	mux.HandleFunc("GET /version", versionHandler)
 	mux.HandleFunc("GET /panic", func(w http.ResponseWriter, r *http.Request) { panic("AAAAAAHHH BEES") })
-	mux.HandleFunc("GET /photos", GetAllPhotos(gdb))
+	mux.HandleFunc("POST /auth/register", Register(gdb))
+	mux.HandleFunc("POST /auth/login", Login(gdb))
+	mux.HandleFunc("POST /auth/logout", Logout(gdb))
+	mux.HandleFunc("GET /me", GetMe(gdb))
+	mux.HandleFunc("GET /me/usage", GetUsage(gdb, cfg.Uploads))
+	mux.HandleFunc("GET /events", GetEvents(gdb))
+	sender := webhooks.NewSender(cfg.Webhooks)
+	mux.HandleFunc("POST /webhooks", CreateWebhook(gdb, sender))
+	mux.HandleFunc("GET /webhooks", GetWebhooks(gdb))
+	mux.HandleFunc("PATCH /webhooks/{id}", UpdateWebhook(gdb, sender))
+	mux.HandleFunc("DELETE /webhooks/{id}", DeleteWebhook(gdb))
+	mux.HandleFunc("GET /webhooks/{id}/deliveries", GetWebhookDeliveries(gdb))
+	mux.HandleFunc("POST /webhooks/{id}/test", SendTestWebhook(gdb, sender))
+	mux.HandleFunc("GET /photos", GetAllPhotos(gdb, cfg.Pages))
 	mux.HandleFunc("GET /photos/{id}", GetPhotoByID(gdb))
-	mux.HandleFunc("GET /photos/{id}/url", GetPhotoUrl(gdb, s3))
-	mux.HandleFunc("GET /albums", GetAllAlbums(gdb))
-	mux.HandleFunc("GET /albums/{id}", GetAlbumByID(gdb))
-	mux.HandleFunc("DELETE /photos/{id}", DeletePhotoByID(gdb, s3))
+	mux.HandleFunc("GET /photos/{id}/url", GetPhotoUrl(gdb, store, cfg.Presign))
+	mux.HandleFunc("GET /photos/{id}/content", GetPhotoContent(gdb, store))
+	mux.HandleFunc("GET /search", Search(gdb, cfg.Pages))
+	mux.HandleFunc("GET /tags", GetTags(gdb))
+	mux.HandleFunc("GET /albums", GetAllAlbums(gdb, cfg.Pages))
+	mux.HandleFunc("GET /albums/{id}", GetAlbumByID(gdb, cfg.Pages))
+	mux.HandleFunc("DELETE /photos/{id}", DeletePhotoByID(gdb))
 	mux.HandleFunc("DELETE /albums/{id}", DeleteAlbum(gdb))
 	mux.HandleFunc("DELETE /albums/{id}/photos", DeletePhotoFromAlbum(gdb))
-	mux.HandleFunc("POST /photos/presign", PresignPhoto(s3))
-	mux.HandleFunc("POST /photos/confirm", ConfirmPhoto(gdb, s3))
+	mux.HandleFunc("POST /photos/presign", PresignPhoto(gdb, store, cfg.Presign.Upload.D(), cfg.Uploads))
+	mux.HandleFunc("POST /photos/confirm", ConfirmPhoto(gdb, store, cfg.Uploads))
+	mux.HandleFunc("POST /photos", UploadPhotos(gdb, store, cfg.Uploads))
+	mux.HandleFunc("POST /photos/uploads", CreateUpload(gdb, store, cfg.UploadMaxAge.D(), cfg.Uploads))
+	mux.HandleFunc("POST /photos/uploads/{id}/parts", PresignUploadParts(gdb, store, cfg.Presign.Upload.D()))
+	mux.HandleFunc("GET /photos/uploads/{id}/parts", ListUploadParts(gdb, store))
+	mux.HandleFunc("POST /photos/uploads/{id}/complete", CompleteUpload(gdb, store, cfg.Uploads))
+	mux.HandleFunc("DELETE /photos/uploads/{id}", AbortUpload(gdb, store))
+	mux.HandleFunc("POST /photos/tags", AddPhotoTags(gdb))
+	mux.HandleFunc("POST /photos/download", DownloadPhotos(gdb, store))
+	mux.HandleFunc("GET /photos/duplicates", GetDuplicates(gdb, cfg.Pages))
+	mux.HandleFunc("POST /photos/duplicates/resolve", ResolveDuplicates(gdb))
+	mux.HandleFunc("GET /albums/{id}/download", DownloadAlbum(gdb, store))
+	mux.HandleFunc("DELETE /photos/tags", RemovePhotoTags(gdb))
 	mux.HandleFunc("POST /albums", CreateAblum(gdb))
 	mux.HandleFunc("POST /albums/{id}/photos", AddPhotoToAlbum(gdb))
+	mux.HandleFunc("PUT /albums/{id}/order", SetAlbumOrder(gdb))
+	mux.HandleFunc("POST /albums/{id}/photos/{pid}/move", MoveAlbumPhoto(gdb))
 	mux.HandleFunc("PATCH /photos/{id}", UpdatePhoto(gdb))
 	mux.HandleFunc("PATCH /albums/{id}", UpdateAlbum(gdb))
-	return reqID(logger(panicRecovery(cors(mux))))
+	mux.HandleFunc("GET /trash", GetTrash(gdb, cfg.TrashRetention.D(), cfg.Pages))
+	mux.HandleFunc("POST /trash/{id}/restore", RestoreFromTrash(gdb))
+	mux.HandleFunc("DELETE /trash/{id}", DeleteFromTrash(gdb, store))
+	backups := backup.OptionsFrom(cfg.Backup)
+	mux.HandleFunc("POST /admin/fsck", adminOnly(RunFsck(gdb, store, backups.SkipPrefixes(store.PhotosBucket()))))
+	mux.HandleFunc("GET /admin/backups", adminOnly(GetBackups(store, backups)))
+	mux.HandleFunc("POST /admin/backups", adminOnly(CreateBackup(gdb, store, backups)))
+	mux.HandleFunc("PUT /admin/users/{id}/quota", adminOnly(SetUserQuota(gdb)))
+	mux.HandleFunc("GET /admin/export", adminOnly(ExportLibrary(gdb, store)))
+	mux.HandleFunc("POST /admin/import", adminOnly(ImportLibrary(gdb, store)))
+	mux.HandleFunc("POST /albums/{id}/shares", CreateShare(gdb))
+	mux.HandleFunc("GET /albums/{id}/shares", GetShares(gdb))
+	mux.HandleFunc("DELETE /albums/{id}/shares/{sid}", RevokeShare(gdb))
+	mux.HandleFunc("GET /albums/{id}/shares/{sid}/access", GetShareAccessLog(gdb))
+	mux.HandleFunc("GET "+sharePathPrefix+"{token}", GetSharedAlbum(gdb, store, cfg.Presign.Share.D(), cfg.Pages))
+	mux.HandleFunc("GET "+sharePathPrefix+"{token}/photos/{id}/content", GetSharedPhotoContent(gdb, store))
+	mux.HandleFunc("GET /metrics", adminOnly(metrics.Default.Handler().ServeHTTP))
+	return reqID(logger(mux, panicRecovery(cors(cfg.WebOrigins)(requireAuth(gdb)(mux)))))
+}
+
+// Routes for the separate admin listener (LM_ADMIN_ADDR). There is no session
+// check here, the listener is meant for a private network or localhost.
+func AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", healthzHandler)
+	mux.Handle("GET /metrics", metrics.Default.Handler())
+	return mux
 }
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/config"
+	"gorm.io/gorm"
+)
+
+// Markers handed to highlight()/snippet(), swapped for <mark> after escaping
+const (
+	markOpen  = "\x02"
+	markClose = "\x03"
+)
+
+type searchItem struct {
+	Kind        string    `json:"kind"`
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	// HTML escaped with matches wrapped in <mark>
+	TitleHighlight string `json:"title_highlight"`
+	Snippet        string `json:"snippet"`
+}
+
+type searchRes struct {
+	Items      []searchItem `json:"items"`
+	NextCursor string       `json:"next_cursor"`
+}
+
+// Results are ordered by rank, then kind and id to break ties
+type searchCursor struct {
+	R  float64 `json:"r"`
+	K  string  `json:"k"`
+	ID string  `json:"id"`
+	Q  string  `json:"q"`
+}
+
+func encodeSearchCursor(q string, rank float64, kind, id string) string {
+	b, _ := json.Marshal(searchCursor{R: rank, K: kind, ID: id, Q: q})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSearchCursor(s string) (searchCursor, error) {
+	var c searchCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// Turns user input into an FTS5 query. Bare words and "quoted phrases" are
+// ANDed, a trailing * makes either a prefix match. Everything is quoted so
+// FTS operators and column filters typed by the user are taken literally.
+func ftsQuery(raw string) string {
+	var terms []string
+	add := func(term string, prefix bool) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return
+		}
+		t := `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+		if prefix {
+			t += "*"
+		}
+		terms = append(terms, t)
+	}
+
+	s := raw
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			break
+		}
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				// Unclosed quote, treat the rest as the phrase
+				add(s[1:], false)
+				break
+			}
+			phrase := s[1 : end+1]
+			s = s[end+2:]
+			prefix := strings.HasPrefix(s, "*")
+			if prefix {
+				s = s[1:]
+			}
+			add(phrase, prefix)
+			continue
+		}
+
+		end := strings.IndexAny(s, " \t\r\n\"")
+		if end < 0 {
+			end = len(s)
+		}
+		word := s[:end]
+		s = s[end:]
+		prefix := strings.HasSuffix(word, "*")
+		add(strings.TrimRight(word, "*"), prefix)
+	}
+	return strings.Join(terms, " ")
+}
+
+// Escapes FTS output for HTML and turns the markers into <mark> tags
+func markup(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, markOpen, "<mark>")
+	return strings.ReplaceAll(s, markClose, "</mark>")
+}
+
+// Ranked search over the caller's photo and album titles and descriptions
+func Search(gdb *gorm.DB, pages config.Pages) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := strings.TrimSpace(r.URL.Query().Get("q"))
+		if raw == "" {
+			writeError(w, http.StatusBadRequest, "missing_query")
+			return
+		}
+		match := ftsQuery(raw)
+		if match == "" {
+			toJSON(w, http.StatusOK, searchRes{Items: []searchItem{}})
+			return
+		}
+
+		// Default page size, clamp 1 - max
+		limit := pages.Default
+		if s := r.URL.Query().Get("limit"); s != "" {
+			if n, err := strconv.Atoi(s); err == nil {
+				if n < 1 {
+					n = 1
+				}
+				if n > pages.Max {
+					n = pages.Max
+				}
+				limit = n
+			}
+		}
+
+		owner := ownerID(r)
+		// Titles weigh more than descriptions
+		sql := `
+			SELECT * FROM (
+				SELECT 'photo' AS kind, p.id, p.title, COALESCE(p.description, '') AS description, p.created_at,
+					bm25(photos_fts, 10.0, 1.0) AS rank,
+					highlight(photos_fts, 0, @open, @close) AS title_highlight,
+					snippet(photos_fts, 1, @open, @close, '…', 16) AS snippet
+				FROM photos_fts
+				JOIN photos p ON p.id = photos_fts.photo_id
+				WHERE photos_fts MATCH @match AND p.owner_id = @owner AND p.deleted_at IS NULL
+				UNION ALL
+				SELECT 'album' AS kind, a.id, a.title, COALESCE(a.description, '') AS description, a.created_at,
+					bm25(albums_fts, 10.0, 1.0) AS rank,
+					highlight(albums_fts, 0, @open, @close) AS title_highlight,
+					snippet(albums_fts, 1, @open, @close, '…', 16) AS snippet
+				FROM albums_fts
+				JOIN albums a ON a.id = albums_fts.album_id
+				WHERE albums_fts MATCH @match AND a.owner_id = @owner AND a.deleted_at IS NULL
+			)`
+		args := map[string]any{
+			"match": match,
+			"owner": owner,
+			"open":  markOpen,
+			"close": markClose,
+			"limit": limit,
+		}
+
+		// Cursors only continue the query they were issued for
+		if c := r.URL.Query().Get("cursor"); c != "" {
+			cur, err := decodeSearchCursor(c)
+			if err != nil || cur.Q != raw {
+				writeError(w, http.StatusBadRequest, "bad_cursor")
+				return
+			}
+			sql += ` WHERE rank > @r OR (rank = @r AND (kind > @k OR (kind = @k AND id > @id)))`
+			args["r"] = cur.R
+			args["k"] = cur.K
+			args["id"] = cur.ID
+		}
+		sql += ` ORDER BY rank, kind, id LIMIT @limit`
+
+		var rows []struct {
+			Kind           string
+			ID             string
+			Title          string
+			Description    string
+			CreatedAt      time.Time
+			Rank           float64
+			TitleHighlight string
+			Snippet        string
+		}
+		if err := gdb.WithContext(r.Context()).Raw(sql, args).Scan(&rows).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_search_failed")
+			return
+		}
+
+		items := make([]searchItem, 0, len(rows))
+		for _, row := range rows {
+			items = append(items, searchItem{
+				Kind:           row.Kind,
+				ID:             row.ID,
+				Title:          row.Title,
+				Description:    row.Description,
+				CreatedAt:      row.CreatedAt,
+				TitleHighlight: markup(row.TitleHighlight),
+				Snippet:        markup(row.Snippet),
+			})
+		}
+
+		out := searchRes{Items: items}
+		if len(rows) == limit {
+			last := rows[len(rows)-1]
+			out.NextCursor = encodeSearchCursor(raw, last.Rank, last.Kind, last.ID)
+		}
+		toJSON(w, http.StatusOK, out)
+	}
+}
@@ -0,0 +1,430 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/auth"
+	"github.com/AJMerr/little-moments-offline/internal/config"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Public share links live under /s/{token}
+const sharePathPrefix = "/s/"
+
+// Header a viewer sends the share password in
+const sharePasswordHeader = "X-Share-Password"
+
+type createShareReq struct {
+	// Hours until the link stops working, 0 or missing means never
+	ExpiresInHours int    `json:"expires_in_hours"`
+	Password       string `json:"password"`
+	AllowDownload  bool   `json:"allow_download"`
+}
+
+type shareOut struct {
+	ID            string     `json:"id"`
+	AlbumID       string     `json:"album_id"`
+	HasPassword   bool       `json:"has_password"`
+	AllowDownload bool       `json:"allow_download"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	RevokedAt     *time.Time `json:"revoked_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	AccessCount   int64      `json:"access_count"`
+	LastAccessAt  *time.Time `json:"last_access_at"`
+}
+
+type shareAccessOut struct {
+	At        time.Time `json:"at"`
+	Status    int       `json:"status"`
+	RemoteIP  string    `json:"remote_ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
+type sharedPhotoOut struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	ContentType string    `json:"content_type"`
+	CapturedAt  time.Time `json:"captured_at"`
+	// Presigned preview when it is ready, the preview path otherwise
+	URL      string `json:"url"`
+	ThumbURL string `json:"thumb_url,omitempty"`
+	// Content path of the original, only when the share allows downloads
+	DownloadURL string `json:"download_url,omitempty"`
+	// Stable paths through the API for the same images, they don't expire
+	Path         string `json:"path"`
+	ThumbPath    string `json:"thumb_path,omitempty"`
+	DownloadPath string `json:"download_path,omitempty"`
+}
+
+func toShareOut(s db.AlbumShare) shareOut {
+	return shareOut{
+		ID:            s.ID,
+		AlbumID:       s.AlbumID,
+		HasPassword:   s.PasswordHash != "",
+		AllowDownload: s.AllowDownload,
+		ExpiresAt:     s.ExpiresAt,
+		RevokedAt:     s.RevokedAt,
+		CreatedAt:     s.CreatedAt,
+		AccessCount:   s.AccessCount,
+		LastAccessAt:  s.LastAccessAt,
+	}
+}
+
+// Checks the album in the path is the caller's and not trashed
+func ownedAlbum(r *http.Request, gdb *gorm.DB) (string, bool) {
+	id := r.PathValue("id")
+	var n int64
+	if err := gdb.WithContext(r.Context()).Model(&db.Album{}).
+		Where("id = ? AND owner_id = ?", id, ownerID(r)).
+		Count(&n).Error; err != nil || n == 0 {
+		return "", false
+	}
+	return id, true
+}
+
+// Mints a share link for an album, the token is only ever returned here
+func CreateShare(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		albumID, ok := ownedAlbum(r, gdb)
+		if !ok {
+			writeError(w, http.StatusNotFound, "album_not_found")
+			return
+		}
+
+		var req createShareReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, "bad_json")
+			return
+		}
+		if req.ExpiresInHours < 0 {
+			writeError(w, http.StatusBadRequest, "bad_expiry")
+			return
+		}
+
+		token, err := auth.NewToken()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "token_failed")
+			return
+		}
+
+		now := time.Now().UTC()
+		share := db.AlbumShare{
+			ID:            uuid.NewString(),
+			AlbumID:       albumID,
+			OwnerID:       ownerID(r),
+			TokenHash:     auth.HashToken(token),
+			AllowDownload: req.AllowDownload,
+			CreatedAt:     now,
+		}
+		if req.ExpiresInHours > 0 {
+			exp := now.Add(time.Duration(req.ExpiresInHours) * time.Hour)
+			share.ExpiresAt = &exp
+		}
+		if req.Password != "" {
+			hash, err := auth.HashPassword(req.Password)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "weak_password")
+				return
+			}
+			share.PasswordHash = hash
+		}
+
+		if err := gdb.WithContext(r.Context()).Create(&share).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_insert_failed")
+			return
+		}
+
+		toJSON(w, http.StatusCreated, map[string]any{
+			"share": toShareOut(share),
+			"token": token,
+			"path":  sharePathPrefix + token,
+		})
+	}
+}
+
+// Lists an album's share links, newest first, revoked ones included
+func GetShares(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		albumID, ok := ownedAlbum(r, gdb)
+		if !ok {
+			writeError(w, http.StatusNotFound, "album_not_found")
+			return
+		}
+
+		var rows []db.AlbumShare
+		if err := gdb.WithContext(r.Context()).
+			Where("album_id = ?", albumID).
+			Order("created_at DESC, id DESC").
+			Find(&rows).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_list_failed")
+			return
+		}
+
+		out := make([]shareOut, 0, len(rows))
+		for _, s := range rows {
+			out = append(out, toShareOut(s))
+		}
+		toJSON(w, http.StatusOK, map[string]any{"items": out})
+	}
+}
+
+// Revokes a share link, it stops working immediately but stays listed
+func RevokeShare(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		albumID, ok := ownedAlbum(r, gdb)
+		if !ok {
+			writeError(w, http.StatusNotFound, "album_not_found")
+			return
+		}
+
+		if err := gdb.WithContext(r.Context()).Model(&db.AlbumShare{}).
+			Where("id = ? AND album_id = ? AND revoked_at IS NULL", r.PathValue("sid"), albumID).
+			Update("revoked_at", time.Now().UTC()).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_update_failed")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Latest accesses made with a share link
+func GetShareAccessLog(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		albumID, ok := ownedAlbum(r, gdb)
+		if !ok {
+			writeError(w, http.StatusNotFound, "album_not_found")
+			return
+		}
+
+		limit := 100
+		if s := r.URL.Query().Get("limit"); s != "" {
+			if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= 1000 {
+				limit = n
+			}
+		}
+
+		var rows []db.ShareAccess
+		if err := gdb.WithContext(r.Context()).
+			Joins("JOIN album_shares s ON s.id = share_access_log.share_id").
+			Where("s.id = ? AND s.album_id = ?", r.PathValue("sid"), albumID).
+			Order("share_access_log.at DESC, share_access_log.id DESC").
+			Limit(limit).
+			Find(&rows).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_list_failed")
+			return
+		}
+
+		out := make([]shareAccessOut, 0, len(rows))
+		for _, a := range rows {
+			out = append(out, shareAccessOut{At: a.At, Status: a.Status, RemoteIP: a.RemoteIP, UserAgent: a.UserAgent})
+		}
+		toJSON(w, http.StatusOK, map[string]any{"items": out})
+	}
+}
+
+// Looks up the share for the {token} path value and checks it is live and
+// the password matches. Refusals are logged and written.
+func openShare(w http.ResponseWriter, r *http.Request, gdb *gorm.DB) (db.AlbumShare, bool) {
+	var share db.AlbumShare
+	if err := gdb.WithContext(r.Context()).
+		Where("token_hash = ?", auth.HashToken(r.PathValue("token"))).
+		First(&share).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, http.StatusNotFound, "share_not_found")
+			return share, false
+		}
+		writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+		return share, false
+	}
+
+	// Every request made with a real token is logged, allowed or not
+	deny := func(code int, msg string) (db.AlbumShare, bool) {
+		logShareAccess(r, gdb, share, code)
+		writeError(w, code, msg)
+		return share, false
+	}
+
+	if share.RevokedAt != nil {
+		return deny(http.StatusNotFound, "share_not_found")
+	}
+	if share.ExpiresAt != nil && time.Now().After(*share.ExpiresAt) {
+		return deny(http.StatusGone, "share_expired")
+	}
+	if share.PasswordHash != "" {
+		pw := r.Header.Get(sharePasswordHeader)
+		if pw == "" {
+			return deny(http.StatusUnauthorized, "password_required")
+		}
+		if !auth.CheckPassword(share.PasswordHash, pw) {
+			return deny(http.StatusUnauthorized, "bad_password")
+		}
+	}
+	return share, true
+}
+
+// Public view of a shared album, no session needed. The password, when the
+// share has one, comes in the X-Share-Password header.
+func GetSharedAlbum(gdb *gorm.DB, store storage.ObjectStore, urlTTL time.Duration, pages config.Pages) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		share, ok := openShare(w, r, gdb)
+		if !ok {
+			return
+		}
+		deny := func(code int, msg string) {
+			logShareAccess(r, gdb, share, code)
+			writeError(w, code, msg)
+		}
+
+		now := time.Now()
+		var a db.Album
+		if err := gdb.WithContext(ctx).Where("id = ?", share.AlbumID).First(&a).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				deny(http.StatusNotFound, "share_not_found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "db_load_failed")
+			return
+		}
+
+		limit := pages.AlbumPhotos
+		if s := r.URL.Query().Get("limit"); s != "" {
+			if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= pages.Max {
+				limit = n
+			}
+		}
+		rows, next, err := listAlbumPhotos(ctx, gdb, a.ID, a.SortMode, limit, r.URL.Query().Get("cursor"))
+		if err != nil {
+			if errors.Is(err, errBadCursor) {
+				writeError(w, http.StatusBadRequest, "bad_cursor")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "db_list_failed")
+			return
+		}
+
+		photos, err := sharedPhotos(r, gdb, store, rows, share.AllowDownload, urlTTL, sharePathPrefix+r.PathValue("token"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "presign_failed")
+			return
+		}
+
+		logShareAccess(r, gdb, share, http.StatusOK)
+		toJSON(w, http.StatusOK, map[string]any{
+			"album": map[string]any{
+				"id":          a.ID,
+				"title":       a.Title,
+				"description": a.Description,
+				"created_at":  a.CreatedAt,
+			},
+			"allow_download": share.AllowDownload,
+			"expires_at":     share.ExpiresAt,
+			"photos":         photos,
+			"next_cursor":    next,
+			"urls_expire_at": now.Add(urlTTL).UTC(),
+		})
+	}
+}
+
+// Display URLs for a page of shared photos, ready variants are presigned and
+// everything else goes through the share's content paths
+func sharedPhotos(r *http.Request, gdb *gorm.DB, store storage.ObjectStore, rows []albumPhotoRow, allowDownload bool, ttl time.Duration, sharePath string) ([]sharedPhotoOut, error) {
+	ctx := r.Context()
+	ids := make([]string, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.Photo.ID)
+	}
+
+	ready := map[string]map[string]string{}
+	if len(ids) > 0 {
+		var variants []db.PhotoVariant
+		if err := gdb.WithContext(ctx).
+			Where("photo_id IN ? AND status = ?", ids, db.VariantReady).
+			Find(&variants).Error; err != nil {
+			return nil, err
+		}
+		for _, v := range variants {
+			if ready[v.PhotoID] == nil {
+				ready[v.PhotoID] = map[string]string{}
+			}
+			ready[v.PhotoID][v.Variant] = v.Key
+		}
+	}
+
+	presign := func(key string) (string, error) {
+		return store.PresignGetObject(ctx, store.PhotosBucket(), key, ttl)
+	}
+
+	out := make([]sharedPhotoOut, 0, len(rows))
+	for _, row := range rows {
+		p := row.Photo
+		content := sharePath + "/photos/" + p.ID + "/content"
+		item := sharedPhotoOut{
+			ID:          p.ID,
+			Title:       p.Title,
+			Description: p.Description,
+			ContentType: p.ContentType,
+			CapturedAt:  p.CapturedAt,
+			Path:        content + "?variant=preview",
+		}
+
+		// Origin keys never leave the server, the original only goes out
+		// through the token's content path
+		item.URL = item.Path
+		if k, ok := ready[p.ID]["preview"]; ok {
+			u, err := presign(k)
+			if err != nil {
+				return nil, err
+			}
+			item.URL = u
+		}
+		if k, ok := ready[p.ID]["thumb"]; ok {
+			u, err := presign(k)
+			if err != nil {
+				return nil, err
+			}
+			item.ThumbURL = u
+			item.ThumbPath = content + "?variant=thumb"
+		}
+		if allowDownload {
+			item.DownloadURL = content
+			item.DownloadPath = content
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+
+// Records an access and bumps the share's counters, best effort
+func logShareAccess(r *http.Request, gdb *gorm.DB, share db.AlbumShare, status int) {
+	now := time.Now().UTC()
+	_ = gdb.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&db.ShareAccess{
+			ShareID:   share.ID,
+			At:        now,
+			Status:    status,
+			RemoteIP:  r.RemoteAddr,
+			UserAgent: r.UserAgent(),
+		}).Error; err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return nil
+		}
+		return tx.Model(&db.AlbumShare{}).
+			Where("id = ?", share.ID).
+			Updates(map[string]any{
+				"access_count":   gorm.Expr("access_count + 1"),
+				"last_access_at": now,
+			}).Error
+	})
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxTagLen = 64
+
+// Tag filter modes for GET /photos
+const (
+	tagModeAll = "all"
+	tagModeAny = "any"
+)
+
+var errBadTag = errors.New("bad tag")
+
+type photoTagsReq struct {
+	PhotoIDs []string `json:"photo_ids"`
+	Tags     []string `json:"tags"`
+}
+
+type tagOut struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// Trims, lower cases and collapses inner whitespace
+func normalizeTag(s string) (string, error) {
+	name := strings.ToLower(strings.Join(strings.Fields(s), " "))
+	if name == "" || utf8.RuneCountInString(name) > maxTagLen {
+		return "", errBadTag
+	}
+	return name, nil
+}
+
+// Normalizes a list of tag names and drops duplicates
+func normalizeTags(in []string) ([]string, error) {
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		name, err := normalizeTag(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, name)
+	}
+	return uniqueStrings(out), nil
+}
+
+// Decodes a photo_ids/tags body and checks every photo belongs to the caller
+func decodePhotoTags(w http.ResponseWriter, r *http.Request, gdb *gorm.DB) (photoTagsReq, bool) {
+	var req photoTagsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_json")
+		return req, false
+	}
+	names, err := normalizeTags(req.Tags)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_tag")
+		return req, false
+	}
+	req.Tags = names
+	req.PhotoIDs = uniqueStrings(req.PhotoIDs)
+	if len(req.PhotoIDs) == 0 || len(req.Tags) == 0 {
+		writeError(w, http.StatusBadRequest, "missing_fields")
+		return req, false
+	}
+
+	var owned int64
+	if err := gdb.WithContext(r.Context()).Model(&db.Photo{}).
+		Where("id IN ? AND owner_id = ?", req.PhotoIDs, ownerID(r)).
+		Count(&owned).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+		return req, false
+	}
+	if int(owned) != len(req.PhotoIDs) {
+		writeError(w, http.StatusBadRequest, "photo_not_found")
+		return req, false
+	}
+	return req, true
+}
+
+// Adds tags to one or many photos, creating tags that don't exist yet
+func AddPhotoTags(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodePhotoTags(w, r, gdb)
+		if !ok {
+			return
+		}
+		owner := ownerID(r)
+
+		err := gdb.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			now := time.Now()
+			tags := make([]db.Tag, 0, len(req.Tags))
+			for _, name := range req.Tags {
+				tags = append(tags, db.Tag{ID: uuid.NewString(), OwnerID: owner, Name: name, CreatedAt: now})
+			}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&tags).Error; err != nil {
+				return err
+			}
+
+			// Existing tags kept their IDs, read them back
+			var ids []string
+			if err := tx.Model(&db.Tag{}).
+				Where("owner_id = ? AND name IN ?", owner, req.Tags).
+				Pluck("id", &ids).Error; err != nil {
+				return err
+			}
+
+			links := make([]db.PhotoTag, 0, len(req.PhotoIDs)*len(ids))
+			for _, pid := range req.PhotoIDs {
+				for _, tid := range ids {
+					links = append(links, db.PhotoTag{PhotoID: pid, TagID: tid, CreatedAt: now})
+				}
+			}
+			return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&links).Error
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_insert_failed")
+			return
+		}
+		publish(r.Context(), gdb, owner, events.PhotosTagged, "", req)
+		toJSON(w, http.StatusOK, map[string]any{"photos": len(req.PhotoIDs), "tags": req.Tags})
+	}
+}
+
+// Removes tags from one or many photos, tags left on no photo are dropped
+func RemovePhotoTags(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodePhotoTags(w, r, gdb)
+		if !ok {
+			return
+		}
+		owner := ownerID(r)
+
+		var removed int64
+		err := gdb.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			res := tx.Where("photo_id IN ? AND tag_id IN (?)", req.PhotoIDs,
+				tx.Model(&db.Tag{}).Select("id").Where("owner_id = ? AND name IN ?", owner, req.Tags)).
+				Delete(&db.PhotoTag{})
+			if res.Error != nil {
+				return res.Error
+			}
+			removed = res.RowsAffected
+
+			return tx.Where("owner_id = ? AND name IN ? AND NOT EXISTS (SELECT 1 FROM photo_tags pt WHERE pt.tag_id = tags.id)", owner, req.Tags).
+				Delete(&db.Tag{}).Error
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_delete_failed")
+			return
+		}
+		if removed > 0 {
+			publish(r.Context(), gdb, owner, events.PhotosUntagged, "", req)
+		}
+		toJSON(w, http.StatusOK, map[string]any{"removed": removed})
+	}
+}
+
+// Lists the caller's tags with how many photos carry each, trashed photos don't count
+func GetTags(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rows []tagOut
+		if err := gdb.WithContext(r.Context()).Raw(`
+			SELECT t.name, COUNT(p.id) AS count
+			FROM tags t
+			JOIN photo_tags pt ON pt.tag_id = t.id
+			JOIN photos p ON p.id = pt.photo_id AND p.deleted_at IS NULL
+			WHERE t.owner_id = ?
+			GROUP BY t.id, t.name
+			ORDER BY t.name`, ownerID(r)).Scan(&rows).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_list_failed")
+			return
+		}
+		if rows == nil {
+			rows = []tagOut{}
+		}
+		toJSON(w, http.StatusOK, map[string]any{"items": rows})
+	}
+}
+
+// Narrows a photos query to photos carrying all (or any) of the tags
+func filterByTags(q *gorm.DB, owner string, names []string, mode string) *gorm.DB {
+	sub := q.Session(&gorm.Session{NewDB: true}).
+		Table("photo_tags pt").
+		Select("pt.photo_id").
+		Joins("JOIN tags t ON t.id = pt.tag_id").
+		Where("t.owner_id = ? AND t.name IN ?", owner, names)
+	if mode == tagModeAll {
+		sub = sub.Group("pt.photo_id").Having("COUNT(DISTINCT t.id) = ?", len(names))
+	}
+	return q.Where("id IN (?)", sub)
+}
+
+// Loads tag names for a page of photos in one query
+func loadTags(ctx context.Context, gdb *gorm.DB, ids []string) (map[string][]string, error) {
+	out := make(map[string][]string, len(ids))
+	if len(ids) == 0 {
+		return out, nil
+	}
+	var rows []struct {
+		PhotoID string
+		Name    string
+	}
+	if err := gdb.WithContext(ctx).
+		Table("photo_tags pt").
+		Select("pt.photo_id, t.name").
+		Joins("JOIN tags t ON t.id = pt.tag_id").
+		Where("pt.photo_id IN ?", ids).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		out[row.PhotoID] = append(out[row.PhotoID], row.Name)
+	}
+	for _, names := range out {
+		sort.Strings(names)
+	}
+	return out, nil
+}
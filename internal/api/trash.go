@@ -0,0 +1,218 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/config"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"github.com/AJMerr/little-moments-offline/internal/trash"
+	"gorm.io/gorm"
+)
+
+type trashItem struct {
+	Kind      string    `json:"kind"` // photo or album
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+type trashCursor struct {
+	DeletedAt time.Time `json:"deleted_at"`
+	ID        string    `json:"id"`
+}
+
+func encodeTrashCursor(t time.Time, id string) string {
+	b, _ := json.Marshal(trashCursor{DeletedAt: t, ID: id})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeTrashCursor(s string) (trashCursor, error) {
+	var c trashCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// Lists trashed photos and albums, most recently deleted first
+func GetTrash(gdb *gorm.DB, retention time.Duration, pages config.Pages) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := pages.Default
+		if s := r.URL.Query().Get("limit"); s != "" {
+			if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= pages.Max {
+				limit = n
+			}
+		}
+		var after *trashCursor
+		if c := r.URL.Query().Get("cursor"); c != "" {
+			tc, err := decodeTrashCursor(c)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "bad_cursor")
+				return
+			}
+			after = &tc
+		}
+
+		// Same shape for both tables so the pages can be merged
+		type row struct {
+			ID        string
+			Title     string
+			DeletedAt time.Time
+		}
+		page := func(model any) ([]row, error) {
+			var rows []row
+			q := gdb.WithContext(r.Context()).Model(model).Unscoped().
+				Select("id, title, deleted_at").
+				Where("owner_id = ? AND deleted_at IS NOT NULL", ownerID(r)).
+				Order("deleted_at DESC, id DESC").
+				Limit(limit)
+			if after != nil {
+				q = q.Where("deleted_at < ? OR (deleted_at = ? AND id < ?)",
+					after.DeletedAt, after.DeletedAt, after.ID)
+			}
+			return rows, q.Scan(&rows).Error
+		}
+
+		photos, err := page(&db.Photo{})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_list_failed")
+			return
+		}
+		albums, err := page(&db.Album{})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_list_failed")
+			return
+		}
+
+		items := make([]trashItem, 0, len(photos)+len(albums))
+		for _, p := range photos {
+			items = append(items, trashItem{Kind: "photo", ID: p.ID, Title: p.Title, DeletedAt: p.DeletedAt})
+		}
+		for _, a := range albums {
+			items = append(items, trashItem{Kind: "album", ID: a.ID, Title: a.Title, DeletedAt: a.DeletedAt})
+		}
+		sort.Slice(items, func(i, j int) bool {
+			if !items[i].DeletedAt.Equal(items[j].DeletedAt) {
+				return items[i].DeletedAt.After(items[j].DeletedAt)
+			}
+			return items[i].ID > items[j].ID
+		})
+		if len(items) > limit {
+			items = items[:limit]
+		}
+		for i := range items {
+			items[i].PurgeAt = items[i].DeletedAt.Add(retention)
+		}
+
+		next := ""
+		if len(items) == limit {
+			last := items[len(items)-1]
+			next = encodeTrashCursor(last.DeletedAt, last.ID)
+		}
+
+		toJSON(w, http.StatusOK, map[string]any{
+			"items":       items,
+			"next_cursor": next,
+		})
+	}
+}
+
+var errNotInTrash = errors.New("not_in_trash")
+
+// Finds a trashed photo or album owned by the caller
+func findTrashed(r *http.Request, gdb *gorm.DB, id string) (*db.Photo, *db.Album, error) {
+	var p db.Photo
+	err := gdb.WithContext(r.Context()).Unscoped().
+		Where("id = ? AND owner_id = ? AND deleted_at IS NOT NULL", id, ownerID(r)).
+		First(&p).Error
+	if err == nil {
+		return &p, nil, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, err
+	}
+
+	var a db.Album
+	err = gdb.WithContext(r.Context()).Unscoped().
+		Where("id = ? AND owner_id = ? AND deleted_at IS NOT NULL", id, ownerID(r)).
+		First(&a).Error
+	if err == nil {
+		return nil, &a, nil
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, errNotInTrash
+	}
+	return nil, nil, err
+}
+
+// Brings a photo or album back. Albums keep their photos and cover while trashed.
+func RestoreFromTrash(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		_, a, err := findTrashed(r, gdb, id)
+		if err != nil {
+			if errors.Is(err, errNotInTrash) {
+				writeError(w, http.StatusNotFound, "not_in_trash")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+
+		kind, typ := "photo", events.PhotoRestored
+		q := gdb.WithContext(r.Context()).Unscoped().Model(&db.Photo{})
+		if a != nil {
+			kind, typ = "album", events.AlbumRestored
+			q = gdb.WithContext(r.Context()).Unscoped().Model(&db.Album{})
+		}
+		if err := q.Where("id = ?", id).Update("deleted_at", nil).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_update_failed")
+			return
+		}
+		publish(r.Context(), gdb, ownerID(r), typ, id, map[string]any{"id": id})
+
+		toJSON(w, http.StatusOK, map[string]any{"kind": kind, "id": id})
+	}
+}
+
+// Permanently deletes a trashed item without waiting for the purger
+func DeleteFromTrash(gdb *gorm.DB, store storage.ObjectStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, a, err := findTrashed(r, gdb, r.PathValue("id"))
+		if err != nil {
+			if errors.Is(err, errNotInTrash) {
+				writeError(w, http.StatusNotFound, "not_in_trash")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+			return
+		}
+
+		if p != nil {
+			err = trash.PurgePhoto(r.Context(), gdb, store, *p)
+		} else {
+			err = trash.PurgeAlbum(r.Context(), gdb, *a)
+		}
+		if err != nil {
+			if errors.Is(err, trash.ErrNotTrashed) {
+				writeError(w, http.StatusNotFound, "not_in_trash")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "purge_failed")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
 	"gorm.io/gorm"
 )
 
@@ -14,6 +15,7 @@ type albumPatch = struct {
 	Title        *string `json:"title"`
 	Description  *string `json:"description"`
 	CoverPhotoID *string `json:"cover_photo_id"`
+	SortMode     *string `json:"sort_mode"`
 }
 
 func UpdateAlbum(gdb *gorm.DB) http.HandlerFunc {
@@ -38,7 +40,7 @@ func UpdateAlbum(gdb *gorm.DB) http.HandlerFunc {
 
 		// Ensure album exists and belongs to user
 		var a db.Album
-		if err := gdb.Where("id = ? AND owner_id = ? AND deleted_at IS NULL", id, localuser).First(&a).Error; err != nil {
+		if err := gdb.Where("id = ? AND owner_id = ? AND deleted_at IS NULL", id, ownerID(r)).First(&a).Error; err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
 				writeError(w, http.StatusNotFound, "album_not_found")
 			} else {
@@ -54,6 +56,13 @@ func UpdateAlbum(gdb *gorm.DB) http.HandlerFunc {
 		if p.Description != nil {
 			updates["description"] = *p.Description
 		}
+		if p.SortMode != nil {
+			if !validAlbumSort(*p.SortMode) {
+				writeError(w, http.StatusBadRequest, "bad_sort_mode")
+				return
+			}
+			updates["sort_mode"] = *p.SortMode
+		}
 		if p.CoverPhotoID != nil {
 			if *p.CoverPhotoID == "" {
 				updates["cover_photo_id"] = nil
@@ -76,7 +85,7 @@ func UpdateAlbum(gdb *gorm.DB) http.HandlerFunc {
 
 		if len(updates) > 0 {
 			if err := gdb.Model(&db.Album{}).
-				Where("id = ? AND owner_id = ?", id, localuser).
+				Where("id = ? AND owner_id = ?", id, ownerID(r)).
 				Updates(updates).Error; err != nil {
 				writeError(w, http.StatusInternalServerError, "db_update_failed")
 				return
@@ -88,12 +97,17 @@ func UpdateAlbum(gdb *gorm.DB) http.HandlerFunc {
 			writeError(w, http.StatusInternalServerError, "db_load_failed")
 			return
 		}
-		toJSON(w, 200, albumOut{
+		out := albumOut{
 			ID:           a.ID,
 			Title:        a.Title,
 			Description:  a.Description,
 			CoverPhotoID: a.CoverPhotoID,
+			SortMode:     a.SortMode,
 			CreatedAt:    a.CreatedAt,
-		})
+		}
+		if len(updates) > 0 {
+			publish(r.Context(), gdb, a.OwnerID, events.AlbumUpdated, a.ID, out)
+		}
+		toJSON(w, 200, out)
 	}
 }
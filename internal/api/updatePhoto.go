@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
 	"gorm.io/gorm"
 )
 
@@ -56,7 +57,7 @@ func UpdatePhoto(gdb *gorm.DB) http.HandlerFunc {
 		// Only update rows owned by current user
 		tx := gdb.WithContext(r.Context()).
 			Model(&db.Photo{}).
-			Where("id = ? AND owner_id = ?", id, "local_user"). // DELETE THIS, switch to auth user
+			Where("id = ? AND owner_id = ?", id, ownerID(r)).
 			Updates(updates)
 
 		if tx.Error != nil {
@@ -71,13 +72,13 @@ func UpdatePhoto(gdb *gorm.DB) http.HandlerFunc {
 		// Returns updated metadata
 		var out db.Photo
 		if err := gdb.WithContext(r.Context()).
-			Where("id = ? AND owner_id = ?", id, "local_user"). // YOU KNOW THE DRILL
+			Where("id = ? AND owner_id = ?", id, ownerID(r)).
 			First(&out).Error; err != nil {
 			writeError(w, http.StatusInternalServerError, "db_lookup_failed")
 			return
 		}
 
-		toJSON(w, http.StatusOK, map[string]any{
+		res := map[string]any{
 			"id":           out.ID,
 			"title":        out.Title,
 			"description":  out.Description,
@@ -85,6 +86,9 @@ func UpdatePhoto(gdb *gorm.DB) http.HandlerFunc {
 			"content_type": out.ContentType,
 			"bytes":        out.Bytes,
 			"created_at":   out.CreatedAt,
-		})
+			"captured_at":  out.CapturedAt,
+		}
+		publish(r.Context(), gdb, out.OwnerID, events.PhotoUpdated, out.ID, res)
+		toJSON(w, http.StatusOK, res)
 	}
 }
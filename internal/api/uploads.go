@@ -0,0 +1,373 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/config"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Parts are 8 MiB unless the file is too big to fit in MaxParts of them
+const defaultPartSize = 8 << 20
+
+// At most this many part URLs per request
+const maxPartURLs = 100
+
+type createUploadReq struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	// Total size, checked against the upload policy and used to pick the part size
+	Bytes int64 `json:"bytes"`
+}
+
+type uploadOut struct {
+	ID          string    `json:"id"`
+	Key         string    `json:"key"`
+	ContentType string    `json:"content_type"`
+	PartSize    int64     `json:"part_size"`
+	MaxParts    int       `json:"max_parts"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func partSize(total int64) int64 {
+	size := int64(defaultPartSize)
+	if total > size*storage.MaxParts {
+		// Rounded up to whole MiB
+		size = (total/storage.MaxParts + 1<<20 - 1) &^ (1<<20 - 1)
+	}
+	return size
+}
+
+// Starts a multipart upload for a large file. The client asks for part URLs,
+// PUTs the parts and confirms with upload_id (or completes and confirms the key).
+func CreateUpload(gdb *gorm.DB, store storage.ObjectStore, maxAge time.Duration, uploads config.Uploads) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in createUploadReq
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		key, content := uploadTarget(in.Filename, in.ContentType)
+		if content == "" {
+			writeError(w, http.StatusBadRequest, "content_type_required")
+			return
+		}
+		// Parts can't be size-signed up front, confirm checks the joined object again
+		if !writeUploadError(w, checkUpload(r.Context(), gdb, uploads, ownerID(r), content, in.Bytes)) {
+			return
+		}
+
+		uploadID, err := store.CreateMultipart(r.Context(), store.PhotosBucket(), key, content)
+		if err != nil {
+			log.Printf("uploads: create: %v", err)
+			writeError(w, http.StatusBadGateway, "storage_failed")
+			return
+		}
+		up := db.MultipartUpload{
+			ID:          uuid.NewString(),
+			OwnerID:     ownerID(r),
+			ObjectKey:   key,
+			UploadID:    uploadID,
+			ContentType: content,
+			Bytes:       in.Bytes,
+			CreatedAt:   time.Now(),
+		}
+		if err := gdb.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&up).Error; err != nil {
+				return err
+			}
+			return issueUploadKey(r.Context(), tx, up.OwnerID, key)
+		}); err != nil {
+			_ = store.AbortMultipart(r.Context(), store.PhotosBucket(), key, uploadID)
+			writeError(w, http.StatusInternalServerError, "db_insert_failed")
+			return
+		}
+
+		toJSON(w, http.StatusCreated, uploadOut{
+			ID:          up.ID,
+			Key:         key,
+			ContentType: content,
+			PartSize:    partSize(in.Bytes),
+			MaxParts:    storage.MaxParts,
+			CreatedAt:   up.CreatedAt,
+			ExpiresAt:   up.CreatedAt.Add(maxAge),
+		})
+	}
+}
+
+// The caller's upload from the {id} path value, writes the error itself
+func loadUpload(w http.ResponseWriter, r *http.Request, gdb *gorm.DB) (db.MultipartUpload, bool) {
+	return findUpload(w, r, gdb, r.PathValue("id"))
+}
+
+func findUpload(w http.ResponseWriter, r *http.Request, gdb *gorm.DB, id string) (db.MultipartUpload, bool) {
+	var ups []db.MultipartUpload
+	if err := gdb.WithContext(r.Context()).
+		Where("id = ? AND owner_id = ?", id, ownerID(r)).
+		Limit(1).Find(&ups).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+		return db.MultipartUpload{}, false
+	}
+	if len(ups) == 0 {
+		writeError(w, http.StatusNotFound, "upload_not_found")
+		return db.MultipartUpload{}, false
+	}
+	return ups[0], true
+}
+
+type partURLsReq struct {
+	Parts []int32 `json:"parts"`
+}
+
+type partURL struct {
+	Number int32  `json:"part_number"`
+	URL    string `json:"url"`
+}
+
+// Presigns PUT URLs for the requested part numbers, ask again when they expire
+func PresignUploadParts(gdb *gorm.DB, store storage.ObjectStore, ttl time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		up, ok := loadUpload(w, r, gdb)
+		if !ok {
+			return
+		}
+		var in partURLsReq
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		if len(in.Parts) == 0 || len(in.Parts) > maxPartURLs {
+			writeError(w, http.StatusBadRequest, "bad_parts")
+			return
+		}
+
+		out := make([]partURL, 0, len(in.Parts))
+		for _, n := range in.Parts {
+			if n < 1 || n > storage.MaxParts {
+				writeError(w, http.StatusBadRequest, "bad_part_number")
+				return
+			}
+			url, err := store.PresignPart(r.Context(), store.PhotosBucket(), up.ObjectKey, up.UploadID, n, ttl)
+			if err != nil {
+				if storage.IsNotFound(err) {
+					writeError(w, http.StatusNotFound, "upload_not_found")
+					return
+				}
+				writeError(w, http.StatusInternalServerError, "presign_failed")
+				return
+			}
+			out = append(out, partURL{Number: n, URL: url})
+		}
+		toJSON(w, http.StatusOK, map[string]any{
+			"parts":      out,
+			"expires_at": time.Now().Add(ttl),
+		})
+	}
+}
+
+// Parts the store already has, a resumed upload skips them
+func ListUploadParts(gdb *gorm.DB, store storage.ObjectStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		up, ok := loadUpload(w, r, gdb)
+		if !ok {
+			return
+		}
+		parts, err := store.ListParts(r.Context(), store.PhotosBucket(), up.ObjectKey, up.UploadID)
+		if err != nil {
+			if storage.IsNotFound(err) {
+				writeError(w, http.StatusNotFound, "upload_not_found")
+				return
+			}
+			writeError(w, http.StatusBadGateway, "storage_failed")
+			return
+		}
+		toJSON(w, http.StatusOK, map[string]any{
+			"id":    up.ID,
+			"key":   up.ObjectKey,
+			"parts": parts,
+		})
+	}
+}
+
+var errNoParts = errors.New("no parts uploaded")
+
+// Joins the parts into the object and forgets the upload. Without a part
+// list every part the store has is used. Completing twice is harmless. An
+// object over the size limit or the owner's quota is never made, the upload
+// is aborted instead.
+func completeUpload(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, uploads config.Uploads, up db.MultipartUpload, parts []storage.Part) error {
+	bucket := store.PhotosBucket()
+	listed, err := store.ListParts(ctx, bucket, up.ObjectKey, up.UploadID)
+	if err != nil && !storage.IsNotFound(err) {
+		return err
+	}
+	if len(parts) == 0 {
+		parts = listed
+	}
+
+	if err := checkJoinedSize(ctx, gdb, uploads, up.OwnerID, listed, parts); err != nil {
+		if errors.Is(err, errTooLarge) || errors.Is(err, errQuotaExceeded) {
+			if err := store.AbortMultipart(ctx, bucket, up.ObjectKey, up.UploadID); err != nil && !storage.IsNotFound(err) {
+				log.Printf("uploads: abort %s: %v", up.ObjectKey, err)
+			}
+			if err := gdb.WithContext(ctx).Delete(&db.MultipartUpload{}, "id = ?", up.ID).Error; err != nil {
+				log.Printf("uploads: delete %s: %v", up.ID, err)
+			}
+		}
+		return err
+	}
+
+	if len(parts) == 0 {
+		err = storage.ErrNotFound
+	} else {
+		err = store.CompleteMultipart(ctx, bucket, up.ObjectKey, up.UploadID, parts)
+	}
+	if storage.IsNotFound(err) {
+		// Gone from the store: fine if an earlier complete already made the object
+		if _, headErr := store.Head(ctx, bucket, up.ObjectKey); headErr != nil {
+			if len(parts) == 0 {
+				return errNoParts
+			}
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return gdb.WithContext(ctx).Delete(&db.MultipartUpload{}, "id = ?", up.ID).Error
+}
+
+// Checks the size of the object the parts would make. Part URLs aren't
+// size-signed, so the sizes are the ones the store reports, not the client's.
+func checkJoinedSize(ctx context.Context, gdb *gorm.DB, uploads config.Uploads, owner string, listed, parts []storage.Part) error {
+	sizes := make(map[int32]int64, len(listed))
+	for _, p := range listed {
+		sizes[p.Number] = p.Size
+	}
+	var total int64
+	for _, p := range parts {
+		total += sizes[p.Number]
+	}
+	if total > int64(uploads.MaxBytes) {
+		return errTooLarge
+	}
+	return checkQuota(ctx, gdb, uploads, owner, "", total)
+}
+
+type completeUploadReq struct {
+	Parts []storage.Part `json:"parts"`
+}
+
+func CompleteUpload(gdb *gorm.DB, store storage.ObjectStore, uploads config.Uploads) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		up, ok := loadUpload(w, r, gdb)
+		if !ok {
+			return
+		}
+		var in completeUploadReq
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		if !writeCompleteError(w, completeUpload(r.Context(), gdb, store, uploads, up, in.Parts)) {
+			return
+		}
+		toJSON(w, http.StatusOK, map[string]any{"key": up.ObjectKey})
+	}
+}
+
+// Reports false after writing the response for a failed complete
+func writeCompleteError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errNoParts):
+		writeError(w, http.StatusBadRequest, "no_parts")
+	case storage.IsNotFound(err):
+		writeError(w, http.StatusNotFound, "upload_not_found")
+	case errors.Is(err, errTooLarge), errors.Is(err, errQuotaExceeded):
+		writeUploadError(w, err)
+	default:
+		// Missing parts, bad ETags or parts under the minimum size
+		log.Printf("uploads: complete: %v", err)
+		writeError(w, http.StatusBadRequest, "complete_failed")
+	}
+	return false
+}
+
+// Drops the upload and every part stored so far
+func AbortUpload(gdb *gorm.DB, store storage.ObjectStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		up, ok := loadUpload(w, r, gdb)
+		if !ok {
+			return
+		}
+		if err := store.AbortMultipart(r.Context(), store.PhotosBucket(), up.ObjectKey, up.UploadID); err != nil && !storage.IsNotFound(err) {
+			writeError(w, http.StatusBadGateway, "storage_failed")
+			return
+		}
+		if err := gdb.WithContext(r.Context()).Delete(&db.MultipartUpload{}, "id = ?", up.ID).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_delete_failed")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Aborts uploads older than maxAge every interval until ctx is cancelled.
+// The store is listed too, so uploads whose row is gone are cleaned up as well.
+func RunUploadSweeper(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, maxAge, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := sweepUploads(ctx, gdb, store, time.Now().Add(-maxAge)); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("uploads: sweep: %v", err)
+			}
+		} else if n > 0 {
+			log.Printf("uploads: aborted %d stale uploads", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sweepUploads(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, cutoff time.Time) (int, error) {
+	bucket := store.PhotosBucket()
+	var stale []storage.MultipartUpload
+	if err := store.ListMultipartUploads(ctx, bucket, func(u storage.MultipartUpload) error {
+		if u.Initiated.Before(cutoff) {
+			stale = append(stale, u)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	aborted := 0
+	for _, u := range stale {
+		if err := store.AbortMultipart(ctx, bucket, u.Key, u.UploadID); err != nil && !storage.IsNotFound(err) {
+			log.Printf("uploads: abort %s: %v", u.Key, err)
+			continue
+		}
+		aborted++
+	}
+	if err := gdb.WithContext(ctx).Where("created_at < ?", cutoff).Delete(&db.MultipartUpload{}).Error; err != nil {
+		return aborted, err
+	}
+	return aborted, gdb.WithContext(ctx).Where("created_at < ?", cutoff).Delete(&db.UploadKey{}).Error
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/media"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Fixed renditions generated for every confirmed image
+type variantSpec struct {
+	Name    string
+	MaxEdge int
+	Quality int
+}
+
+var variantSpecs = []variantSpec{
+	{Name: "thumb", MaxEdge: 256, Quality: 80},
+	{Name: "preview", MaxEdge: 1600, Quality: 85},
+}
+
+func variantSpecByName(name string) (variantSpec, bool) {
+	for _, v := range variantSpecs {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return variantSpec{}, false
+}
+
+// Variants live under their own prefix so they never collide with upload keys
+func variantKey(photoID, name string) string {
+	return "variants/" + photoID + "/" + name + ".jpg"
+}
+
+// Only one or two images are decoded at a time to keep memory in check
+const variantWorkers = 2
+
+// Confirmed photos waiting for renditions, drained by RunVariantWorker
+var variantQueue = make(chan db.Photo, 256)
+
+// Inserts pending rows and hands the photo to the variant worker
+func queueVariants(gdb *gorm.DB, store storage.ObjectStore, p db.Photo) {
+	if !strings.HasPrefix(p.ContentType, "image/") {
+		return
+	}
+
+	now := time.Now()
+	rows := make([]db.PhotoVariant, 0, len(variantSpecs))
+	for _, spec := range variantSpecs {
+		rows = append(rows, db.PhotoVariant{
+			PhotoID:     p.ID,
+			Variant:     spec.Name,
+			Key:         variantKey(p.ID, spec.Name),
+			ContentType: "image/jpeg",
+			Status:      db.VariantPending,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		})
+	}
+	if err := gdb.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error; err != nil {
+		log.Printf("variants %s: queue: %v", p.ID, err)
+		return
+	}
+
+	select {
+	case variantQueue <- p:
+	default:
+		// Queue is full, the rows stay pending until the next sweep
+	}
+}
+
+// Generates queued renditions until ctx is cancelled. Rows left pending by a
+// restart or a full queue are picked up again every interval.
+func RunVariantWorker(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, interval time.Duration) {
+	var wg sync.WaitGroup
+	for range variantWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case p := <-variantQueue:
+					generateVariants(ctx, gdb, store, p)
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// The first sweep takes everything a previous run left behind
+	cutoff := time.Now()
+	for {
+		requeuePending(ctx, gdb, cutoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cutoff = time.Now().Add(-interval)
+		}
+	}
+}
+
+// Queues live photos whose renditions have been pending since before cutoff.
+// A photo that is queued twice is just rendered again.
+func requeuePending(ctx context.Context, gdb *gorm.DB, cutoff time.Time) {
+	var photos []db.Photo
+	if err := gdb.WithContext(ctx).Preload("Exif").
+		Where("id IN (SELECT photo_id FROM photo_variants WHERE status = ? AND updated_at < ?)", db.VariantPending, cutoff).
+		Find(&photos).Error; err != nil {
+		if ctx.Err() == nil {
+			log.Printf("variants: sweep: %v", err)
+		}
+		return
+	}
+	for _, p := range photos {
+		select {
+		case variantQueue <- p:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Downloads the original once and writes every rendition back to the bucket
+func generateVariants(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, p db.Photo) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	fail := func(err error) {
+		// Shutting down, the rows stay pending for the next start
+		if errors.Is(ctx.Err(), context.Canceled) {
+			log.Printf("variants %s: interrupted", p.ID)
+			return
+		}
+		log.Printf("variants %s: %v", p.ID, err)
+		gdb.Model(&db.PhotoVariant{}).
+			Where("photo_id = ? AND status = ?", p.ID, db.VariantPending).
+			Updates(map[string]any{"status": db.VariantFailed, "updated_at": time.Now()})
+	}
+
+	body, err := store.GetObject(ctx, store.PhotosBucket(), p.OriginKey)
+	if err != nil {
+		fail(err)
+		return
+	}
+	img, err := media.Decode(body)
+	body.Close()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	orientation := 0
+	if p.Exif != nil {
+		orientation = p.Exif.Orientation
+	}
+
+	// The decoded image is at hand, so the near-duplicate hash is taken here
+	if err := gdb.Model(&db.Photo{}).Where("id = ?", p.ID).
+		Update("dhash", int64(media.DHash(img, orientation))).Error; err != nil {
+		log.Printf("variants %s: dhash: %v", p.ID, err)
+	}
+
+	for _, spec := range variantSpecs {
+		out, err := media.Render(img, spec.MaxEdge, spec.Quality, orientation)
+		if err != nil {
+			fail(err)
+			return
+		}
+		key := variantKey(p.ID, spec.Name)
+		if err := store.PutObject(ctx, store.PhotosBucket(), key, out.ContentType, out.Data); err != nil {
+			fail(err)
+			return
+		}
+		if err := gdb.Model(&db.PhotoVariant{}).
+			Where("photo_id = ? AND variant = ?", p.ID, spec.Name).
+			Updates(map[string]any{
+				"status":       db.VariantReady,
+				"content_type": out.ContentType,
+				"bytes":        len(out.Data),
+				"width":        out.Width,
+				"height":       out.Height,
+				"updated_at":   time.Now(),
+			}).Error; err != nil {
+			fail(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/config"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/media"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"gorm.io/gorm"
+)
+
+var (
+	errObjectMissing   = errors.New("object_missing")
+	errUnsupportedType = errors.New("unsupported_media_type")
+	errKeyNotIssued    = errors.New("key_not_issued")
+)
+
+// What the bucket says about an uploaded object, the client's claims are not used
+type verifiedObject struct {
+	Bytes       int64
+	ContentType string
+	// Leading bytes of the object, enough for sniffing and EXIF
+	Head []byte
+}
+
+// Keys handed out by PresignPhoto are a flat uuid + extension, anything with a
+// prefix belongs to the server (renditions, backups) and can't be registered
+func validUploadKey(key string) bool {
+	return key != "" && !strings.Contains(key, "/") && !strings.HasPrefix(key, ".")
+}
+
+// Remembers who a key was handed out to
+func issueUploadKey(ctx context.Context, gdb *gorm.DB, owner, key string) error {
+	return gdb.WithContext(ctx).Create(&db.UploadKey{Key: key, OwnerID: owner, CreatedAt: time.Now()}).Error
+}
+
+// A key is only confirmed by the user it was issued to. The upload sweeper
+// drops rows after LM_UPLOAD_MAX_AGE, confirmed keys are recognised by their
+// photo row before this is checked.
+func checkUploadKey(ctx context.Context, gdb *gorm.DB, owner, key string) error {
+	var n int64
+	if err := gdb.WithContext(ctx).Model(&db.UploadKey{}).
+		Where("key = ? AND owner_id = ?", key, owner).
+		Count(&n).Error; err != nil {
+		return err
+	}
+	if n == 0 {
+		return errKeyNotIssued
+	}
+	return nil
+}
+
+// HEADs the object for its real size and sniffs the magic bytes from a ranged GET.
+// Objects that are not an allowed image or video are deleted.
+func verifyObject(ctx context.Context, store storage.ObjectStore, key string, uploads config.Uploads) (verifiedObject, error) {
+	var out verifiedObject
+
+	head, err := store.Head(ctx, store.PhotosBucket(), key)
+	if err != nil {
+		if storage.IsNotFound(err) {
+			return out, errObjectMissing
+		}
+		return out, err
+	}
+	out.Bytes = head.Size
+
+	body, err := store.GetObjectRange(ctx, store.PhotosBucket(), key, 0, media.ExifHeadBytes)
+	if err != nil {
+		if storage.IsNotFound(err) {
+			return out, errObjectMissing
+		}
+		return out, err
+	}
+	defer body.Close()
+
+	out.Head, err = io.ReadAll(io.LimitReader(body, media.ExifHeadBytes))
+	if err != nil {
+		return out, err
+	}
+
+	out.ContentType = media.Sniff(out.Head)
+	if !uploads.Allows(out.ContentType) {
+		_ = store.DeleteObject(ctx, store.PhotosBucket(), key)
+		return out, errUnsupportedType
+	}
+	return out, nil
+}
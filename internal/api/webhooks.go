@@ -0,0 +1,325 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/auth"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
+	"github.com/AJMerr/little-moments-offline/internal/webhooks"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type createWebhookReq struct {
+	URL string `json:"url"`
+	// Types like photo.created or kinds like album, empty for every event
+	EventTypes []string `json:"event_types"`
+}
+
+type webhookPatch struct {
+	URL          *string   `json:"url"`
+	EventTypes   *[]string `json:"event_types"`
+	Active       *bool     `json:"active"`
+	RotateSecret bool      `json:"rotate_secret"`
+}
+
+type webhookOut struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"event_types"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	// Only when the webhook is created or the secret rotated
+	Secret string `json:"secret,omitempty"`
+}
+
+type deliveryOut struct {
+	ID             string          `json:"id"`
+	EventID        *int64          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at"`
+	ResponseStatus int             `json:"response_status"`
+	LastError      string          `json:"last_error"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+func toWebhookOut(h db.Webhook) webhookOut {
+	types := webhooks.SplitTypes(h.EventTypes)
+	if types == nil {
+		types = []string{}
+	}
+	return webhookOut{
+		ID:         h.ID,
+		URL:        h.URL,
+		EventTypes: types,
+		Active:     h.Active,
+		CreatedAt:  h.CreatedAt,
+		UpdatedAt:  h.UpdatedAt,
+	}
+}
+
+func toDeliveryOut(d db.WebhookDelivery) deliveryOut {
+	return deliveryOut{
+		ID:             d.ID,
+		EventID:        d.EventID,
+		EventType:      d.EventType,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		NextAttemptAt:  d.NextAttemptAt,
+		LastAttemptAt:  d.LastAttemptAt,
+		ResponseStatus: d.ResponseStatus,
+		LastError:      d.LastError,
+		CreatedAt:      d.CreatedAt,
+		Payload:        json.RawMessage(d.Payload),
+	}
+}
+
+var errBadEventType = errors.New("bad_event_type")
+
+// Trims and checks the filters, returns them as stored
+func webhookTypes(in []string) (string, error) {
+	types := make([]string, 0, len(in))
+	for _, t := range in {
+		t = strings.TrimSpace(t)
+		if !events.Known(t) {
+			return "", errBadEventType
+		}
+		types = append(types, t)
+	}
+	return strings.Join(uniqueStrings(types), ","), nil
+}
+
+// Trims the URL in *s and checks it is an absolute http(s) URL the sender
+// may reach, writes the error itself
+func checkWebhookURL(w http.ResponseWriter, sender *webhooks.Sender, s *string) bool {
+	*s = strings.TrimSpace(*s)
+	u, err := url.Parse(*s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, http.StatusBadRequest, "bad_url")
+		return false
+	}
+	if !sender.AllowsHost(u.Hostname()) {
+		writeError(w, http.StatusBadRequest, "url_not_allowed")
+		return false
+	}
+	return true
+}
+
+// Subscribes a URL to the caller's events. The secret for checking
+// signatures is only returned here and when it is rotated.
+func CreateWebhook(gdb *gorm.DB, sender *webhooks.Sender) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in createWebhookReq
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		if !checkWebhookURL(w, sender, &in.URL) {
+			return
+		}
+		types, err := webhookTypes(in.EventTypes)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_event_type")
+			return
+		}
+		secret, err := auth.NewToken()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "secret_failed")
+			return
+		}
+
+		now := time.Now()
+		h := db.Webhook{
+			ID:         uuid.NewString(),
+			OwnerID:    ownerID(r),
+			URL:        in.URL,
+			Secret:     secret,
+			EventTypes: types,
+			Active:     true,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+		if err := gdb.WithContext(r.Context()).Create(&h).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_insert_failed")
+			return
+		}
+		out := toWebhookOut(h)
+		out.Secret = secret
+		toJSON(w, http.StatusCreated, out)
+	}
+}
+
+// Lists the caller's webhooks, secrets left out
+func GetWebhooks(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var hooks []db.Webhook
+		if err := gdb.WithContext(r.Context()).
+			Where("owner_id = ?", ownerID(r)).
+			Order("created_at, id").
+			Find(&hooks).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_list_failed")
+			return
+		}
+		out := make([]webhookOut, 0, len(hooks))
+		for _, h := range hooks {
+			out = append(out, toWebhookOut(h))
+		}
+		toJSON(w, http.StatusOK, map[string]any{"items": out})
+	}
+}
+
+// The caller's webhook from the {id} path value, writes the error itself
+func loadWebhook(w http.ResponseWriter, r *http.Request, gdb *gorm.DB) (db.Webhook, bool) {
+	var hooks []db.Webhook
+	if err := gdb.WithContext(r.Context()).
+		Where("id = ? AND owner_id = ?", r.PathValue("id"), ownerID(r)).
+		Limit(1).Find(&hooks).Error; err != nil {
+		writeError(w, http.StatusInternalServerError, "db_lookup_failed")
+		return db.Webhook{}, false
+	}
+	if len(hooks) == 0 {
+		writeError(w, http.StatusNotFound, "webhook_not_found")
+		return db.Webhook{}, false
+	}
+	return hooks[0], true
+}
+
+// Changes the URL, the filters or whether the webhook is active. Deliveries
+// still queued for an inactive webhook are marked failed.
+func UpdateWebhook(gdb *gorm.DB, sender *webhooks.Sender) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := loadWebhook(w, r, gdb)
+		if !ok {
+			return
+		}
+		var p webhookPatch
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_json")
+			return
+		}
+
+		if p.URL != nil {
+			if !checkWebhookURL(w, sender, p.URL) {
+				return
+			}
+			h.URL = *p.URL
+		}
+		if p.EventTypes != nil {
+			types, err := webhookTypes(*p.EventTypes)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "bad_event_type")
+				return
+			}
+			h.EventTypes = types
+		}
+		if p.Active != nil {
+			h.Active = *p.Active
+		}
+		secret := ""
+		if p.RotateSecret {
+			s, err := auth.NewToken()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "secret_failed")
+				return
+			}
+			secret, h.Secret = s, s
+		}
+		h.UpdatedAt = time.Now()
+
+		if err := gdb.WithContext(r.Context()).Save(&h).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_update_failed")
+			return
+		}
+		out := toWebhookOut(h)
+		out.Secret = secret
+		toJSON(w, http.StatusOK, out)
+	}
+}
+
+// Removes the webhook and its delivery log
+func DeleteWebhook(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := loadWebhook(w, r, gdb)
+		if !ok {
+			return
+		}
+		if err := gdb.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("webhook_id = ?", h.ID).Delete(&db.WebhookDelivery{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&db.Webhook{}, "id = ?", h.ID).Error
+		}); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_delete_failed")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Latest deliveries of a webhook, ?status= narrows to pending, succeeded or failed
+func GetWebhookDeliveries(gdb *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := loadWebhook(w, r, gdb)
+		if !ok {
+			return
+		}
+
+		limit := 100
+		if s := r.URL.Query().Get("limit"); s != "" {
+			if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= 1000 {
+				limit = n
+			}
+		}
+		q := gdb.WithContext(r.Context()).Where("webhook_id = ?", h.ID)
+		switch status := r.URL.Query().Get("status"); status {
+		case "":
+		case db.DeliveryPending, db.DeliverySucceeded, db.DeliveryFailed:
+			q = q.Where("status = ?", status)
+		default:
+			writeError(w, http.StatusBadRequest, "bad_status")
+			return
+		}
+
+		var rows []db.WebhookDelivery
+		if err := q.Order("created_at DESC, id DESC").Limit(limit).Find(&rows).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, "db_list_failed")
+			return
+		}
+		out := make([]deliveryOut, 0, len(rows))
+		for _, d := range rows {
+			out = append(out, toDeliveryOut(d))
+		}
+		toJSON(w, http.StatusOK, map[string]any{"items": out})
+	}
+}
+
+// Sends a webhook.test event now and returns the delivery with the
+// receiver's answer. Inactive webhooks can be tested too.
+func SendTestWebhook(gdb *gorm.DB, sender *webhooks.Sender) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := loadWebhook(w, r, gdb)
+		if !ok {
+			return
+		}
+		d, err := sender.SendTest(r.Context(), gdb, h)
+		if err != nil {
+			log.Printf("webhooks: test %s: %v", h.ID, err)
+			writeError(w, http.StatusInternalServerError, "db_insert_failed")
+			return
+		}
+		toJSON(w, http.StatusOK, toDeliveryOut(d))
+	}
+}
@@ -0,0 +1,170 @@
+// Package archive writes and reads whole-library archives: a tar with the
+// users, photos, albums and tags as JSON followed by every original and
+// rendition. An archive restores into an empty instance or merges into one
+// that is already in use.
+package archive
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"gorm.io/gorm"
+)
+
+// Written to the manifest so a reader can tell what it is looking at
+const (
+	Format  = "little-moments-archive"
+	Version = 1
+)
+
+// Metadata entries, in the order they are written. Blobs follow them.
+const (
+	manifestFile    = "manifest.json"
+	usersFile       = "users.json"
+	photosFile      = "photos.json"
+	variantsFile    = "variants.json"
+	tagsFile        = "tags.json"
+	photoTagsFile   = "photo_tags.json"
+	albumsFile      = "albums.json"
+	albumPhotosFile = "album_photos.json"
+)
+
+type Manifest struct {
+	Format        string    `json:"format"`
+	Version       int       `json:"version"`
+	SchemaVersion int       `json:"schema_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	// Set when only one user's library was exported
+	OwnerID     string `json:"owner_id,omitempty"`
+	Users       int    `json:"users"`
+	Photos      int    `json:"photos"`
+	Variants    int    `json:"variants"`
+	Tags        int    `json:"tags"`
+	Albums      int    `json:"albums"`
+	AlbumPhotos int    `json:"album_photos"`
+	// Photos whose original couldn't be read, their rows are kept with Missing set
+	Missing int `json:"missing"`
+}
+
+type userRec struct {
+	ID           string    `json:"id"`
+	Email        string    `json:"email"`
+	UserName     string    `json:"user_name"`
+	PasswordHash string    `json:"password_hash"`
+	IsAdmin      bool      `json:"is_admin"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type exifRec struct {
+	TakenAt      *time.Time `json:"taken_at,omitempty"`
+	CameraMake   string     `json:"camera_make,omitempty"`
+	CameraModel  string     `json:"camera_model,omitempty"`
+	LensModel    string     `json:"lens_model,omitempty"`
+	ExposureTime string     `json:"exposure_time,omitempty"`
+	FNumber      float64    `json:"f_number,omitempty"`
+	ISO          int        `json:"iso,omitempty"`
+	FocalLength  float64    `json:"focal_length,omitempty"`
+	Width        int        `json:"width,omitempty"`
+	Height       int        `json:"height,omitempty"`
+	Orientation  int        `json:"orientation,omitempty"`
+}
+
+type photoRec struct {
+	ID          string     `json:"id"`
+	OwnerID     string     `json:"owner_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	OriginKey   string     `json:"origin_key"`
+	ContentType string     `json:"content_type"`
+	Bytes       int64      `json:"bytes"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CapturedAt  time.Time  `json:"captured_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Exif        *exifRec   `json:"exif,omitempty"`
+	// Content and perceptual hashes when the source had computed them
+	SHA256 string `json:"sha256,omitempty"`
+	DHash  *int64 `json:"dhash,omitempty"`
+	// Tar entry holding the original
+	File    string `json:"file"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+type variantRec struct {
+	PhotoID     string    `json:"photo_id"`
+	Variant     string    `json:"variant"`
+	Key         string    `json:"key"`
+	ContentType string    `json:"content_type"`
+	Bytes       int64     `json:"bytes"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	CreatedAt   time.Time `json:"created_at"`
+	File        string    `json:"file"`
+}
+
+type tagRec struct {
+	ID        string    `json:"id"`
+	OwnerID   string    `json:"owner_id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type photoTagRec struct {
+	PhotoID   string    `json:"photo_id"`
+	TagID     string    `json:"tag_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type albumRec struct {
+	ID           string     `json:"id"`
+	OwnerID      string     `json:"owner_id"`
+	Title        string     `json:"title"`
+	Description  string     `json:"description"`
+	CoverPhotoID *string    `json:"cover_photo_id,omitempty"`
+	SortMode     string     `json:"sort_mode"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+}
+
+type albumPhotoRec struct {
+	AlbumID string    `json:"album_id"`
+	PhotoID string    `json:"photo_id"`
+	Pos     int       `json:"pos"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// Tar entry names for blobs, derived from IDs so titles never end up in paths
+func originalFile(p db.Photo) string {
+	return "originals/" + p.ID + path.Ext(p.OriginKey)
+}
+
+func variantFile(v db.PhotoVariant) string {
+	return "variants/" + v.PhotoID + "/" + v.Variant + path.Ext(v.Key)
+}
+
+func deletedAt(d gorm.DeletedAt) *time.Time {
+	if !d.Valid {
+		return nil
+	}
+	t := d.Time
+	return &t
+}
+
+func toDeletedAt(t *time.Time) gorm.DeletedAt {
+	if t == nil {
+		return gorm.DeletedAt{}
+	}
+	return gorm.DeletedAt{Time: *t, Valid: true}
+}
+
+func (m Manifest) check() error {
+	if m.Format != Format {
+		return fmt.Errorf("archive: not a %s (format %q)", Format, m.Format)
+	}
+	if m.Version < 1 || m.Version > Version {
+		return fmt.Errorf("archive: version %d not supported (want 1..%d)", m.Version, Version)
+	}
+	return nil
+}
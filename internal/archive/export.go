@@ -0,0 +1,324 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"gorm.io/gorm"
+)
+
+type ExportOptions struct {
+	// Only this user's library, everything when empty
+	OwnerID string
+}
+
+// Rows read in one transaction so the metadata is a consistent snapshot
+type snapshot struct {
+	users       []db.User
+	photos      []db.Photo
+	variants    []db.PhotoVariant
+	tags        []db.Tag
+	photoTags   []db.PhotoTag
+	albums      []db.Album
+	albumPhotos []db.AlbumPhoto
+}
+
+func loadSnapshot(ctx context.Context, gdb *gorm.DB, owner string) (snapshot, error) {
+	var s snapshot
+	err := gdb.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Scopes a query to the exported owner, on the given column
+		scoped := func(q *gorm.DB, col string) *gorm.DB {
+			if owner == "" {
+				return q
+			}
+			return q.Where(col+" = ?", owner)
+		}
+
+		if err := scoped(tx.Order("created_at, id"), "id").Find(&s.users).Error; err != nil {
+			return err
+		}
+		// Trashed photos and albums go too, restore should still work afterwards
+		if err := scoped(tx.Unscoped().Preload("Exif").Order("created_at, id"), "owner_id").Find(&s.photos).Error; err != nil {
+			return err
+		}
+		if err := scoped(tx.Table("photo_variants v").Select("v.*").
+			Joins("JOIN photos p ON p.id = v.photo_id").
+			Where("v.status = ?", db.VariantReady), "p.owner_id").
+			Order("v.photo_id, v.variant").
+			Scan(&s.variants).Error; err != nil {
+			return err
+		}
+		if err := scoped(tx.Order("owner_id, name"), "owner_id").Find(&s.tags).Error; err != nil {
+			return err
+		}
+		if err := scoped(tx.Table("photo_tags pt").Select("pt.*").
+			Joins("JOIN tags t ON t.id = pt.tag_id"), "t.owner_id").
+			Order("pt.photo_id, pt.tag_id").
+			Scan(&s.photoTags).Error; err != nil {
+			return err
+		}
+		if err := scoped(tx.Unscoped().Order("created_at, id"), "owner_id").Find(&s.albums).Error; err != nil {
+			return err
+		}
+		return scoped(tx.Table("album_photos ap").Select("ap.*").
+			Joins("JOIN albums a ON a.id = ap.album_id"), "a.owner_id").
+			Order("ap.album_id, ap.pos, ap.photo_id").
+			Scan(&s.albumPhotos).Error
+	})
+	return s, err
+}
+
+// Writes the archive to w. Metadata comes first so an import can plan before
+// the blobs stream past; each original is followed by its renditions. A blob
+// that can't be read is logged and its photo marked missing in photos.json.
+func Export(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, w io.Writer, opts ExportOptions) (Manifest, error) {
+	s, err := loadSnapshot(ctx, gdb, opts.OwnerID)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("archive: load: %w", err)
+	}
+	schema, err := db.SchemaVersion(gdb.WithContext(ctx))
+	if err != nil {
+		return Manifest{}, fmt.Errorf("archive: schema version: %w", err)
+	}
+	bucket := store.PhotosBucket()
+
+	// HEAD every blob up front, tar needs each size before the bytes
+	photos := make([]photoRec, 0, len(s.photos))
+	sizes := map[string]int64{}
+	missing := 0
+	for _, p := range s.photos {
+		rec := photoRecFrom(p)
+		info, err := store.Head(ctx, bucket, p.OriginKey)
+		switch {
+		case storage.IsNotFound(err):
+			log.Printf("export: %s: original %s missing", p.ID, p.OriginKey)
+			rec.File, rec.Missing = "", true
+			missing++
+		case err != nil:
+			return Manifest{}, fmt.Errorf("archive: head %s: %w", p.OriginKey, err)
+		default:
+			sizes[p.OriginKey] = info.Size
+		}
+		photos = append(photos, rec)
+	}
+	variants := make([]variantRec, 0, len(s.variants))
+	for _, v := range s.variants {
+		info, err := store.Head(ctx, bucket, v.Key)
+		if storage.IsNotFound(err) {
+			// Regenerated on the other side would be nicer, dropping it is still correct
+			continue
+		}
+		if err != nil {
+			return Manifest{}, fmt.Errorf("archive: head %s: %w", v.Key, err)
+		}
+		sizes[v.Key] = info.Size
+		variants = append(variants, variantRec{
+			PhotoID:     v.PhotoID,
+			Variant:     v.Variant,
+			Key:         v.Key,
+			ContentType: v.ContentType,
+			Bytes:       v.Bytes,
+			Width:       v.Width,
+			Height:      v.Height,
+			CreatedAt:   v.CreatedAt,
+			File:        variantFile(v),
+		})
+	}
+
+	man := Manifest{
+		Format:        Format,
+		Version:       Version,
+		SchemaVersion: schema,
+		CreatedAt:     time.Now().UTC(),
+		OwnerID:       opts.OwnerID,
+		Users:         len(s.users),
+		Photos:        len(photos),
+		Variants:      len(variants),
+		Tags:          len(s.tags),
+		Albums:        len(s.albums),
+		AlbumPhotos:   len(s.albumPhotos),
+		Missing:       missing,
+	}
+
+	tw := tar.NewWriter(w)
+	meta := []struct {
+		name string
+		v    any
+	}{
+		{manifestFile, man},
+		{usersFile, usersRecFrom(s.users)},
+		{photosFile, photos},
+		{variantsFile, variants},
+		{tagsFile, tagsRecFrom(s.tags)},
+		{photoTagsFile, photoTagsRecFrom(s.photoTags)},
+		{albumsFile, albumsRecFrom(s.albums)},
+		{albumPhotosFile, albumPhotosRecFrom(s.albumPhotos)},
+	}
+	for _, m := range meta {
+		if err := writeJSON(tw, m.name, man.CreatedAt, m.v); err != nil {
+			return man, err
+		}
+	}
+
+	byPhoto := map[string][]variantRec{}
+	for _, v := range variants {
+		byPhoto[v.PhotoID] = append(byPhoto[v.PhotoID], v)
+	}
+	for i, p := range s.photos {
+		if photos[i].Missing {
+			continue
+		}
+		if err := writeBlob(ctx, tw, store, p.OriginKey, photos[i].File, sizes[p.OriginKey], p.CapturedAt); err != nil {
+			return man, err
+		}
+		for _, v := range byPhoto[p.ID] {
+			if err := writeBlob(ctx, tw, store, v.Key, v.File, sizes[v.Key], v.CreatedAt); err != nil {
+				return man, err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return man, fmt.Errorf("archive: close: %w", err)
+	}
+	return man, nil
+}
+
+func writeJSON(tw *tar.Writer, name string, mod time.Time, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("archive: encode %s: %w", name, err)
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: mod,
+	}); err != nil {
+		return fmt.Errorf("archive: write %s: %w", name, err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("archive: write %s: %w", name, err)
+	}
+	return nil
+}
+
+// Streams one object into the tar. The size comes from an earlier HEAD, if the
+// object changed since then the tar writer refuses and the export fails.
+func writeBlob(ctx context.Context, tw *tar.Writer, store storage.ObjectStore, key, name string, size int64, mod time.Time) error {
+	body, err := store.GetObject(ctx, store.PhotosBucket(), key)
+	if err != nil {
+		return fmt.Errorf("archive: get %s: %w", key, err)
+	}
+	defer body.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    size,
+		ModTime: mod,
+	}); err != nil {
+		return fmt.Errorf("archive: write %s: %w", name, err)
+	}
+	if _, err := io.Copy(tw, body); err != nil {
+		return fmt.Errorf("archive: copy %s: %w", key, err)
+	}
+	return nil
+}
+
+func usersRecFrom(rows []db.User) []userRec {
+	out := make([]userRec, 0, len(rows))
+	for _, u := range rows {
+		out = append(out, userRec{
+			ID:           u.ID,
+			Email:        u.Email,
+			UserName:     u.UserName,
+			PasswordHash: u.PasswordHash,
+			IsAdmin:      u.IsAdmin,
+			CreatedAt:    u.CreatedAt,
+		})
+	}
+	return out
+}
+
+func photoRecFrom(p db.Photo) photoRec {
+	rec := photoRec{
+		ID:          p.ID,
+		OwnerID:     p.OwnerID,
+		Title:       p.Title,
+		Description: p.Description,
+		OriginKey:   p.OriginKey,
+		ContentType: p.ContentType,
+		Bytes:       p.Bytes,
+		CreatedAt:   p.CreatedAt,
+		CapturedAt:  p.CapturedAt,
+		DeletedAt:   deletedAt(p.DeletedAt),
+		SHA256:      p.SHA256,
+		DHash:       p.DHash,
+		File:        originalFile(p),
+	}
+	if e := p.Exif; e != nil {
+		rec.Exif = &exifRec{
+			TakenAt:      e.TakenAt,
+			CameraMake:   e.CameraMake,
+			CameraModel:  e.CameraModel,
+			LensModel:    e.LensModel,
+			ExposureTime: e.ExposureTime,
+			FNumber:      e.FNumber,
+			ISO:          e.ISO,
+			FocalLength:  e.FocalLength,
+			Width:        e.Width,
+			Height:       e.Height,
+			Orientation:  e.Orientation,
+		}
+	}
+	return rec
+}
+
+func tagsRecFrom(rows []db.Tag) []tagRec {
+	out := make([]tagRec, 0, len(rows))
+	for _, t := range rows {
+		out = append(out, tagRec{ID: t.ID, OwnerID: t.OwnerID, Name: t.Name, CreatedAt: t.CreatedAt})
+	}
+	return out
+}
+
+func photoTagsRecFrom(rows []db.PhotoTag) []photoTagRec {
+	out := make([]photoTagRec, 0, len(rows))
+	for _, pt := range rows {
+		out = append(out, photoTagRec{PhotoID: pt.PhotoID, TagID: pt.TagID, CreatedAt: pt.CreatedAt})
+	}
+	return out
+}
+
+func albumsRecFrom(rows []db.Album) []albumRec {
+	out := make([]albumRec, 0, len(rows))
+	for _, a := range rows {
+		out = append(out, albumRec{
+			ID:           a.ID,
+			OwnerID:      a.OwnerID,
+			Title:        a.Title,
+			Description:  a.Description,
+			CoverPhotoID: a.CoverPhotoID,
+			SortMode:     a.SortMode,
+			CreatedAt:    a.CreatedAt,
+			UpdatedAt:    a.UpdatedAt,
+			DeletedAt:    deletedAt(a.DeletedAt),
+		})
+	}
+	return out
+}
+
+func albumPhotosRecFrom(rows []db.AlbumPhoto) []albumPhotoRec {
+	out := make([]albumPhotoRec, 0, len(rows))
+	for _, ap := range rows {
+		out = append(out, albumPhotoRec{AlbumID: ap.AlbumID, PhotoID: ap.PhotoID, Pos: ap.Pos, AddedAt: ap.AddedAt})
+	}
+	return out
+}
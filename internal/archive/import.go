@@ -0,0 +1,730 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type ImportOptions struct {
+	// Gives everything to this user instead of matching archive users by email
+	OwnerID string
+}
+
+type ImportStats struct {
+	Users        int `json:"users"`
+	UsersMatched int `json:"users_matched"`
+	Photos       int `json:"photos"`
+	// Photos already in the library, by ID, origin key or content
+	Duplicates   int `json:"duplicates"`
+	Missing      int `json:"missing"`
+	Variants     int `json:"variants"`
+	Tags         int `json:"tags"`
+	Albums       int `json:"albums"`
+	AlbumsMerged int `json:"albums_merged"`
+	AlbumPhotos  int `json:"album_photos"`
+}
+
+func (s ImportStats) Summary() string {
+	return fmt.Sprintf("users %d new %d matched, photos %d new %d duplicate %d missing, %d variants, %d tags, albums %d new %d merged, %d album photos",
+		s.Users, s.UsersMatched, s.Photos, s.Duplicates, s.Missing, s.Variants, s.Tags, s.Albums, s.AlbumsMerged, s.AlbumPhotos)
+}
+
+// SQLite caps bound parameters, lookups go in chunks of this many
+const lookupChunk = 500
+
+type importer struct {
+	ctx    context.Context
+	gdb    *gorm.DB
+	store  storage.ObjectStore
+	bucket string
+	opts   ImportOptions
+	stats  ImportStats
+
+	man         Manifest
+	users       []userRec
+	photos      []photoRec
+	variants    []variantRec
+	tags        []tagRec
+	photoTags   []photoTagRec
+	albums      []albumRec
+	albumPhotos []albumPhotoRec
+
+	// Archive user ID -> target user ID
+	userMap  map[string]string
+	newUsers []db.User
+	// First admin created here, takes over local_user's data like registration does
+	claimer string
+
+	// Archive photo ID -> target photo ID, and who owns the target photo
+	photoMap   map[string]string
+	photoOwner map[string]string
+	// Tar entry -> what it holds
+	originals map[string]*photoRec
+	variantOf map[string]*variantRec
+
+	// Tar entries read so far and the archive photo IDs this import creates
+	seen     map[string]bool
+	inserted map[string]bool
+	// Another user's photo already has these, archive photo ID -> new ID,
+	// and origin keys that must not be reused
+	newIDs    map[string]string
+	keysTaken map[string]bool
+
+	newPhotos   []db.Photo
+	newExif     []db.PhotoExif
+	newVariants []db.PhotoVariant
+	// Keys written to the bucket, deleted again if the import fails
+	uploaded []string
+	// owner + sha256 -> target photo ID, for photos seen so far
+	hashes map[string]string
+	// origin key -> sha256 of blobs already in the bucket
+	hashCache map[string]string
+}
+
+// Reads an archive from r into the library. Photos keep their IDs unless they
+// are duplicates, which are skipped and mapped to the photo already there so
+// albums and tags still point at them, or another user's photo has the same ID. Blobs are uploaded as they stream in
+// and rows are written in one transaction at the end; when anything fails the
+// uploaded blobs are deleted and the library is left as it was.
+func Import(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, r io.Reader, opts ImportOptions) (ImportStats, error) {
+	im := &importer{
+		ctx:        ctx,
+		gdb:        gdb.WithContext(ctx),
+		store:      store,
+		bucket:     store.PhotosBucket(),
+		opts:       opts,
+		userMap:    map[string]string{},
+		photoMap:   map[string]string{},
+		photoOwner: map[string]string{},
+		originals:  map[string]*photoRec{},
+		variantOf:  map[string]*variantRec{},
+		inserted:   map[string]bool{},
+		seen:       map[string]bool{},
+		newIDs:     map[string]string{},
+		keysTaken:  map[string]bool{},
+		hashes:     map[string]string{},
+		hashCache:  map[string]string{},
+	}
+	err := im.run(tar.NewReader(r))
+	if err != nil {
+		im.cleanup()
+	}
+	return im.stats, err
+}
+
+func (im *importer) run(tr *tar.Reader) error {
+	planned := false
+	for first := true; ; first = false {
+		if err := im.ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("archive: read: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if first && hdr.Name != manifestFile {
+			return fmt.Errorf("archive: %s must come first, got %s", manifestFile, hdr.Name)
+		}
+		if dst := im.metaTarget(hdr.Name); dst != nil {
+			if planned {
+				return fmt.Errorf("archive: %s after the blobs", hdr.Name)
+			}
+			if err := json.NewDecoder(tr).Decode(dst); err != nil {
+				return fmt.Errorf("archive: decode %s: %w", hdr.Name, err)
+			}
+			if hdr.Name == manifestFile {
+				if err := im.man.check(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if !planned {
+			if err := im.plan(); err != nil {
+				return err
+			}
+			planned = true
+		}
+		if err := im.blob(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+	if !planned {
+		if err := im.plan(); err != nil {
+			return err
+		}
+	}
+	return im.finish()
+}
+
+func (im *importer) metaTarget(name string) any {
+	switch name {
+	case manifestFile:
+		return &im.man
+	case usersFile:
+		return &im.users
+	case photosFile:
+		return &im.photos
+	case variantsFile:
+		return &im.variants
+	case tagsFile:
+		return &im.tags
+	case photoTagsFile:
+		return &im.photoTags
+	case albumsFile:
+		return &im.albums
+	case albumPhotosFile:
+		return &im.albumPhotos
+	}
+	return nil
+}
+
+// Decides, from the metadata alone, which users exist and which photos are
+// already in the library
+func (im *importer) plan() error {
+	if err := im.planUsers(); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(im.photos))
+	keys := make([]string, 0, len(im.photos))
+	for _, p := range im.photos {
+		ids = append(ids, p.ID)
+		keys = append(keys, p.OriginKey)
+	}
+	byID, err := im.existingPhotos("id", ids)
+	if err != nil {
+		return err
+	}
+	byKey, err := im.existingPhotos("origin_key", keys)
+	if err != nil {
+		return err
+	}
+
+	for i := range im.photos {
+		p := &im.photos[i]
+		owner, ok := im.userMap[p.OwnerID]
+		if !ok {
+			return fmt.Errorf("archive: photo %s: unknown owner %s", p.ID, p.OwnerID)
+		}
+		if p.Missing {
+			im.stats.Missing++
+			continue
+		}
+		byIDRow, idTaken := byID[p.ID]
+		if idTaken && byIDRow.OwnerID == owner {
+			im.duplicate(p, byIDRow)
+			continue
+		}
+		byKeyRow, keyTaken := byKey[p.OriginKey]
+		if keyTaken && byKeyRow.OwnerID == owner {
+			im.duplicate(p, byKeyRow)
+			continue
+		}
+		// Matches on another user's photo are not duplicates, this one is
+		// imported next to it under a new ID or key
+		if idTaken {
+			im.newIDs[p.ID] = uuid.NewString()
+		}
+		if keyTaken {
+			im.keysTaken[p.OriginKey] = true
+		}
+		im.originals[p.File] = p
+	}
+	for i := range im.variants {
+		im.variantOf[im.variants[i].File] = &im.variants[i]
+	}
+	return nil
+}
+
+func (im *importer) planUsers() error {
+	if im.opts.OwnerID != "" {
+		for _, u := range im.users {
+			im.userMap[u.ID] = im.opts.OwnerID
+		}
+		// Owner-only archives can carry rows for users that aren't in users.json
+		for _, p := range im.photos {
+			im.userMap[p.OwnerID] = im.opts.OwnerID
+		}
+		for _, a := range im.albums {
+			im.userMap[a.OwnerID] = im.opts.OwnerID
+		}
+		for _, t := range im.tags {
+			im.userMap[t.OwnerID] = im.opts.OwnerID
+		}
+		return nil
+	}
+
+	var existing []db.User
+	if err := im.gdb.Order("created_at, id").Find(&existing).Error; err != nil {
+		return fmt.Errorf("archive: load users: %w", err)
+	}
+	byEmail := map[string]db.User{}
+	taken := map[string]bool{}
+	firstAdmin, hasAccounts := "", false
+	for _, u := range existing {
+		byEmail[strings.ToLower(u.Email)] = u
+		taken[u.ID] = true
+		if u.PasswordHash != "" {
+			hasAccounts = true
+		}
+		if u.IsAdmin && firstAdmin == "" {
+			firstAdmin = u.ID
+		}
+	}
+
+	for _, u := range im.users {
+		if ex, ok := byEmail[strings.ToLower(u.Email)]; ok {
+			im.userMap[u.ID] = ex.ID
+			im.stats.UsersMatched++
+			continue
+		}
+		// Data of the password-less local_user would be out of reach, the
+		// first admin claims it like they would have at registration
+		if u.PasswordHash == "" && hasAccounts && firstAdmin != "" {
+			im.userMap[u.ID] = firstAdmin
+			im.stats.UsersMatched++
+			continue
+		}
+
+		id := u.ID
+		if taken[id] {
+			id = uuid.NewString()
+		}
+		taken[id] = true
+		im.userMap[u.ID] = id
+		if u.IsAdmin && firstAdmin == "" && u.PasswordHash != "" && im.claimer == "" {
+			im.claimer = id
+		}
+		im.newUsers = append(im.newUsers, db.User{
+			ID:           id,
+			Email:        strings.ToLower(u.Email),
+			UserName:     u.UserName,
+			PasswordHash: u.PasswordHash,
+			// Importing must not hand out admin on a library that already has one
+			IsAdmin:   u.IsAdmin && firstAdmin == "",
+			CreatedAt: u.CreatedAt,
+		})
+		im.stats.Users++
+	}
+	return nil
+}
+
+type existingPhoto struct {
+	ID        string
+	OwnerID   string
+	OriginKey string
+}
+
+func (im *importer) existingPhotos(col string, vals []string) (map[string]existingPhoto, error) {
+	out := map[string]existingPhoto{}
+	for start := 0; start < len(vals); start += lookupChunk {
+		end := min(start+lookupChunk, len(vals))
+		var rows []existingPhoto
+		if err := im.gdb.Model(&db.Photo{}).Unscoped().
+			Select("id, owner_id, origin_key").
+			Where(col+" IN ?", vals[start:end]).
+			Scan(&rows).Error; err != nil {
+			return nil, fmt.Errorf("archive: lookup photos: %w", err)
+		}
+		for _, r := range rows {
+			if col == "id" {
+				out[r.ID] = r
+			} else {
+				out[r.OriginKey] = r
+			}
+		}
+	}
+	return out, nil
+}
+
+func (im *importer) duplicate(p *photoRec, ex existingPhoto) {
+	im.photoMap[p.ID] = ex.ID
+	im.photoOwner[ex.ID] = ex.OwnerID
+	im.stats.Duplicates++
+}
+
+func (im *importer) blob(name string, r io.Reader) error {
+	if p, ok := im.originals[name]; ok && !im.seen[name] {
+		im.seen[name] = true
+		return im.original(p, r)
+	}
+	if v, ok := im.variantOf[name]; ok {
+		return im.variant(v, r)
+	}
+	// Blobs of duplicates and anything we don't know are skipped
+	return nil
+}
+
+func (im *importer) original(p *photoRec, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("archive: read %s: %w", p.File, err)
+	}
+	owner := im.userMap[p.OwnerID]
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	// Same bytes already in this user's library, or earlier in this archive
+	if id, ok := im.hashes[owner+hash]; ok {
+		im.duplicate(p, existingPhoto{ID: id, OwnerID: owner})
+		return nil
+	}
+	dup, err := im.sameContent(owner, int64(len(data)), hash)
+	if err != nil {
+		return err
+	}
+	if dup != "" {
+		im.duplicate(p, existingPhoto{ID: dup, OwnerID: owner})
+		return nil
+	}
+
+	id := p.ID
+	if n, ok := im.newIDs[p.ID]; ok {
+		id = n
+	}
+
+	// Keeps the key unless another photo has it or a stray object already sits there
+	key := p.OriginKey
+	if im.keysTaken[key] {
+		key = uuid.NewString() + strings.ToLower(path.Ext(p.OriginKey))
+	} else if _, err := im.store.Head(im.ctx, im.bucket, key); err == nil {
+		key = uuid.NewString() + strings.ToLower(path.Ext(p.OriginKey))
+	} else if !storage.IsNotFound(err) {
+		return fmt.Errorf("archive: head %s: %w", key, err)
+	}
+	if err := im.store.PutObject(im.ctx, im.bucket, key, p.ContentType, data); err != nil {
+		return fmt.Errorf("archive: put %s: %w", key, err)
+	}
+	im.uploaded = append(im.uploaded, key)
+
+	im.photoMap[p.ID] = id
+	im.photoOwner[id] = owner
+	im.inserted[p.ID] = true
+	im.hashes[owner+hash] = id
+	im.newPhotos = append(im.newPhotos, db.Photo{
+		ID:          id,
+		OwnerID:     owner,
+		Title:       p.Title,
+		Description: p.Description,
+		OriginKey:   key,
+		ContentType: p.ContentType,
+		Bytes:       p.Bytes,
+		SHA256:      hash,
+		DHash:       p.DHash,
+		CreatedAt:   p.CreatedAt,
+		CapturedAt:  p.CapturedAt,
+		DeletedAt:   toDeletedAt(p.DeletedAt),
+	})
+	if e := p.Exif; e != nil {
+		im.newExif = append(im.newExif, db.PhotoExif{
+			PhotoID:      id,
+			TakenAt:      e.TakenAt,
+			CameraMake:   e.CameraMake,
+			CameraModel:  e.CameraModel,
+			LensModel:    e.LensModel,
+			ExposureTime: e.ExposureTime,
+			FNumber:      e.FNumber,
+			ISO:          e.ISO,
+			FocalLength:  e.FocalLength,
+			Width:        e.Width,
+			Height:       e.Height,
+			Orientation:  e.Orientation,
+		})
+	}
+	im.stats.Photos++
+	return nil
+}
+
+// Looks for a photo of owner with the same bytes by its stored hash. Rows
+// not hashed yet are checked by downloading the blobs of the same size.
+func (im *importer) sameContent(owner string, size int64, hash string) (string, error) {
+	var rows []existingPhoto
+	if err := im.gdb.Model(&db.Photo{}).Unscoped().
+		Select("id, owner_id, origin_key").
+		Where("owner_id = ? AND sha256 = ?", owner, hash).
+		Limit(1).Scan(&rows).Error; err != nil {
+		return "", fmt.Errorf("archive: lookup photos: %w", err)
+	}
+	if len(rows) > 0 {
+		return rows[0].ID, nil
+	}
+
+	if err := im.gdb.Model(&db.Photo{}).Unscoped().
+		Select("id, owner_id, origin_key").
+		Where("owner_id = ? AND bytes = ? AND sha256 = ''", owner, size).
+		Scan(&rows).Error; err != nil {
+		return "", fmt.Errorf("archive: lookup photos: %w", err)
+	}
+	for _, r := range rows {
+		h, ok := im.hashCache[r.OriginKey]
+		if !ok {
+			var err error
+			if h, err = im.hashObject(r.OriginKey); err != nil {
+				if storage.IsNotFound(err) {
+					continue
+				}
+				return "", err
+			}
+			im.hashCache[r.OriginKey] = h
+		}
+		if h == hash {
+			return r.ID, nil
+		}
+	}
+	return "", nil
+}
+
+func (im *importer) hashObject(key string) (string, error) {
+	body, err := im.store.GetObject(im.ctx, im.bucket, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", fmt.Errorf("archive: hash %s: %w", key, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Renditions are only kept for photos this import created
+func (im *importer) variant(v *variantRec, r io.Reader) error {
+	if !im.inserted[v.PhotoID] {
+		return nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("archive: read %s: %w", v.File, err)
+	}
+	// Keys are derived from the photo ID, a photo imported under a new ID
+	// gets new ones too
+	pid, key := im.photoMap[v.PhotoID], v.Key
+	if pid != v.PhotoID {
+		key = "variants/" + pid + "/" + v.Variant + path.Ext(v.Key)
+	}
+	if err := im.store.PutObject(im.ctx, im.bucket, key, v.ContentType, data); err != nil {
+		return fmt.Errorf("archive: put %s: %w", key, err)
+	}
+	im.uploaded = append(im.uploaded, key)
+
+	now := time.Now()
+	im.newVariants = append(im.newVariants, db.PhotoVariant{
+		PhotoID:     pid,
+		Variant:     v.Variant,
+		Key:         key,
+		ContentType: v.ContentType,
+		Bytes:       int64(len(data)),
+		Width:       v.Width,
+		Height:      v.Height,
+		Status:      db.VariantReady,
+		CreatedAt:   v.CreatedAt,
+		UpdatedAt:   now,
+	})
+	im.stats.Variants++
+	return nil
+}
+
+// Writes every row in one transaction
+func (im *importer) finish() error {
+	if len(im.seen) < len(im.originals) {
+		return errors.New("archive: truncated, some originals are missing")
+	}
+
+	return im.gdb.Transaction(func(tx *gorm.DB) error {
+		if len(im.newUsers) > 0 {
+			if err := tx.CreateInBatches(&im.newUsers, 100).Error; err != nil {
+				return fmt.Errorf("archive: insert users: %w", err)
+			}
+		}
+		if len(im.newPhotos) > 0 {
+			if err := tx.Omit(clause.Associations).CreateInBatches(&im.newPhotos, 100).Error; err != nil {
+				return fmt.Errorf("archive: insert photos: %w", err)
+			}
+		}
+		if len(im.newExif) > 0 {
+			if err := tx.CreateInBatches(&im.newExif, 100).Error; err != nil {
+				return fmt.Errorf("archive: insert exif: %w", err)
+			}
+		}
+		if len(im.newVariants) > 0 {
+			if err := tx.Omit(clause.Associations).CreateInBatches(&im.newVariants, 100).Error; err != nil {
+				return fmt.Errorf("archive: insert variants: %w", err)
+			}
+		}
+		if err := im.importTags(tx); err != nil {
+			return err
+		}
+		if err := im.importAlbums(tx); err != nil {
+			return err
+		}
+		if im.claimer != "" {
+			if err := db.ClaimLocalData(tx, im.claimer); err != nil {
+				return fmt.Errorf("archive: claim local data: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// Tags are matched by owner and name, photo tags follow the photo mapping
+func (im *importer) importTags(tx *gorm.DB) error {
+	tagMap := map[string]string{}
+	tagOwner := map[string]string{}
+	for _, t := range im.tags {
+		owner := im.userMap[t.OwnerID]
+		if owner == "" {
+			continue
+		}
+		var ex []db.Tag
+		if err := tx.Where("owner_id = ? AND name = ?", owner, t.Name).Limit(1).Find(&ex).Error; err != nil {
+			return fmt.Errorf("archive: lookup tag: %w", err)
+		}
+		if len(ex) > 0 {
+			tagMap[t.ID], tagOwner[t.ID] = ex[0].ID, owner
+			continue
+		}
+
+		id := t.ID
+		var n int64
+		if err := tx.Model(&db.Tag{}).Where("id = ?", id).Count(&n).Error; err != nil {
+			return fmt.Errorf("archive: lookup tag: %w", err)
+		}
+		if n > 0 {
+			id = uuid.NewString()
+		}
+		if err := tx.Create(&db.Tag{ID: id, OwnerID: owner, Name: t.Name, CreatedAt: t.CreatedAt}).Error; err != nil {
+			return fmt.Errorf("archive: insert tag: %w", err)
+		}
+		tagMap[t.ID], tagOwner[t.ID] = id, owner
+		im.stats.Tags++
+	}
+
+	for _, pt := range im.photoTags {
+		pid, ok := im.photoMap[pt.PhotoID]
+		tid, ok2 := tagMap[pt.TagID]
+		// Never links a tag to another user's photo
+		if !ok || !ok2 || im.photoOwner[pid] != tagOwner[pt.TagID] {
+			continue
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&db.PhotoTag{PhotoID: pid, TagID: tid, CreatedAt: pt.CreatedAt}).Error; err != nil {
+			return fmt.Errorf("archive: insert photo tag: %w", err)
+		}
+	}
+	return nil
+}
+
+// Albums keep their IDs, one that already exists is merged: its own fields
+// stay and the archive's photos are appended after its current ones
+func (im *importer) importAlbums(tx *gorm.DB) error {
+	albumMap := map[string]string{}
+	albumOwner := map[string]string{}
+	base := map[string]int{}
+	for _, a := range im.albums {
+		owner := im.userMap[a.OwnerID]
+		if owner == "" {
+			continue
+		}
+
+		id := a.ID
+		var ex []db.Album
+		if err := tx.Unscoped().Where("id = ?", a.ID).Limit(1).Find(&ex).Error; err != nil {
+			return fmt.Errorf("archive: lookup album: %w", err)
+		}
+		switch {
+		case len(ex) > 0 && ex[0].OwnerID == owner:
+			var next struct{ N int }
+			if err := tx.Table("album_photos").
+				Select("COALESCE(MAX(pos) + 1, 0) AS n").
+				Where("album_id = ?", a.ID).
+				Scan(&next).Error; err != nil {
+				return fmt.Errorf("archive: album order: %w", err)
+			}
+			albumMap[a.ID], albumOwner[a.ID], base[a.ID] = a.ID, owner, next.N
+			im.stats.AlbumsMerged++
+			continue
+		case len(ex) > 0:
+			// Same ID under another user, keep the two apart
+			id = uuid.NewString()
+		}
+
+		var cover *string
+		if a.CoverPhotoID != nil {
+			if pid, ok := im.photoMap[*a.CoverPhotoID]; ok && im.photoOwner[pid] == owner {
+				cover = &pid
+			}
+		}
+		mode := a.SortMode
+		if mode == "" {
+			mode = db.AlbumSortAdded
+		}
+		row := db.Album{
+			ID:           id,
+			OwnerID:      owner,
+			Title:        a.Title,
+			Description:  a.Description,
+			CoverPhotoID: cover,
+			SortMode:     mode,
+			CreatedAt:    a.CreatedAt,
+			UpdatedAt:    a.UpdatedAt,
+			DeletedAt:    toDeletedAt(a.DeletedAt),
+		}
+		if err := tx.Omit(clause.Associations).Create(&row).Error; err != nil {
+			return fmt.Errorf("archive: insert album: %w", err)
+		}
+		albumMap[a.ID], albumOwner[a.ID] = id, owner
+		im.stats.Albums++
+	}
+
+	for _, ap := range im.albumPhotos {
+		aid, ok := albumMap[ap.AlbumID]
+		pid, ok2 := im.photoMap[ap.PhotoID]
+		if !ok || !ok2 || im.photoOwner[pid] != albumOwner[ap.AlbumID] {
+			continue
+		}
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Omit(clause.Associations).
+			Create(&db.AlbumPhoto{AlbumID: aid, PhotoID: pid, Pos: base[ap.AlbumID] + ap.Pos, AddedAt: ap.AddedAt})
+		if res.Error != nil {
+			return fmt.Errorf("archive: insert album photo: %w", res.Error)
+		}
+		im.stats.AlbumPhotos += int(res.RowsAffected)
+	}
+	return nil
+}
+
+// Best effort, runs on a fresh context since ctx may be the reason we failed
+func (im *importer) cleanup() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, key := range im.uploaded {
+		if err := im.store.DeleteObject(ctx, im.bucket, key); err != nil && !storage.IsNotFound(err) {
+			log.Printf("import: cleanup %s: %v", key, err)
+		}
+	}
+}
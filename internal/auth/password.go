@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const MinPasswordLen = 8
+
+var ErrWeakPassword = errors.New("password too short")
+
+// Hashes a password with bcrypt at the default cost
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLen {
+		return "", ErrWeakPassword
+	}
+	// bcrypt ignores anything past 72 bytes, refuse instead of silently truncating
+	if len(password) > 72 {
+		return "", bcrypt.ErrPasswordTooLong
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Reports whether password matches the stored hash
+func CheckPassword(hash, password string) bool {
+	if hash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
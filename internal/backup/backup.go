@@ -0,0 +1,302 @@
+// Package backup takes consistent snapshots of the SQLite database while the
+// server runs, keeps the newest few in the object store and restores them.
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/config"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Snapshot names sort by time: <prefix>app-20060102T150405Z.db.gz
+const (
+	namePrefix = "app-"
+	nameSuffix = ".db.gz"
+	timeLayout = "20060102T150405Z"
+)
+
+type Options struct {
+	// Bucket for snapshots, the photos bucket when empty
+	Bucket string
+	// Key prefix, e.g. "backups/"
+	Prefix string
+	// Newest snapshots kept by Rotate
+	Keep int
+}
+
+func OptionsFrom(c config.Backup) Options {
+	return Options{Bucket: c.Bucket, Prefix: c.Prefix, Keep: c.Keep}
+}
+
+// Prefixes fsck has to leave alone when snapshots share the photos bucket
+func (o Options) SkipPrefixes(photosBucket string) []string {
+	if o.Bucket == "" || o.Bucket == photosBucket {
+		return []string{o.Prefix}
+	}
+	return nil
+}
+
+func (o Options) bucket(store storage.ObjectStore) string {
+	if o.Bucket == "" {
+		return store.PhotosBucket()
+	}
+	return o.Bucket
+}
+
+type Snapshot struct {
+	Key       string    `json:"key"`
+	Bytes     int64     `json:"bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func snapshotKey(prefix string, t time.Time) string {
+	return prefix + namePrefix + t.UTC().Format(timeLayout) + nameSuffix
+}
+
+// Reads the time back out of a snapshot key, false for anything else under the prefix
+func parseKey(prefix, key string) (time.Time, bool) {
+	name, ok := strings.CutPrefix(key, prefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	name, ok = strings.CutPrefix(name, namePrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	name, ok = strings.CutSuffix(name, nameSuffix)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(timeLayout, name)
+	return t, err == nil
+}
+
+// Writes a snapshot with VACUUM INTO, which reads one consistent view of the
+// database without blocking writers, then uploads it gzipped and rotates
+func Create(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, opts Options) (Snapshot, error) {
+	bucket := opts.bucket(store)
+	if bucket != store.PhotosBucket() {
+		if err := store.EnsureBucket(ctx, bucket); err != nil {
+			return Snapshot{}, fmt.Errorf("ensure bucket: %w", err)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "lm-backup-")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	path := filepath.Join(dir, "app.db")
+	if err := gdb.WithContext(ctx).Exec("VACUUM INTO ?", path).Error; err != nil {
+		return Snapshot{}, fmt.Errorf("vacuum into: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, f); err != nil {
+		return Snapshot{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return Snapshot{}, err
+	}
+
+	snap := Snapshot{Key: snapshotKey(opts.Prefix, now), Bytes: int64(buf.Len()), CreatedAt: now.UTC().Truncate(time.Second)}
+	if err := store.PutObject(ctx, bucket, snap.Key, "application/gzip", buf.Bytes()); err != nil {
+		return Snapshot{}, fmt.Errorf("upload: %w", err)
+	}
+
+	if _, err := Rotate(ctx, store, opts); err != nil {
+		log.Printf("backup: rotate: %v", err)
+	}
+	return snap, nil
+}
+
+// Snapshots under the prefix, newest first
+func List(ctx context.Context, store storage.ObjectStore, opts Options) ([]Snapshot, error) {
+	snaps := []Snapshot{}
+	err := store.ListObjects(ctx, opts.bucket(store), opts.Prefix, func(o storage.ObjectInfo) error {
+		if t, ok := parseKey(opts.Prefix, o.Key); ok {
+			snaps = append(snaps, Snapshot{Key: o.Key, Bytes: o.Size, CreatedAt: t})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].CreatedAt.After(snaps[j].CreatedAt) })
+	return snaps, nil
+}
+
+// Deletes all but the newest opts.Keep snapshots, returns how many went
+func Rotate(ctx context.Context, store storage.ObjectStore, opts Options) (int, error) {
+	if opts.Keep < 1 {
+		return 0, nil
+	}
+	snaps, err := List(ctx, store, opts)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, s := range snaps[min(opts.Keep, len(snaps)):] {
+		if err := store.DeleteObject(ctx, opts.bucket(store), s.Key); err != nil && !storage.IsNotFound(err) {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Takes a snapshot every interval until ctx is cancelled. After a restart
+// the first one waits for the interval since the newest existing snapshot.
+func RunScheduler(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, opts Options, interval time.Duration) {
+	// Give startup a moment before the first VACUUM
+	wait := time.Minute
+	if snaps, err := List(ctx, store, opts); err != nil {
+		log.Printf("backup: list: %v", err)
+	} else if len(snaps) > 0 {
+		wait = max(wait, time.Until(snaps[0].CreatedAt.Add(interval)))
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		snap, err := Create(ctx, gdb, store, opts)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			log.Printf("backup: %v", err)
+		default:
+			log.Printf("backup: wrote %s (%d bytes)", snap.Key, snap.Bytes)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// Downloads key ("latest" for the newest) next to dbPath, checks it and
+// swaps it in. The current database is kept as <dbPath>.pre-restore-<time>.
+// The server must not be running.
+func Restore(ctx context.Context, store storage.ObjectStore, opts Options, key, dbPath string) (Snapshot, error) {
+	snaps, err := List(ctx, store, opts)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var snap Snapshot
+	for _, s := range snaps {
+		if key == "latest" || s.Key == key || strings.TrimPrefix(s.Key, opts.Prefix) == key {
+			snap = s
+			break
+		}
+	}
+	if snap.Key == "" {
+		return Snapshot{}, fmt.Errorf("snapshot %q not found", key)
+	}
+
+	tmp := dbPath + ".restore"
+	removeDB(tmp)
+	if err := download(ctx, store, opts.bucket(store), snap.Key, tmp); err != nil {
+		removeDB(tmp)
+		return snap, err
+	}
+	if err := Verify(tmp); err != nil {
+		removeDB(tmp)
+		return snap, fmt.Errorf("verify %s: %w", snap.Key, err)
+	}
+
+	// The WAL and shared memory files belong to the old database, they move with it
+	if _, err := os.Stat(dbPath); err == nil {
+		aside := dbPath + ".pre-restore-" + time.Now().UTC().Format(timeLayout)
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if err := os.Rename(dbPath+suffix, aside+suffix); err != nil && !os.IsNotExist(err) {
+				return snap, err
+			}
+		}
+		log.Printf("restore: previous database moved to %s", aside)
+	}
+	if err := os.Rename(tmp, dbPath); err != nil {
+		return snap, err
+	}
+	return snap, nil
+}
+
+func download(ctx context.Context, store storage.ObjectStore, bucket, key, path string) error {
+	body, err := store.GetObject(ctx, bucket, key)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", key, err)
+	}
+	defer body.Close()
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", key, err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, zr); err != nil {
+		f.Close()
+		return fmt.Errorf("download %s: %w", key, err)
+	}
+	return f.Close()
+}
+
+// Runs PRAGMA integrity_check and refuses schemas newer than this binary
+func Verify(path string) error {
+	gdb, err := db.OpenDB(path)
+	if err != nil {
+		return err
+	}
+	defer db.CloseDB(gdb)
+
+	var rows []string
+	if err := gdb.Raw("PRAGMA integrity_check").Scan(&rows).Error; err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	if len(rows) != 1 || rows[0] != "ok" {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(rows, "; "))
+	}
+
+	migs, err := db.Migrations()
+	if err != nil {
+		return err
+	}
+	v, err := db.SchemaVersion(gdb)
+	if err != nil {
+		return err
+	}
+	if len(migs) > 0 && v > migs[len(migs)-1].Version {
+		return db.ErrSchemaTooNew
+	}
+	return nil
+}
+
+func removeDB(path string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		_ = os.Remove(path + suffix)
+	}
+}
@@ -0,0 +1,509 @@
+// Package config loads the server settings. Each layer overrides the one
+// before it: built-in defaults, an optional JSON file, LM_* environment
+// variables, then command line flags.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/media"
+)
+
+type Config struct {
+	// Main API listener
+	Addr string `json:"addr"`
+	// Optional private listener for /metrics and /healthz, off when empty
+	AdminAddr string `json:"admin_addr"`
+	DBPath    string `json:"db_path"`
+
+	// Blob store backend, "s3" or "fs"
+	Storage      string `json:"storage"`
+	PhotosBucket string `json:"photos_bucket"`
+	S3           S3     `json:"s3"`
+	FS           FS     `json:"fs"`
+
+	// Browser origins allowed to call the API with credentials
+	WebOrigins []string `json:"web_origins"`
+	// How long trashed photos and albums are kept
+	TrashRetention Duration `json:"trash_retention"`
+	// Unfinished multipart uploads are aborted after this long
+	UploadMaxAge Duration `json:"upload_max_age"`
+	// How far back GET /events can replay
+	EventRetention Duration `json:"event_retention"`
+
+	Uploads  Uploads  `json:"uploads"`
+	Presign  Presign  `json:"presign"`
+	Pages    Pages    `json:"pages"`
+	HTTP     HTTP     `json:"http"`
+	Backup   Backup   `json:"backup"`
+	Webhooks Webhooks `json:"webhooks"`
+}
+
+type S3 struct {
+	Endpoint       string `json:"endpoint"`
+	Region         string `json:"region"`
+	AccessKey      string `json:"access_key"`
+	SecretKey      string `json:"secret_key"`
+	ForcePathStyle bool   `json:"force_path_style"`
+}
+
+type FS struct {
+	Root       string `json:"root"`
+	Secret     string `json:"secret"`
+	PublicBase string `json:"public_base"`
+}
+
+// What users may upload
+type Uploads struct {
+	// Largest single file
+	MaxBytes Size `json:"max_bytes"`
+	// Accepted content types, compared with what the bytes sniff as
+	AllowedTypes []string `json:"allowed_types"`
+	// Storage per user unless an admin set their own, 0 is unlimited
+	Quota Size `json:"quota"`
+}
+
+// Reports whether contentType is on the allow-list
+func (u Uploads) Allows(contentType string) bool {
+	return slices.Contains(u.AllowedTypes, contentType)
+}
+
+// Lifetimes of the presigned URLs handed to clients
+type Presign struct {
+	Upload Duration `json:"upload"`
+	// Default for GET /photos/{id}/url, ?ttl= is clamped to MinDownload..MaxDownload
+	Download    Duration `json:"download"`
+	MinDownload Duration `json:"min_download"`
+	MaxDownload Duration `json:"max_download"`
+	// URLs in a public share page
+	Share Duration `json:"share"`
+}
+
+// Page sizes for the list endpoints, ?limit= above Max is not honoured
+type Pages struct {
+	Default int `json:"default"`
+	// Album photo grids default to a multiple of 2, 3, 4 and 6 columns
+	AlbumPhotos int `json:"album_photos"`
+	Max         int `json:"max"`
+}
+
+// Server timeouts. Blob transfers, exports and ZIP downloads lift the
+// read/write deadlines for their own requests.
+type HTTP struct {
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	// How long SIGTERM waits for requests and workers before closing anyway
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+}
+
+// Database snapshots in the object store
+type Backup struct {
+	// Bucket for snapshots, the photos bucket when empty
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	// Time between scheduled snapshots, 0 turns the schedule off
+	Interval Duration `json:"interval"`
+	// Newest snapshots kept, older ones are deleted after each backup
+	Keep int `json:"keep"`
+}
+
+// Outgoing webhook deliveries
+type Webhooks struct {
+	// Per attempt, the receiver has this long to answer
+	Timeout Duration `json:"timeout"`
+	// Attempts before a delivery is marked failed, the gaps double from 30s
+	MaxAttempts int `json:"max_attempts"`
+	// Lets webhooks reach loopback, private and link-local addresses, for
+	// receivers on the LAN. Off so users can't probe the server's network.
+	AllowPrivate bool `json:"allow_private"`
+}
+
+// Duration reads and writes as "10m" in JSON
+type Duration time.Duration
+
+func (d Duration) D() time.Duration { return time.Duration(d) }
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Size is a byte count, "2GiB" or "500MB" in JSON and env
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}, {"B", 1},
+}
+
+func (s Size) MarshalText() ([]byte, error) {
+	for _, u := range sizeUnits[:4] {
+		if s != 0 && int64(s)%u.n == 0 {
+			return []byte(strconv.FormatInt(int64(s)/u.n, 10) + u.suffix), nil
+		}
+	}
+	return []byte(strconv.FormatInt(int64(s), 10)), nil
+}
+
+func (s *Size) UnmarshalText(b []byte) error {
+	v := strings.TrimSpace(string(b))
+	mult := int64(1)
+	for _, u := range sizeUnits {
+		if num, ok := strings.CutSuffix(v, u.suffix); ok {
+			v, mult = strings.TrimSpace(num), u.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mult {
+		return fmt.Errorf("bad size %q", b)
+	}
+	*s = Size(n * mult)
+	return nil
+}
+
+// Plain numbers in the JSON file are bytes
+func (s *Size) UnmarshalJSON(b []byte) error {
+	if n, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+		*s = Size(n)
+		return nil
+	}
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("bad size %s", b)
+	}
+	return s.UnmarshalText([]byte(v))
+}
+
+func Defaults() Config {
+	return Config{
+		Addr:         ":8173",
+		DBPath:       "data/app.db",
+		Storage:      "s3",
+		PhotosBucket: "photos",
+		S3:           S3{ForcePathStyle: true},
+		FS: FS{
+			Root:       "data/blobs",
+			PublicBase: "http://localhost:8173",
+		},
+		WebOrigins:     []string{"http://localhost:5173", "http://127.0.0.1:5173"},
+		TrashRetention: Duration(30 * 24 * time.Hour),
+		UploadMaxAge:   Duration(24 * time.Hour),
+		EventRetention: Duration(7 * 24 * time.Hour),
+		Uploads:        Uploads{MaxBytes: 2 << 30, AllowedTypes: media.Types()},
+		Presign: Presign{
+			Upload:      Duration(10 * time.Minute),
+			Download:    Duration(5 * time.Minute),
+			MinDownload: Duration(10 * time.Second),
+			MaxDownload: Duration(50 * time.Minute),
+			Share:       Duration(15 * time.Minute),
+		},
+		Pages: Pages{Default: 25, AlbumPhotos: 24, Max: 100},
+		HTTP: HTTP{
+			ReadHeaderTimeout: Duration(10 * time.Second),
+			ReadTimeout:       Duration(time.Minute),
+			WriteTimeout:      Duration(2 * time.Minute),
+			IdleTimeout:       Duration(2 * time.Minute),
+			ShutdownTimeout:   Duration(25 * time.Second),
+		},
+		Backup:   Backup{Prefix: "backups/", Interval: Duration(24 * time.Hour), Keep: 7},
+		Webhooks: Webhooks{Timeout: Duration(10 * time.Second), MaxAttempts: 10},
+	}
+}
+
+// Loads every layer and validates the result. args are the command's flags,
+// -config names the JSON file (LM_CONFIG works too).
+func Load(name string, args []string) (Config, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	file := flags.String("config", os.Getenv("LM_CONFIG"), "JSON config file")
+	addr := flags.String("addr", "", "listen address (LM_ADDR)")
+	adminAddr := flags.String("admin-addr", "", "private /metrics listener (LM_ADMIN_ADDR)")
+	dbPath := flags.String("db", "", "SQLite database path (LM_DB_PATH)")
+	storage := flags.String("storage", "", "blob store, s3 or fs (LM_STORAGE)")
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if flags.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	c := Defaults()
+	if *file != "" {
+		if err := c.loadFile(*file); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := c.loadEnv(os.LookupEnv); err != nil {
+		return Config{}, err
+	}
+
+	// Only flags given on the command line win over the other layers
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			c.Addr = *addr
+		case "admin-addr":
+			c.AdminAddr = *adminAddr
+		case "db":
+			c.DBPath = *dbPath
+		case "storage":
+			c.Storage = *storage
+		}
+	})
+	return c, c.Validate()
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv(lookup func(string) (string, bool)) error {
+	str := func(key string, dst *string) {
+		if v, ok := lookup(key); ok && v != "" {
+			*dst = v
+		}
+	}
+	var errs []error
+	dur := func(key string, dst *Duration) {
+		if v, ok := lookup(key); ok && v != "" {
+			if err := dst.UnmarshalText([]byte(v)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: bad duration %q", key, v))
+			}
+		}
+	}
+	size := func(key string, dst *Size) {
+		if v, ok := lookup(key); ok && v != "" {
+			if err := dst.UnmarshalText([]byte(v)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: bad size %q", key, v))
+			}
+		}
+	}
+	boolean := func(key string, dst *bool) {
+		if v, ok := lookup(key); ok && v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: bad bool %q", key, v))
+				return
+			}
+			*dst = b
+		}
+	}
+	num := func(key string, dst *int) {
+		if v, ok := lookup(key); ok && v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: bad number %q", key, v))
+				return
+			}
+			*dst = n
+		}
+	}
+
+	str("LM_ADDR", &c.Addr)
+	str("LM_ADMIN_ADDR", &c.AdminAddr)
+	str("LM_DB_PATH", &c.DBPath)
+	str("LM_STORAGE", &c.Storage)
+	str("LM_S3_BUCKET_PHOTOS", &c.PhotosBucket)
+	str("LM_S3_ENDPOINT", &c.S3.Endpoint)
+	str("LM_S3_REGION", &c.S3.Region)
+	str("LM_S3_ACCESS_KEY", &c.S3.AccessKey)
+	str("LM_S3_SECRET_KEY", &c.S3.SecretKey)
+	boolean("LM_S3_FORCE_PATH_STYLE", &c.S3.ForcePathStyle)
+	str("LM_FS_ROOT", &c.FS.Root)
+	str("LM_FS_SECRET", &c.FS.Secret)
+	str("LM_FS_PUBLIC_BASE", &c.FS.PublicBase)
+	if v, ok := lookup("LM_WEB_ORIGINS"); ok && v != "" {
+		c.WebOrigins = splitList(v)
+	}
+	dur("LM_TRASH_RETENTION", &c.TrashRetention)
+	dur("LM_UPLOAD_MAX_AGE", &c.UploadMaxAge)
+	dur("LM_EVENT_RETENTION", &c.EventRetention)
+	size("LM_UPLOAD_MAX_BYTES", &c.Uploads.MaxBytes)
+	if v, ok := lookup("LM_UPLOAD_ALLOWED_TYPES"); ok && v != "" {
+		c.Uploads.AllowedTypes = splitList(v)
+	}
+	size("LM_USER_QUOTA", &c.Uploads.Quota)
+	dur("LM_PRESIGN_UPLOAD_TTL", &c.Presign.Upload)
+	dur("LM_PRESIGN_DOWNLOAD_TTL", &c.Presign.Download)
+	dur("LM_PRESIGN_MIN_DOWNLOAD_TTL", &c.Presign.MinDownload)
+	dur("LM_PRESIGN_MAX_DOWNLOAD_TTL", &c.Presign.MaxDownload)
+	dur("LM_SHARE_URL_TTL", &c.Presign.Share)
+	num("LM_PAGE_SIZE", &c.Pages.Default)
+	num("LM_ALBUM_PAGE_SIZE", &c.Pages.AlbumPhotos)
+	num("LM_PAGE_SIZE_MAX", &c.Pages.Max)
+	dur("LM_HTTP_READ_HEADER_TIMEOUT", &c.HTTP.ReadHeaderTimeout)
+	dur("LM_HTTP_READ_TIMEOUT", &c.HTTP.ReadTimeout)
+	dur("LM_HTTP_WRITE_TIMEOUT", &c.HTTP.WriteTimeout)
+	dur("LM_HTTP_IDLE_TIMEOUT", &c.HTTP.IdleTimeout)
+	dur("LM_SHUTDOWN_TIMEOUT", &c.HTTP.ShutdownTimeout)
+	str("LM_BACKUP_BUCKET", &c.Backup.Bucket)
+	str("LM_BACKUP_PREFIX", &c.Backup.Prefix)
+	dur("LM_BACKUP_INTERVAL", &c.Backup.Interval)
+	num("LM_BACKUP_KEEP", &c.Backup.Keep)
+	dur("LM_WEBHOOK_TIMEOUT", &c.Webhooks.Timeout)
+	num("LM_WEBHOOK_MAX_ATTEMPTS", &c.Webhooks.MaxAttempts)
+	boolean("LM_WEBHOOK_ALLOW_PRIVATE", &c.Webhooks.AllowPrivate)
+	return errors.Join(errs...)
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// Checks every setting and reports all problems at once
+func (c Config) Validate() error {
+	var errs []error
+	bad := func(format string, args ...any) { errs = append(errs, fmt.Errorf(format, args...)) }
+
+	if c.Addr == "" {
+		bad("addr is required")
+	}
+	if c.DBPath == "" {
+		bad("db_path is required")
+	}
+	if c.PhotosBucket == "" {
+		bad("photos_bucket is required")
+	}
+	switch c.Storage {
+	case "s3":
+		if c.S3.Endpoint != "" {
+			if u, err := url.Parse(c.S3.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+				bad("s3.endpoint: %q is not a URL", c.S3.Endpoint)
+			}
+		}
+	case "fs":
+		if c.FS.Root == "" {
+			bad("fs.root is required with storage fs")
+		}
+		if c.FS.Secret == "" {
+			bad("fs.secret is required with storage fs (LM_FS_SECRET)")
+		}
+	default:
+		bad("storage: unknown %q (want s3 or fs)", c.Storage)
+	}
+	for _, o := range c.WebOrigins {
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			bad("web_origins: %q is not an origin like http://host:port", o)
+		}
+	}
+
+	if c.TrashRetention <= 0 {
+		bad("trash_retention must be positive")
+	}
+	if c.UploadMaxAge <= 0 {
+		bad("upload_max_age must be positive")
+	}
+	if c.EventRetention <= 0 {
+		bad("event_retention must be positive")
+	}
+	if c.Uploads.MaxBytes <= 0 {
+		bad("uploads.max_bytes must be positive")
+	}
+	if c.Uploads.Quota < 0 {
+		bad("uploads.quota can't be negative")
+	}
+	if len(c.Uploads.AllowedTypes) == 0 {
+		bad("uploads.allowed_types can't be empty")
+	}
+	// Confirm trusts the sniffed type, anything it can't recognise would never match
+	for _, ct := range c.Uploads.AllowedTypes {
+		if !media.Allowed(ct) {
+			bad("uploads.allowed_types: %q is not one of %s", ct, strings.Join(media.Types(), ", "))
+		}
+	}
+	p := c.Presign
+	if p.Upload <= 0 || p.Share <= 0 || p.MinDownload <= 0 {
+		bad("presign durations must be positive")
+	}
+	if p.MinDownload > p.Download || p.Download > p.MaxDownload {
+		bad("presign: want min_download <= download <= max_download")
+	}
+	// S3 refuses presigned URLs valid for more than a week
+	if p.Upload.D() > 7*24*time.Hour || p.MaxDownload.D() > 7*24*time.Hour || p.Share.D() > 7*24*time.Hour {
+		bad("presign durations can't exceed 168h")
+	}
+	if c.Pages.Max < 1 || c.Pages.Default < 1 || c.Pages.AlbumPhotos < 1 {
+		bad("page sizes must be at least 1")
+	}
+	if c.Pages.Default > c.Pages.Max || c.Pages.AlbumPhotos > c.Pages.Max {
+		bad("pages: default sizes can't exceed max")
+	}
+	h := c.HTTP
+	if h.ReadHeaderTimeout <= 0 || h.ReadTimeout <= 0 || h.WriteTimeout <= 0 || h.IdleTimeout <= 0 || h.ShutdownTimeout <= 0 {
+		bad("http timeouts must be positive")
+	}
+	// An empty prefix would mix snapshots with the photos
+	if c.Backup.Prefix == "" || !strings.HasSuffix(c.Backup.Prefix, "/") || strings.HasPrefix(c.Backup.Prefix, "/") {
+		bad("backup.prefix: %q must be a path like backups/", c.Backup.Prefix)
+	}
+	if c.Backup.Interval < 0 {
+		bad("backup.interval can't be negative")
+	}
+	if c.Backup.Keep < 1 {
+		bad("backup.keep must be at least 1")
+	}
+	if c.Webhooks.Timeout <= 0 {
+		bad("webhooks.timeout must be positive")
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		bad("webhooks.max_attempts must be at least 1")
+	}
+	return errors.Join(errs...)
+}
+
+const redacted = "REDACTED"
+
+// Copy safe to print, secrets that are set are replaced
+func (c Config) Redacted() Config {
+	if c.S3.AccessKey != "" {
+		c.S3.AccessKey = redacted
+	}
+	if c.S3.SecretKey != "" {
+		c.S3.SecretKey = redacted
+	}
+	if c.FS.Secret != "" {
+		c.FS.Secret = redacted
+	}
+	c.WebOrigins = append([]string(nil), c.WebOrigins...)
+	return c
+}
@@ -1,14 +1,85 @@
 package db
 
-import "gorm.io/gorm"
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"gorm.io/gorm"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Returned when the DB was migrated by a newer build than this one
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// Migration is one embedded migrations/NNNN_name.sql file
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus is a known migration and when it was applied, if it was
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Columns AutoMigrate added after the first release, a legacy DB may be
+// missing any of them. Frozen, new columns go in a migration.
+var legacyColumns = []struct{ Table, Column, Def string }{
+	{"users", "password_hash", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "is_admin", "NUMERIC NOT NULL DEFAULT false"},
+	{"photos", "captured_at", "DATETIME"},
+	{"photos", "broken", "NUMERIC NOT NULL DEFAULT false"},
+}
+
+// Parses the embedded migrations, ordered by version
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Migration
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || path.Ext(name) != ".sql" {
+			continue
+		}
+		num, label, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), "_")
+		v, err := strconv.Atoi(num)
+		if !ok || err != nil || v <= 0 {
+			return nil, fmt.Errorf("migration %s: want NNNN_name.sql", name)
+		}
+		body, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Migration{Version: v, Name: label, SQL: string(body)})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	for i := range out {
+		if out[i].Version != i+1 {
+			return nil, fmt.Errorf("migration %04d_%s: versions must run 1..N without gaps", out[i].Version, out[i].Name)
+		}
+	}
+	return out, nil
+}
+
+// Brings the schema up to the latest embedded migration
 func Migrate(gdb *gorm.DB) error {
-	if err := gdb.AutoMigrate(
-		&User{},
-		&Photo{},
-		&Album{},
-		&AlbumPhoto{},
-	); err != nil {
+	if err := MigrateTo(gdb, 0); err != nil {
 		return err
 	}
 
@@ -21,3 +92,137 @@ func Migrate(gdb *gorm.DB) error {
 
 	return nil
 }
+
+// Applies pending migrations up to and including target, 0 means all of them.
+// Each migration runs in its own transaction together with its bookkeeping row.
+func MigrateTo(gdb *gorm.DB, target int) error {
+	migs, err := Migrations()
+	if err != nil {
+		return err
+	}
+	latest := len(migs)
+	if target == 0 {
+		target = latest
+	}
+	if target < 0 || target > latest {
+		return fmt.Errorf("no migration %d (latest is %d)", target, latest)
+	}
+
+	if err := ensureMigrationsTable(gdb); err != nil {
+		return err
+	}
+	current, err := SchemaVersion(gdb)
+	if err != nil {
+		return err
+	}
+	if current > latest {
+		return fmt.Errorf("%w: database is at %d, binary knows up to %d", ErrSchemaTooNew, current, latest)
+	}
+	if target < current {
+		return fmt.Errorf("database is at %d, migrating down to %d is not supported", current, target)
+	}
+
+	for _, m := range migs[current:target] {
+		if err := gdb.Transaction(func(tx *gorm.DB) error {
+			if m.Version == 1 {
+				if err := adoptLegacy(tx); err != nil {
+					return err
+				}
+			}
+			if err := tx.Exec(m.SQL).Error; err != nil {
+				return err
+			}
+			return tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+				m.Version, m.Name, time.Now().UTC()).Error
+		}); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// Highest applied migration, 0 for a fresh or pre-migrations database
+func SchemaVersion(gdb *gorm.DB) (int, error) {
+	if err := ensureMigrationsTable(gdb); err != nil {
+		return 0, err
+	}
+	var v int
+	err := gdb.Raw("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&v).Error
+	return v, err
+}
+
+// Lists every embedded migration with its applied time
+func MigrationStatuses(gdb *gorm.DB) ([]MigrationStatus, error) {
+	migs, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(gdb); err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Version   int
+		Name      string
+		AppliedAt time.Time
+	}
+	if err := gdb.Raw("SELECT version, name, applied_at FROM schema_migrations ORDER BY version").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	out := make([]MigrationStatus, 0, len(migs))
+	applied := make(map[int]time.Time, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r.AppliedAt
+		// Applied by a newer binary, still worth showing
+		if r.Version > len(migs) {
+			at := r.AppliedAt
+			out = append(out, MigrationStatus{Version: r.Version, Name: r.Name, AppliedAt: &at})
+		}
+	}
+	for _, m := range migs {
+		s := MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			s.AppliedAt = &at
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+func ensureMigrationsTable(gdb *gorm.DB) error {
+	return gdb.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`).Error
+}
+
+// Databases created by AutoMigrate have the baseline tables but maybe not
+// every column, those are added before the baseline runs
+func adoptLegacy(tx *gorm.DB) error {
+	for _, c := range legacyColumns {
+		var tables int64
+		if err := tx.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", c.Table).
+			Scan(&tables).Error; err != nil {
+			return err
+		}
+		if tables == 0 {
+			continue
+		}
+		var cols int64
+		if err := tx.Raw("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", c.Table, c.Column).
+			Scan(&cols).Error; err != nil {
+			return err
+		}
+		if cols > 0 {
+			continue
+		}
+		if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.Table, c.Column, c.Def)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
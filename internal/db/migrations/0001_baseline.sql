@@ -0,0 +1,102 @@
+-- Schema as it stood when migrations were introduced. Every statement is
+-- IF NOT EXISTS so databases created by the old AutoMigrate can adopt it.
+
+CREATE TABLE IF NOT EXISTS users (
+    id            TEXT PRIMARY KEY,
+    email         TEXT NOT NULL,
+    user_name     TEXT,
+    password_hash TEXT NOT NULL DEFAULT '',
+    is_admin      NUMERIC NOT NULL DEFAULT false,
+    created_at    DATETIME NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users(email);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id           TEXT PRIMARY KEY,
+    user_id      TEXT NOT NULL,
+    created_at   DATETIME NOT NULL,
+    expires_at   DATETIME NOT NULL,
+    last_seen_at DATETIME,
+    CONSTRAINT fk_sessions_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+
+CREATE TABLE IF NOT EXISTS photos (
+    id           TEXT PRIMARY KEY,
+    owner_id     TEXT NOT NULL,
+    title        TEXT NOT NULL,
+    description  TEXT,
+    origin_key   TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    bytes        INTEGER NOT NULL,
+    created_at   DATETIME,
+    captured_at  DATETIME,
+    broken       NUMERIC NOT NULL DEFAULT false,
+    deleted_at   DATETIME,
+    CONSTRAINT fk_users_photos FOREIGN KEY (owner_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_photos_captured_at ON photos(captured_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_photos_origin_key ON photos(origin_key);
+CREATE INDEX IF NOT EXISTS idx_photos_owner_id ON photos(owner_id);
+
+CREATE TABLE IF NOT EXISTS albums (
+    id             TEXT PRIMARY KEY,
+    owner_id       TEXT NOT NULL,
+    title          TEXT NOT NULL,
+    description    TEXT,
+    cover_photo_id TEXT,
+    created_at     DATETIME,
+    updated_at     DATETIME,
+    deleted_at     DATETIME
+);
+CREATE INDEX IF NOT EXISTS idx_albums_created_at ON albums(created_at);
+CREATE INDEX IF NOT EXISTS idx_albums_cover_photo_id ON albums(cover_photo_id);
+CREATE INDEX IF NOT EXISTS idx_albums_owner_id ON albums(owner_id);
+
+CREATE TABLE IF NOT EXISTS album_photos (
+    album_id TEXT,
+    photo_id TEXT,
+    pos      INTEGER DEFAULT 0,
+    added_at DATETIME NOT NULL,
+    PRIMARY KEY (album_id, photo_id),
+    CONSTRAINT fk_album_photos_album FOREIGN KEY (album_id) REFERENCES albums(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_album_photos_photo FOREIGN KEY (photo_id) REFERENCES photos(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_album_photos_added_at ON album_photos(added_at);
+CREATE INDEX IF NOT EXISTS idx_album_photos_pos ON album_photos(pos);
+CREATE INDEX IF NOT EXISTS idx_album_photos_photo_id ON album_photos(photo_id);
+CREATE INDEX IF NOT EXISTS idx_album_photos_album_id ON album_photos(album_id);
+
+CREATE TABLE IF NOT EXISTS photo_variants (
+    photo_id     TEXT,
+    variant      TEXT,
+    key          TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    bytes        INTEGER NOT NULL DEFAULT 0,
+    width        INTEGER NOT NULL DEFAULT 0,
+    height       INTEGER NOT NULL DEFAULT 0,
+    status       TEXT NOT NULL,
+    created_at   DATETIME,
+    updated_at   DATETIME,
+    PRIMARY KEY (photo_id, variant),
+    CONSTRAINT fk_photo_variants_photo FOREIGN KEY (photo_id) REFERENCES photos(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_photo_variants_status ON photo_variants(status);
+
+CREATE TABLE IF NOT EXISTS photo_exif (
+    photo_id      TEXT PRIMARY KEY,
+    taken_at      DATETIME,
+    camera_make   TEXT,
+    camera_model  TEXT,
+    lens_model    TEXT,
+    exposure_time TEXT,
+    f_number      REAL,
+    iso           INTEGER,
+    focal_length  REAL,
+    width         INTEGER,
+    height        INTEGER,
+    orientation   INTEGER,
+    CONSTRAINT fk_photos_exif FOREIGN KEY (photo_id) REFERENCES photos(id)
+);
+CREATE INDEX IF NOT EXISTS idx_photo_exif_taken_at ON photo_exif(taken_at);
@@ -0,0 +1,5 @@
+-- Rows from before EXIF support sort by upload time
+UPDATE photos SET captured_at = created_at WHERE captured_at IS NULL;
+
+-- The primary key (album_id, photo_id) already covers lookups by album
+DROP INDEX IF EXISTS idx_album_photos_album_id;
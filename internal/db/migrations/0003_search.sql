@@ -0,0 +1,54 @@
+-- Full-text indexes over titles and descriptions, kept in sync by triggers.
+-- Standalone tables keyed by id since rowids of TEXT keyed tables can change on VACUUM.
+
+CREATE VIRTUAL TABLE photos_fts USING fts5(
+    title,
+    description,
+    photo_id UNINDEXED,
+    tokenize = 'unicode61 remove_diacritics 2',
+    prefix = '2 3'
+);
+
+CREATE VIRTUAL TABLE albums_fts USING fts5(
+    title,
+    description,
+    album_id UNINDEXED,
+    tokenize = 'unicode61 remove_diacritics 2',
+    prefix = '2 3'
+);
+
+INSERT INTO photos_fts (title, description, photo_id)
+SELECT title, COALESCE(description, ''), id FROM photos;
+
+INSERT INTO albums_fts (title, description, album_id)
+SELECT title, COALESCE(description, ''), id FROM albums;
+
+CREATE TRIGGER photos_fts_insert AFTER INSERT ON photos BEGIN
+    INSERT INTO photos_fts (title, description, photo_id)
+    VALUES (new.title, COALESCE(new.description, ''), new.id);
+END;
+
+CREATE TRIGGER photos_fts_update AFTER UPDATE OF title, description ON photos BEGIN
+    DELETE FROM photos_fts WHERE photo_id = old.id;
+    INSERT INTO photos_fts (title, description, photo_id)
+    VALUES (new.title, COALESCE(new.description, ''), new.id);
+END;
+
+CREATE TRIGGER photos_fts_delete AFTER DELETE ON photos BEGIN
+    DELETE FROM photos_fts WHERE photo_id = old.id;
+END;
+
+CREATE TRIGGER albums_fts_insert AFTER INSERT ON albums BEGIN
+    INSERT INTO albums_fts (title, description, album_id)
+    VALUES (new.title, COALESCE(new.description, ''), new.id);
+END;
+
+CREATE TRIGGER albums_fts_update AFTER UPDATE OF title, description ON albums BEGIN
+    DELETE FROM albums_fts WHERE album_id = old.id;
+    INSERT INTO albums_fts (title, description, album_id)
+    VALUES (new.title, COALESCE(new.description, ''), new.id);
+END;
+
+CREATE TRIGGER albums_fts_delete AFTER DELETE ON albums BEGIN
+    DELETE FROM albums_fts WHERE album_id = old.id;
+END;
@@ -0,0 +1,19 @@
+-- Per-user tags, names are stored normalized (trimmed, lower case)
+CREATE TABLE tags (
+    id         TEXT PRIMARY KEY,
+    owner_id   TEXT NOT NULL,
+    name       TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    CONSTRAINT fk_tags_owner FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX idx_tags_owner_name ON tags(owner_id, name);
+
+CREATE TABLE photo_tags (
+    photo_id   TEXT NOT NULL,
+    tag_id     TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (photo_id, tag_id),
+    CONSTRAINT fk_photo_tags_photo FOREIGN KEY (photo_id) REFERENCES photos(id) ON DELETE CASCADE,
+    CONSTRAINT fk_photo_tags_tag FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+CREATE INDEX idx_photo_tags_tag_id ON photo_tags(tag_id);
@@ -0,0 +1,29 @@
+-- Public links to an album. Only the SHA-256 of the token is stored.
+CREATE TABLE album_shares (
+    id             TEXT PRIMARY KEY,
+    album_id       TEXT NOT NULL,
+    owner_id       TEXT NOT NULL,
+    token_hash     TEXT NOT NULL,
+    password_hash  TEXT NOT NULL DEFAULT '',
+    allow_download NUMERIC NOT NULL DEFAULT false,
+    expires_at     DATETIME,
+    revoked_at     DATETIME,
+    created_at     DATETIME NOT NULL,
+    access_count   INTEGER NOT NULL DEFAULT 0,
+    last_access_at DATETIME,
+    CONSTRAINT fk_album_shares_album FOREIGN KEY (album_id) REFERENCES albums(id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX idx_album_shares_token_hash ON album_shares(token_hash);
+CREATE INDEX idx_album_shares_album_id ON album_shares(album_id);
+
+-- One row per request made with a share token, allowed or not
+CREATE TABLE share_access_log (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    share_id   TEXT NOT NULL,
+    at         DATETIME NOT NULL,
+    status     INTEGER NOT NULL,
+    remote_ip  TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    CONSTRAINT fk_share_access_log_share FOREIGN KEY (share_id) REFERENCES album_shares(id) ON DELETE CASCADE
+);
+CREATE INDEX idx_share_access_log_share_at ON share_access_log(share_id, at);
@@ -0,0 +1,17 @@
+-- How an album's photos are listed: manual, added, captured or title
+ALTER TABLE albums ADD COLUMN sort_mode TEXT NOT NULL DEFAULT 'added';
+
+-- Photos added after creation all got pos 0, give every album a dense order
+-- that keeps what create set and puts later additions after it
+UPDATE album_photos SET pos = (
+    SELECT x.rn FROM (
+        SELECT album_id, photo_id,
+            ROW_NUMBER() OVER (PARTITION BY album_id ORDER BY pos, added_at, photo_id) - 1 AS rn
+        FROM album_photos
+    ) x
+    WHERE x.album_id = album_photos.album_id AND x.photo_id = album_photos.photo_id
+);
+
+-- Manual order is always read per album
+DROP INDEX IF EXISTS idx_album_photos_pos;
+CREATE INDEX idx_album_photos_album_pos ON album_photos(album_id, pos);
@@ -0,0 +1,6 @@
+-- Content hash of the original, set at confirm or by the backfill worker
+ALTER TABLE photos ADD COLUMN sha256 TEXT NOT NULL DEFAULT '';
+-- 64-bit difference hash of the image for near-duplicates, NULL until computed
+ALTER TABLE photos ADD COLUMN dhash INTEGER;
+
+CREATE INDEX idx_photos_owner_sha256 ON photos(owner_id, sha256);
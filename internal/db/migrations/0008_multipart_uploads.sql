@@ -0,0 +1,13 @@
+-- Chunked uploads that were started and not yet completed or aborted
+CREATE TABLE multipart_uploads (
+    id           TEXT PRIMARY KEY,
+    owner_id     TEXT NOT NULL,
+    object_key   TEXT NOT NULL,
+    upload_id    TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    bytes        INTEGER NOT NULL DEFAULT 0,
+    created_at   DATETIME NOT NULL,
+    CONSTRAINT fk_multipart_uploads_owner FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX idx_multipart_uploads_object_key ON multipart_uploads(object_key);
+CREATE INDEX idx_multipart_uploads_created_at ON multipart_uploads(created_at);
@@ -0,0 +1,2 @@
+-- Per-user storage limit in bytes set by an admin, NULL uses the server default
+ALTER TABLE users ADD COLUMN quota_bytes INTEGER;
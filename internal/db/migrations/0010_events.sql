@@ -0,0 +1,11 @@
+-- Change log behind GET /events, clients resume from the last id they saw
+CREATE TABLE events (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    owner_id   TEXT NOT NULL,
+    type       TEXT NOT NULL,
+    subject_id TEXT NOT NULL DEFAULT '',
+    data       TEXT NOT NULL DEFAULT '{}',
+    created_at DATETIME NOT NULL
+);
+CREATE INDEX idx_events_owner_id ON events(owner_id, id);
+CREATE INDEX idx_events_created_at ON events(created_at);
@@ -0,0 +1,32 @@
+-- URLs a user wants events POSTed to. event_types is comma separated, empty for all.
+CREATE TABLE webhooks (
+    id          TEXT PRIMARY KEY,
+    owner_id    TEXT NOT NULL,
+    url         TEXT NOT NULL,
+    secret      TEXT NOT NULL,
+    event_types TEXT NOT NULL DEFAULT '',
+    active      NUMERIC NOT NULL DEFAULT true,
+    created_at  DATETIME NOT NULL,
+    updated_at  DATETIME NOT NULL,
+    CONSTRAINT fk_webhooks_owner FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX idx_webhooks_owner_id ON webhooks(owner_id);
+
+-- One event for one webhook, queued with the event and retried until it succeeds or gives up
+CREATE TABLE webhook_deliveries (
+    id              TEXT PRIMARY KEY,
+    webhook_id      TEXT NOT NULL,
+    event_id        INTEGER,
+    event_type      TEXT NOT NULL,
+    payload         TEXT NOT NULL,
+    status          TEXT NOT NULL DEFAULT 'pending',
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME,
+    last_attempt_at DATETIME,
+    response_status INTEGER NOT NULL DEFAULT 0,
+    last_error      TEXT NOT NULL DEFAULT '',
+    created_at      DATETIME NOT NULL,
+    CONSTRAINT fk_webhook_deliveries_webhook FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+);
+CREATE INDEX idx_webhook_deliveries_webhook_created ON webhook_deliveries(webhook_id, created_at);
+CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
@@ -0,0 +1,9 @@
+-- Keys handed out for direct-to-store uploads and who they were handed to.
+-- Only that user can confirm the key.
+CREATE TABLE upload_keys (
+    key        TEXT PRIMARY KEY,
+    owner_id   TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    CONSTRAINT fk_upload_keys_owner FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX idx_upload_keys_created_at ON upload_keys(created_at);
@@ -6,15 +6,33 @@ import (
 	"gorm.io/gorm"
 )
 
+// The schema lives in migrations/, tags here only describe it to gorm.
+// A new column needs a migration as well as a field.
+
 type User struct {
-	ID        string    `gorm:"primaryKey;type:text"`
-	Email     string    `gorm:"uniqueIndex;not null"`
-	UserName  string    `gorm:"type:text"`
-	CreatedAt time.Time `gorm:"not null"`
+	ID           string    `gorm:"primaryKey;type:text"`
+	Email        string    `gorm:"uniqueIndex;not null"`
+	UserName     string    `gorm:"type:text"`
+	PasswordHash string    `gorm:"type:text;not null;default:''"`
+	IsAdmin      bool      `gorm:"not null;default:false"`
+	CreatedAt    time.Time `gorm:"not null"`
+	// Storage limit in bytes, nil for the server default (0 is unlimited)
+	QuotaBytes *int64
 
 	Photos []Photo `gorm:"foreignKey:OwnerID"`
 }
 
+// Session is a server side login, ID is the SHA-256 of the cookie token
+type Session struct {
+	ID         string    `gorm:"primaryKey;type:text"`
+	UserID     string    `gorm:"index;not null"`
+	CreatedAt  time.Time `gorm:"not null"`
+	ExpiresAt  time.Time `gorm:"index;not null"`
+	LastSeenAt time.Time
+
+	User User `gorm:"constraint:OnDelete:CASCADE;foreignKey:UserID;references:ID"`
+}
+
 type Photo struct {
 	ID          string `gorm:"primaryKey;type:text"`
 	OwnerID     string `gorm:"index;not null"`
@@ -24,18 +42,46 @@ type Photo struct {
 	ContentType string `gorm:"not null"`
 	Bytes       int64  `gorm:"not null"`
 	CreatedAt   time.Time
-	DeletedAt   gorm.DeletedAt
+	// When the photo was taken, EXIF DateTimeOriginal or CreatedAt when missing
+	CapturedAt time.Time `gorm:"index"`
+	// Set by fsck when the blob is missing or doesn't match the row
+	Broken bool `gorm:"not null;default:false"`
+	// Hex SHA-256 of the original, empty until hashed
+	SHA256 string `gorm:"column:sha256;not null;default:''"`
+	// Difference hash for near-duplicate search, nil for videos and until computed
+	DHash     *int64 `gorm:"column:dhash"`
+	DeletedAt gorm.DeletedAt
+
+	Owner  User       `gorm:"constraint:OnDelete:CASCADE;foreignKey:OwnerID;references:ID"`
+	Albums []Album    `gorm:"many2many:album_photos"`
+	Exif   *PhotoExif `gorm:"foreignKey:PhotoID;references:ID"`
+}
 
-	Owner  User    `gorm:"constraint:OnDelete:CASCADE;foreignKey:OwnerID;references:ID"`
-	Albums []Album `gorm:"many2many:album_photos"`
+// PhotoExif is the camera metadata read from the object at confirm time
+type PhotoExif struct {
+	PhotoID      string     `gorm:"primaryKey;type:text"`
+	TakenAt      *time.Time `gorm:"index"`
+	CameraMake   string     `gorm:"type:text"`
+	CameraModel  string     `gorm:"type:text"`
+	LensModel    string     `gorm:"type:text"`
+	ExposureTime string     `gorm:"type:text"`
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	Width        int
+	Height       int
+	Orientation  int
 }
 
+func (PhotoExif) TableName() string { return "photo_exif" }
+
 type Album struct {
 	ID           string    `gorm:"primaryKey;type:text"`
 	OwnerID      string    `gorm:"index;not null"`
 	Title        string    `gorm:"type:text;not null"`
 	Description  string    `gorm:"type:text"`
 	CoverPhotoID *string   `gorm:"index"`
+	SortMode     string    `gorm:"type:text;not null;default:'added'"`
 	CreatedAt    time.Time `gorm:"index"`
 	UpdatedAt    time.Time
 	DeletedAt    gorm.DeletedAt
@@ -45,10 +91,19 @@ type Album struct {
 	Photos []Photo `gorm:"many2many:album_photos"`
 }
 
+// Album sort modes
+const (
+	AlbumSortManual   = "manual"
+	AlbumSortAdded    = "added"
+	AlbumSortCaptured = "captured"
+	AlbumSortTitle    = "title"
+)
+
 type AlbumPhoto struct {
-	AlbumID string    `gorm:"primaryKey;type:text;index"`
-	PhotoID string    `gorm:"primaryKey;type:text;index"`
-	Pos     int       `gorm:"default:0;index"`
+	AlbumID string `gorm:"primaryKey;type:text"`
+	PhotoID string `gorm:"primaryKey;type:text;index"`
+	// Place in the manual order, ascending
+	Pos     int       `gorm:"default:0"`
 	AddedAt time.Time `gorm:"not null;index"`
 
 	Album Album `gorm:"constraint:OnDelete:CASCADE,OnUpdate:CASCADE;foreignKey:AlbumID;references:ID"`
@@ -56,3 +111,138 @@ type AlbumPhoto struct {
 }
 
 func (AlbumPhoto) TableName() string { return "album_photos" }
+
+// Variant status values
+const (
+	VariantPending = "pending"
+	VariantReady   = "ready"
+	VariantFailed  = "failed"
+)
+
+// PhotoVariant is a server generated rendition (thumb, preview) of a photo
+type PhotoVariant struct {
+	PhotoID     string `gorm:"primaryKey;type:text"`
+	Variant     string `gorm:"primaryKey;type:text"`
+	Key         string `gorm:"not null"`
+	ContentType string `gorm:"not null"`
+	Bytes       int64  `gorm:"not null;default:0"`
+	Width       int    `gorm:"not null;default:0"`
+	Height      int    `gorm:"not null;default:0"`
+	Status      string `gorm:"not null;index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+
+	Photo Photo `gorm:"constraint:OnDelete:CASCADE;foreignKey:PhotoID;references:ID"`
+}
+
+// Tag is a user's label, Name is normalized so "Beach" and "beach " are one tag
+type Tag struct {
+	ID        string    `gorm:"primaryKey;type:text"`
+	OwnerID   string    `gorm:"not null;uniqueIndex:idx_tags_owner_name"`
+	Name      string    `gorm:"not null;uniqueIndex:idx_tags_owner_name"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+type PhotoTag struct {
+	PhotoID   string    `gorm:"primaryKey;type:text"`
+	TagID     string    `gorm:"primaryKey;type:text;index"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// AlbumShare is a public link to an album, TokenHash is the SHA-256 of the link token
+type AlbumShare struct {
+	ID            string `gorm:"primaryKey;type:text"`
+	AlbumID       string `gorm:"index;not null"`
+	OwnerID       string `gorm:"not null"`
+	TokenHash     string `gorm:"uniqueIndex;not null"`
+	PasswordHash  string `gorm:"not null;default:''"`
+	AllowDownload bool   `gorm:"not null;default:false"`
+	ExpiresAt     *time.Time
+	RevokedAt     *time.Time
+	CreatedAt     time.Time `gorm:"not null"`
+	AccessCount   int64     `gorm:"not null;default:0"`
+	LastAccessAt  *time.Time
+
+	Album Album `gorm:"constraint:OnDelete:CASCADE;foreignKey:AlbumID;references:ID"`
+}
+
+type ShareAccess struct {
+	ID        int64     `gorm:"primaryKey;autoIncrement"`
+	ShareID   string    `gorm:"not null"`
+	At        time.Time `gorm:"not null"`
+	Status    int       `gorm:"not null"`
+	RemoteIP  string    `gorm:"not null;default:''"`
+	UserAgent string    `gorm:"not null;default:''"`
+}
+
+func (ShareAccess) TableName() string { return "share_access_log" }
+
+// UploadKey is an object key presigned for (or a multipart upload started
+// by) OwnerID, confirm only accepts keys issued to the caller
+type UploadKey struct {
+	Key       string    `gorm:"primaryKey;type:text"`
+	OwnerID   string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null;index"`
+}
+
+// MultipartUpload is a chunked upload in progress. UploadID is the store's
+// handle for it, ID is what clients use.
+type MultipartUpload struct {
+	ID          string `gorm:"primaryKey;type:text"`
+	OwnerID     string `gorm:"not null"`
+	ObjectKey   string `gorm:"uniqueIndex;not null"`
+	UploadID    string `gorm:"not null"`
+	ContentType string `gorm:"not null"`
+	// Size the client announced, 0 when unknown
+	Bytes     int64     `gorm:"not null;default:0"`
+	CreatedAt time.Time `gorm:"not null;index"`
+}
+
+// Event is one change to a user's library. IDs only grow, so a client that
+// saw ID n has seen everything before it.
+type Event struct {
+	ID        int64  `gorm:"primaryKey;autoIncrement"`
+	OwnerID   string `gorm:"not null"`
+	Type      string `gorm:"not null"`
+	SubjectID string `gorm:"not null;default:''"`
+	// JSON
+	Data      string    `gorm:"not null;default:'{}'"`
+	CreatedAt time.Time `gorm:"not null;index"`
+}
+
+// Webhook is a URL events are POSTed to, signed with Secret
+type Webhook struct {
+	ID      string `gorm:"primaryKey;type:text"`
+	OwnerID string `gorm:"index;not null"`
+	URL     string `gorm:"not null"`
+	Secret  string `gorm:"not null"`
+	// Comma separated types or kinds, empty for every event
+	EventTypes string    `gorm:"not null;default:''"`
+	Active     bool      `gorm:"not null;default:true"`
+	CreatedAt  time.Time `gorm:"not null"`
+	UpdatedAt  time.Time `gorm:"not null"`
+}
+
+// Delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is one event for one webhook. Payload is the exact body
+// sent on every attempt. EventID is nil for test events.
+type WebhookDelivery struct {
+	ID             string `gorm:"primaryKey;type:text"`
+	WebhookID      string `gorm:"not null"`
+	EventID        *int64
+	EventType      string `gorm:"not null"`
+	Payload        string `gorm:"not null"`
+	Status         string `gorm:"not null;default:'pending'"`
+	Attempts       int    `gorm:"not null;default:0"`
+	NextAttemptAt  *time.Time
+	LastAttemptAt  *time.Time
+	ResponseStatus int       `gorm:"not null;default:0"`
+	LastError      string    `gorm:"not null;default:''"`
+	CreatedAt      time.Time `gorm:"not null"`
+}
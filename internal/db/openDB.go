@@ -45,3 +45,16 @@ func OpenDB(path string) (*gorm.DB, error) {
 	log.Printf("sqlite open: %s", path)
 	return gdb, nil
 }
+
+// Folds the WAL back into the main file and closes the pool, so the
+// database is a single consistent file once the process exits
+func CloseDB(gdb *gorm.DB) error {
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		return err
+	}
+	if err := gdb.Exec("PRAGMA wal_checkpoint(TRUNCATE)").Error; err != nil {
+		log.Printf("sqlite checkpoint: %v", err)
+	}
+	return sqlDB.Close()
+}
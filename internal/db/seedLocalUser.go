@@ -5,8 +5,39 @@ import (
 	"gorm.io/gorm/clause"
 )
 
+// Owner of everything uploaded before accounts existed
+const LocalUserID = "local_user"
+
+// Creates the placeholder local_user until a real account claims its data
 func SeedLocalUser(gdb *gorm.DB) error {
-	u := User{ID: "local_user", Email: "local@example.com", UserName: "LocalUser"}
+	n, err := CountAccounts(gdb)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	u := User{ID: LocalUserID, Email: "local@example.com", UserName: "LocalUser"}
 	// safe if exists already
 	return gdb.Clauses(clause.OnConflict{DoNothing: true}).Create(&u).Error
 }
+
+// Counts users that can log in
+func CountAccounts(gdb *gorm.DB) (int64, error) {
+	var n int64
+	err := gdb.Model(&User{}).Where("password_hash <> ''").Count(&n).Error
+	return n, err
+}
+
+// Moves local_user's photos and albums to userID and removes the placeholder.
+// Runs inside the transaction that creates the first admin.
+func ClaimLocalData(tx *gorm.DB, userID string) error {
+	for _, table := range []string{"photos", "albums"} {
+		if err := tx.Table(table).
+			Where("owner_id = ?", LocalUserID).
+			Update("owner_id", userID).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Where("id = ?", LocalUserID).Delete(&User{}).Error
+}
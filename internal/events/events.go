@@ -0,0 +1,283 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"gorm.io/gorm"
+)
+
+// Event types. Data is the resource as the API returns it for created and
+// updated, otherwise just the IDs involved.
+const (
+	PhotoCreated   = "photo.created"
+	PhotoUpdated   = "photo.updated"
+	PhotoDeleted   = "photo.deleted" // moved to the trash
+	PhotoRestored  = "photo.restored"
+	PhotoPurged    = "photo.purged"
+	PhotosTagged   = "photo.tags_added"
+	PhotosUntagged = "photo.tags_removed"
+
+	AlbumCreated       = "album.created"
+	AlbumUpdated       = "album.updated"
+	AlbumDeleted       = "album.deleted" // moved to the trash
+	AlbumRestored      = "album.restored"
+	AlbumPurged        = "album.purged"
+	AlbumPhotosAdded   = "album.photos_added"
+	AlbumPhotosRemoved = "album.photos_removed"
+	AlbumReordered     = "album.reordered"
+)
+
+// Every event type, in the order above
+var Types = []string{
+	PhotoCreated, PhotoUpdated, PhotoDeleted, PhotoRestored, PhotoPurged, PhotosTagged, PhotosUntagged,
+	AlbumCreated, AlbumUpdated, AlbumDeleted, AlbumRestored, AlbumPurged, AlbumPhotosAdded, AlbumPhotosRemoved, AlbumReordered,
+}
+
+// Reports whether filter names an event type or a whole kind like "photo"
+func Known(filter string) bool {
+	for _, t := range Types {
+		if t == filter || strings.HasPrefix(t, filter+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether typ passes filters, exact types or kinds. No filters pass everything.
+func Match(filters []string, typ string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, f := range filters {
+		if typ == f || strings.HasPrefix(typ, f+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is what subscribers and GET /events see
+type Event struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	SubjectID string          `json:"subject_id,omitempty"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+	OwnerID   string          `json:"-"`
+}
+
+func fromRow(row db.Event) Event {
+	return Event{
+		ID:        row.ID,
+		Type:      row.Type,
+		SubjectID: row.SubjectID,
+		Data:      json.RawMessage(row.Data),
+		CreatedAt: row.CreatedAt,
+		OwnerID:   row.OwnerID,
+	}
+}
+
+// Events a subscriber may fall behind by before it is dropped. A dropped
+// client reconnects with Last-Event-ID and catches up from the log.
+const subscriberBuffer = 256
+
+// Hook is told about every event. Record runs in the transaction that
+// stores it, an error rolls the event back. Committed runs after.
+type Hook interface {
+	Record(tx *gorm.DB, ev Event) error
+	Committed(ev Event)
+}
+
+// Bus fans published events out to the subscribers of the same owner
+type Bus struct {
+	// Held across the insert and the fan-out so subscribers see IDs in order
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	hooks  []Hook
+	closed bool
+}
+
+// Bus the API publishes to
+var Default = NewBus()
+
+func NewBus() *Bus {
+	return &Bus{subs: map[*Subscription]struct{}{}}
+}
+
+// Subscription receives the owner's events until C is closed, either by
+// Close, by the bus shutting down or because the subscriber fell behind
+type Subscription struct {
+	C       <-chan Event
+	ch      chan Event
+	owner   string
+	bus     *Bus
+	dropped bool
+}
+
+// AddHook registers h for every event published after it returns
+func (b *Bus) AddHook(h Hook) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hooks = append(b.hooks, h)
+}
+
+// Publish records the event and hands it to the owner's subscribers.
+// data is marshalled to JSON, nil becomes {}.
+func (b *Bus) Publish(ctx context.Context, gdb *gorm.DB, owner, typ, subject string, data any) (Event, error) {
+	raw := []byte("{}")
+	if data != nil {
+		var err error
+		if raw, err = json.Marshal(data); err != nil {
+			return Event{}, err
+		}
+	}
+	row := db.Event{
+		OwnerID:   owner,
+		Type:      typ,
+		SubjectID: subject,
+		Data:      string(raw),
+		CreatedAt: time.Now(),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ev Event
+	if err := gdb.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&row).Error; err != nil {
+			return err
+		}
+		ev = fromRow(row)
+		for _, h := range b.hooks {
+			if err := h.Record(tx, ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return Event{}, err
+	}
+	for _, h := range b.hooks {
+		h.Committed(ev)
+	}
+	for s := range b.subs {
+		if s.owner != owner {
+			continue
+		}
+		select {
+		case s.ch <- ev:
+		default:
+			s.dropped = true
+			b.remove(s)
+		}
+	}
+	return ev, nil
+}
+
+// Subscribe starts receiving owner's events. Events published before it
+// returns are in the log, anything after arrives on C.
+func (b *Bus) Subscribe(owner string) *Subscription {
+	ch := make(chan Event, subscriberBuffer)
+	s := &Subscription{C: ch, ch: ch, owner: owner, bus: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return s
+	}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Close stops the subscription, calling it twice is fine
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.bus.remove(s)
+}
+
+// Dropped reports whether C was closed because the subscriber fell behind
+func (s *Subscription) Dropped() bool {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	return s.dropped
+}
+
+// Needs b.mu
+func (b *Bus) remove(s *Subscription) {
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
+
+// Close ends every subscription so open streams return and the server can
+// shut down. Later subscriptions are closed straight away.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for s := range b.subs {
+		b.remove(s)
+	}
+}
+
+// Since returns up to limit of owner's events after id, oldest first
+func Since(ctx context.Context, gdb *gorm.DB, owner string, id int64, limit int) ([]Event, error) {
+	var rows []db.Event
+	if err := gdb.WithContext(ctx).
+		Where("owner_id = ? AND id > ?", owner, id).
+		Order("id").Limit(limit).
+		Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]Event, 0, len(rows))
+	for _, row := range rows {
+		out = append(out, fromRow(row))
+	}
+	return out, nil
+}
+
+// Oldest returns the lowest ID still in the log, 0 when it is empty.
+// A client whose last ID is below it may have missed pruned events.
+func Oldest(ctx context.Context, gdb *gorm.DB) (int64, error) {
+	var id int64
+	err := gdb.WithContext(ctx).Model(&db.Event{}).
+		Select("COALESCE(MIN(id), 0)").Scan(&id).Error
+	return id, err
+}
+
+// Prune deletes events older than cutoff, returns how many were removed
+func Prune(ctx context.Context, gdb *gorm.DB, cutoff time.Time) (int64, error) {
+	res := gdb.WithContext(ctx).Where("created_at < ?", cutoff).Delete(&db.Event{})
+	return res.RowsAffected, res.Error
+}
+
+// Runs Prune every interval until ctx is cancelled
+func RunPruner(ctx context.Context, gdb *gorm.DB, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := Prune(ctx, gdb, time.Now().Add(-retention))
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("events: prune: %v", err)
+			}
+		} else if n > 0 {
+			log.Printf("events: pruned %d events older than %s", n, retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
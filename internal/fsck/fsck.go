@@ -0,0 +1,314 @@
+package fsck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/media"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Orphans younger than this are left alone, they may be uploads that are still being confirmed
+const DefaultOrphanAge = 24 * time.Hour
+
+// Issue kinds
+const (
+	KindOrphan              = "orphan_object"
+	KindMissingBlob         = "missing_blob"
+	KindSizeMismatch        = "size_mismatch"
+	KindContentTypeMismatch = "content_type_mismatch"
+	KindMissingVariant      = "missing_variant"
+	KindDanglingAlbumPhoto  = "dangling_album_photo"
+	KindDanglingCover       = "dangling_cover"
+)
+
+type Options struct {
+	// Fix what can be fixed instead of only reporting it
+	Repair bool
+	// Only orphans last modified before now-OrphanAge are deleted on repair
+	OrphanAge time.Duration
+	// Keys under these prefixes aren't photos (e.g. database backups) and are skipped
+	SkipPrefixes []string
+}
+
+type Issue struct {
+	Kind     string `json:"kind"`
+	Key      string `json:"key,omitempty"`
+	PhotoID  string `json:"photo_id,omitempty"`
+	AlbumID  string `json:"album_id,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+type Report struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Repair     bool      `json:"repair"`
+	Objects    int       `json:"objects"`
+	Photos     int       `json:"photos"`
+	Variants   int       `json:"variants"`
+	Issues     []Issue   `json:"issues"`
+	Repaired   int       `json:"repaired"`
+	// Rows that were marked broken earlier and check out now
+	Unbroken int `json:"unbroken"`
+}
+
+func (r *Report) add(is Issue) {
+	if is.Repaired {
+		r.Repaired++
+	}
+	r.Issues = append(r.Issues, is)
+}
+
+// Diffs the photos bucket against the database. Trashed photos count as
+// referenced since their blobs are needed for restore.
+func Run(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, opts Options) (Report, error) {
+	if opts.OrphanAge <= 0 {
+		opts.OrphanAge = DefaultOrphanAge
+	}
+	rep := Report{StartedAt: time.Now().UTC(), Repair: opts.Repair, Issues: []Issue{}}
+	bucket := store.PhotosBucket()
+
+	objects := map[string]storage.ObjectInfo{}
+	if err := store.ListObjects(ctx, bucket, "", func(o storage.ObjectInfo) error {
+		for _, p := range opts.SkipPrefixes {
+			if strings.HasPrefix(o.Key, p) {
+				return nil
+			}
+		}
+		objects[o.Key] = o
+		return nil
+	}); err != nil {
+		return rep, fmt.Errorf("list bucket: %w", err)
+	}
+	rep.Objects = len(objects)
+
+	referenced := make(map[string]bool, len(objects))
+
+	if err := checkPhotos(ctx, gdb, store, objects, referenced, opts, &rep); err != nil {
+		return rep, err
+	}
+	if err := checkVariants(ctx, gdb, objects, referenced, opts, &rep); err != nil {
+		return rep, err
+	}
+
+	// Whatever is left in the bucket isn't pointed at by any row
+	cutoff := time.Now().Add(-opts.OrphanAge)
+	keys := make([]string, 0, len(objects))
+	for k := range objects {
+		if !referenced[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o := objects[k]
+		is := Issue{Kind: KindOrphan, Key: k, Detail: fmt.Sprintf("%d bytes, modified %s", o.Size, o.LastModified.UTC().Format(time.RFC3339))}
+		if opts.Repair && o.LastModified.Before(cutoff) {
+			if err := store.DeleteObject(ctx, bucket, k); err != nil && !storage.IsNotFound(err) {
+				is.Detail += ", delete failed: " + err.Error()
+			} else {
+				is.Repaired = true
+			}
+		}
+		rep.add(is)
+	}
+
+	if err := checkAlbums(ctx, gdb, opts, &rep); err != nil {
+		return rep, err
+	}
+
+	rep.FinishedAt = time.Now().UTC()
+	return rep, nil
+}
+
+// Every photo row must have its original, with the size and type recorded at confirm
+func checkPhotos(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, objects map[string]storage.ObjectInfo, referenced map[string]bool, opts Options, rep *Report) error {
+	var photos []db.Photo
+	if err := gdb.WithContext(ctx).Unscoped().Order("id").Find(&photos).Error; err != nil {
+		return fmt.Errorf("load photos: %w", err)
+	}
+	rep.Photos = len(photos)
+
+	for _, p := range photos {
+		referenced[p.OriginKey] = true
+
+		var problems []Issue
+		o, ok := objects[p.OriginKey]
+		if !ok {
+			problems = append(problems, Issue{Kind: KindMissingBlob, Key: p.OriginKey, PhotoID: p.ID})
+		} else {
+			if o.Size != p.Bytes {
+				problems = append(problems, Issue{
+					Kind: KindSizeMismatch, Key: p.OriginKey, PhotoID: p.ID,
+					Detail: fmt.Sprintf("row %d bytes, object %d bytes", p.Bytes, o.Size),
+				})
+			}
+			ct, err := sniffObject(ctx, store, p.OriginKey)
+			if err != nil && !storage.IsNotFound(err) {
+				return fmt.Errorf("read %s: %w", p.OriginKey, err)
+			}
+			if ct != "" && ct != p.ContentType {
+				problems = append(problems, Issue{
+					Kind: KindContentTypeMismatch, Key: p.OriginKey, PhotoID: p.ID,
+					Detail: fmt.Sprintf("row %s, object %s", p.ContentType, ct),
+				})
+			}
+		}
+
+		if !opts.Repair {
+			for _, is := range problems {
+				rep.add(is)
+			}
+			continue
+		}
+
+		// Repair can't bring a blob back, it flags the row so clients can hide it
+		broken := len(problems) > 0
+		if broken != p.Broken {
+			if err := gdb.WithContext(ctx).Model(&db.Photo{}).Unscoped().
+				Where("id = ?", p.ID).
+				Update("broken", broken).Error; err != nil {
+				return fmt.Errorf("mark photo %s: %w", p.ID, err)
+			}
+			if !broken {
+				rep.Unbroken++
+			}
+		}
+		for _, is := range problems {
+			is.Repaired = true
+			rep.add(is)
+		}
+	}
+	return nil
+}
+
+// Ready variants must have their object, anything else under variants/ needs a row
+func checkVariants(ctx context.Context, gdb *gorm.DB, objects map[string]storage.ObjectInfo, referenced map[string]bool, opts Options, rep *Report) error {
+	var variants []db.PhotoVariant
+	if err := gdb.WithContext(ctx).Order("photo_id, variant").Find(&variants).Error; err != nil {
+		return fmt.Errorf("load variants: %w", err)
+	}
+	rep.Variants = len(variants)
+
+	for _, v := range variants {
+		if v.Key == "" {
+			continue
+		}
+		referenced[v.Key] = true
+		if v.Status != db.VariantReady {
+			continue
+		}
+		if _, ok := objects[v.Key]; ok {
+			continue
+		}
+
+		is := Issue{Kind: KindMissingVariant, Key: v.Key, PhotoID: v.PhotoID, Detail: v.Variant}
+		// Dropping the row makes the URL endpoint fall back to the original
+		if opts.Repair {
+			if err := gdb.WithContext(ctx).
+				Where("photo_id = ? AND variant = ?", v.PhotoID, v.Variant).
+				Delete(&db.PhotoVariant{}).Error; err != nil {
+				return fmt.Errorf("drop variant %s/%s: %w", v.PhotoID, v.Variant, err)
+			}
+			is.Repaired = true
+		}
+		rep.add(is)
+	}
+	return nil
+}
+
+// Finds album_photos rows and covers pointing at photos or albums that no longer exist
+func checkAlbums(ctx context.Context, gdb *gorm.DB, opts Options, rep *Report) error {
+	type link struct {
+		AlbumID string
+		PhotoID string
+	}
+
+	var dangling []link
+	if err := gdb.WithContext(ctx).Raw(`
+		SELECT ap.album_id, ap.photo_id
+		FROM album_photos ap
+		LEFT JOIN albums a ON a.id = ap.album_id
+		LEFT JOIN photos p ON p.id = ap.photo_id
+		WHERE a.id IS NULL OR p.id IS NULL
+		ORDER BY ap.album_id, ap.photo_id`).Scan(&dangling).Error; err != nil {
+		return fmt.Errorf("check album_photos: %w", err)
+	}
+	for _, l := range dangling {
+		is := Issue{Kind: KindDanglingAlbumPhoto, AlbumID: l.AlbumID, PhotoID: l.PhotoID}
+		if opts.Repair {
+			if err := gdb.WithContext(ctx).
+				Where("album_id = ? AND photo_id = ?", l.AlbumID, l.PhotoID).
+				Delete(&db.AlbumPhoto{}).Error; err != nil {
+				return fmt.Errorf("drop album_photo: %w", err)
+			}
+			is.Repaired = true
+		}
+		rep.add(is)
+	}
+
+	var covers []link
+	if err := gdb.WithContext(ctx).Raw(`
+		SELECT a.id AS album_id, a.cover_photo_id AS photo_id
+		FROM albums a
+		LEFT JOIN photos p ON p.id = a.cover_photo_id
+		WHERE a.cover_photo_id IS NOT NULL AND p.id IS NULL
+		ORDER BY a.id`).Scan(&covers).Error; err != nil {
+		return fmt.Errorf("check covers: %w", err)
+	}
+	for _, l := range covers {
+		is := Issue{Kind: KindDanglingCover, AlbumID: l.AlbumID, PhotoID: l.PhotoID}
+		if opts.Repair {
+			if err := gdb.WithContext(ctx).Model(&db.Album{}).Unscoped().
+				Where("id = ?", l.AlbumID).
+				Update("cover_photo_id", nil).Error; err != nil {
+				return fmt.Errorf("clear cover: %w", err)
+			}
+			is.Repaired = true
+		}
+		rep.add(is)
+	}
+	return nil
+}
+
+// Reads just enough of the object to sniff its real type
+func sniffObject(ctx context.Context, store storage.ObjectStore, key string) (string, error) {
+	rc, err := store.GetObjectRange(ctx, store.PhotosBucket(), key, 0, media.SniffBytes)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	head, err := io.ReadAll(io.LimitReader(rc, media.SniffBytes))
+	if err != nil {
+		return "", err
+	}
+	if len(head) == 0 {
+		return "", nil
+	}
+	return media.Sniff(head), nil
+}
+
+// One line summary for logs and the CLI
+func (r Report) Summary() string {
+	counts := map[string]int{}
+	for _, is := range r.Issues {
+		counts[is.Kind]++
+	}
+	kinds := make([]string, 0, len(counts))
+	for k, n := range counts {
+		kinds = append(kinds, fmt.Sprintf("%s=%d", k, n))
+	}
+	sort.Strings(kinds)
+	if len(kinds) == 0 {
+		kinds = append(kinds, "clean")
+	}
+	return fmt.Sprintf("%d objects, %d photos, %d variants: %s (repaired %d)",
+		r.Objects, r.Photos, r.Variants, strings.Join(kinds, " "), r.Repaired)
+}
@@ -0,0 +1,37 @@
+package media
+
+import (
+	"image"
+	"math/bits"
+
+	"golang.org/x/image/draw"
+)
+
+// Difference hash: the image is shrunk to 9x8 grey pixels and each bit says
+// whether a pixel is brighter than its right neighbour. Re-encodes, resizes
+// and small edits change only a few bits.
+func DHash(src image.Image, orientation int) uint64 {
+	// Orient a small copy so rotated duplicates hash the same
+	small := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), src, src.Bounds(), draw.Src, nil)
+	upright := Orient(small, orientation)
+
+	grey := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.ApproxBiLinear.Scale(grey, grey.Bounds(), upright, upright.Bounds(), draw.Src, nil)
+
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if grey.GrayAt(x, y).Y > grey.GrayAt(x+1, y).Y {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// Number of differing bits, 0 for identical images
+func Hamming(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,110 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// How much of the object is fetched to find EXIF, APP1 segments are capped at 64KB
+// but some cameras put other segments in front of it
+const ExifHeadBytes = 256 << 10
+
+// Exif holds the camera metadata we keep per photo. Zero values mean the tag was missing.
+type Exif struct {
+	TakenAt      *time.Time
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	Width        int
+	Height       int
+	Orientation  int
+}
+
+// Parses EXIF from the first bytes of an image.
+// Dimensions fall back to the image header when the tags are absent.
+func ReadExif(head []byte) (Exif, error) {
+	var out Exif
+
+	x, err := exif.Decode(bytes.NewReader(head))
+	if err != nil {
+		// Still try to get dimensions for images without EXIF (PNG, stripped JPEG)
+		if cfg, _, cerr := image.DecodeConfig(bytes.NewReader(head)); cerr == nil {
+			out.Width, out.Height = cfg.Width, cfg.Height
+			return out, nil
+		}
+		return out, err
+	}
+
+	if t, err := x.DateTime(); err == nil && !t.IsZero() {
+		out.TakenAt = &t
+	}
+	out.CameraMake = tagString(x, exif.Make)
+	out.CameraModel = tagString(x, exif.Model)
+	out.LensModel = tagString(x, exif.LensModel)
+	out.ISO = tagInt(x, exif.ISOSpeedRatings)
+	out.Orientation = tagInt(x, exif.Orientation)
+	out.Width = tagInt(x, exif.PixelXDimension)
+	out.Height = tagInt(x, exif.PixelYDimension)
+	out.FNumber = tagRat(x, exif.FNumber)
+	out.FocalLength = tagRat(x, exif.FocalLength)
+
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && den != 0 {
+			if num >= den {
+				out.ExposureTime = fmt.Sprintf("%g", float64(num)/float64(den))
+			} else {
+				out.ExposureTime = fmt.Sprintf("1/%d", (den+num/2)/num)
+			}
+		}
+	}
+
+	if out.Width == 0 || out.Height == 0 {
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(head)); err == nil {
+			out.Width, out.Height = cfg.Width, cfg.Height
+		}
+	}
+	return out, nil
+}
+
+func tagString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil || tag.Format() != tiff.StringVal {
+		return ""
+	}
+	s, _ := tag.StringVal()
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func tagInt(x *exif.Exif, name exif.FieldName) int {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	n, err := tag.Int(0)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func tagRat(x *exif.Exif, name exif.FieldName) float64 {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
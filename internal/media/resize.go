@@ -0,0 +1,141 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+
+	// Registers decoders for image.Decode
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	ErrUnsupportedImage = errors.New("unsupported image format")
+	ErrImageTooLarge    = errors.New("image too large")
+)
+
+// Largest image Decode accepts, in pixels. A small file can declare a huge
+// size and decoding it would allocate gigabytes.
+const MaxPixels = 100_000_000
+
+// Rendition is an encoded, resized copy of an image
+type Rendition struct {
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// Decodes an image from r. The size in the header is checked first, images
+// over MaxPixels are refused before any pixels are allocated.
+func Decode(r io.Reader) (image.Image, error) {
+	var head bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &head))
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return nil, ErrUnsupportedImage
+		}
+		return nil, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return nil, ErrImageTooLarge
+	}
+
+	img, _, err := image.Decode(io.MultiReader(&head, r))
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return nil, ErrUnsupportedImage
+		}
+		return nil, err
+	}
+	return img, nil
+}
+
+// Scales src so the longest edge is at most maxEdge, applies the EXIF orientation
+// and encodes it as JPEG. Images already smaller than maxEdge are not upscaled.
+func Render(src image.Image, maxEdge, quality, orientation int) (Rendition, error) {
+	b := src.Bounds()
+	w, h := fit(b.Dx(), b.Dy(), maxEdge)
+
+	scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, b, draw.Src, nil)
+
+	// Rotating after scaling keeps the pixel loop small
+	dst := Orient(scaled, orientation)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality}); err != nil {
+		return Rendition{}, err
+	}
+	return Rendition{
+		Data:        buf.Bytes(),
+		ContentType: "image/jpeg",
+		Width:       dst.Bounds().Dx(),
+		Height:      dst.Bounds().Dy(),
+	}, nil
+}
+
+// Works out the target size keeping the aspect ratio
+func fit(w, h, maxEdge int) (int, int) {
+	if w <= maxEdge && h <= maxEdge {
+		return w, h
+	}
+	if w >= h {
+		nh := h * maxEdge / w
+		if nh < 1 {
+			nh = 1
+		}
+		return maxEdge, nh
+	}
+	nw := w * maxEdge / h
+	if nw < 1 {
+		nw = 1
+	}
+	return nw, maxEdge
+}
+
+// Applies an EXIF orientation (1-8) so renditions display upright without the tag
+func Orient(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// 5-8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90 counter clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
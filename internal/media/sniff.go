@@ -0,0 +1,92 @@
+package media
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// How many leading bytes Sniff looks at
+const SniffBytes = 512
+
+// Content types accepted as photos or videos, with the extension their keys get
+var allowedTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/bmp":       ".bmp",
+	"image/heic":      ".heic",
+	"image/heif":      ".heif",
+	"image/avif":      ".avif",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"video/webm":      ".webm",
+	"video/3gpp":      ".3gp",
+}
+
+// ISO base media file brands (the "ftyp" box) that net/http does not know about
+var ftypBrands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"hevc": "image/heic",
+	"hevx": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"avif": "image/avif",
+	"avis": "image/avif",
+	"qt  ": "video/quicktime",
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"mp41": "video/mp4",
+	"mp42": "video/mp4",
+	"avc1": "video/mp4",
+	"M4V ": "video/mp4",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"3gp6": "video/3gpp",
+}
+
+// Detects the content type from magic bytes, ignoring whatever the client claimed
+func Sniff(head []byte) string {
+	if len(head) > SniffBytes {
+		head = head[:SniffBytes]
+	}
+
+	// ftyp box: 4 byte size, "ftyp", 4 byte major brand
+	if len(head) >= 12 && bytes.Equal(head[4:8], []byte("ftyp")) {
+		if ct, ok := ftypBrands[string(head[8:12])]; ok {
+			return ct
+		}
+	}
+
+	ct := http.DetectContentType(head)
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	return strings.TrimSpace(ct)
+}
+
+// Reports whether a sniffed content type may be stored as a photo
+func Allowed(contentType string) bool {
+	_, ok := allowedTypes[contentType]
+	return ok
+}
+
+// Extension for keys of an allowed content type, "" for anything else
+func Extension(contentType string) string {
+	return allowedTypes[contentType]
+}
+
+// Every content type Sniff can report that Allowed accepts, sorted
+func Types() []string {
+	types := make([]string, 0, len(allowedTypes))
+	for ct := range allowedTypes {
+		types = append(types, ct)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const startKey = "metrics:start"
+
+// Times every gorm operation and exports the connection pool and library
+// gauges. Call once per *gorm.DB, after it is opened.
+func InstrumentDB(gdb *gorm.DB) error {
+	cb := gdb.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("metrics:before_create", startTimer),
+		cb.Create().After("gorm:create").Register("metrics:after_create", observe("create")),
+		cb.Query().Before("gorm:query").Register("metrics:before_query", startTimer),
+		cb.Query().After("gorm:query").Register("metrics:after_query", observe("query")),
+		cb.Update().Before("gorm:update").Register("metrics:before_update", startTimer),
+		cb.Update().After("gorm:update").Register("metrics:after_update", observe("update")),
+		cb.Delete().Before("gorm:delete").Register("metrics:before_delete", startTimer),
+		cb.Delete().After("gorm:delete").Register("metrics:after_delete", observe("delete")),
+		cb.Row().Before("gorm:row").Register("metrics:before_row", startTimer),
+		cb.Row().After("gorm:row").Register("metrics:after_row", observe("row")),
+		cb.Raw().Before("gorm:raw").Register("metrics:before_raw", startTimer),
+		cb.Raw().After("gorm:raw").Register("metrics:after_raw", observe("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		return err
+	}
+	Default.NewGaugeFunc("lm_db_pool_open_connections", "Open SQLite connections.",
+		func() float64 { return float64(sqlDB.Stats().OpenConnections) })
+	Default.NewGaugeFunc("lm_db_pool_in_use", "SQLite connections in use.",
+		func() float64 { return float64(sqlDB.Stats().InUse) })
+	Default.NewCounterFunc("lm_db_pool_wait_total", "Queries that had to wait for a connection.",
+		func() float64 { return float64(sqlDB.Stats().WaitCount) })
+	Default.NewCounterFunc("lm_db_pool_wait_seconds_total", "Time spent waiting for a connection.",
+		func() float64 { return sqlDB.Stats().WaitDuration.Seconds() })
+
+	registerLibrary(gdb)
+	return nil
+}
+
+func startTimer(tx *gorm.DB) {
+	tx.InstanceSet(startKey, time.Now())
+}
+
+func observe(op string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		v, ok := tx.InstanceGet(startKey)
+		if !ok {
+			return
+		}
+		start, _ := v.(time.Time)
+		DBQueryDuration.Observe(since(start), op, tableLabel(tx.Statement))
+		if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			DBErrors.Inc(op)
+		}
+	}
+}
+
+// Table("album_photos ap") leaves the alias in Statement.Table, the label
+// is the real table name
+func tableLabel(st *gorm.Statement) string {
+	t := st.Table
+	if st.TableExpr != nil {
+		t = st.TableExpr.SQL
+		if i := strings.IndexByte(t, ' '); i >= 0 {
+			t = t[:i]
+		}
+	}
+	return strings.Trim(t, "`\"")
+}
+
+// Photo count, bytes and album count, live rows only, queried at scrape time
+func registerLibrary(gdb *gorm.DB) {
+	query := func(q string) float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var n float64
+		if err := gdb.WithContext(ctx).Raw(q).Scan(&n).Error; err != nil {
+			log.Printf("metrics: %v", err)
+		}
+		return n
+	}
+	Default.NewGaugeFunc("lm_library_photos", "Photos not in the trash.",
+		func() float64 { return query("SELECT COUNT(*) FROM photos WHERE deleted_at IS NULL") })
+	Default.NewGaugeFunc("lm_library_photo_bytes", "Bytes of original photos not in the trash.",
+		func() float64 { return query("SELECT COALESCE(SUM(bytes), 0) FROM photos WHERE deleted_at IS NULL") })
+	Default.NewGaugeFunc("lm_library_albums", "Albums not in the trash.",
+		func() float64 { return query("SELECT COUNT(*) FROM albums WHERE deleted_at IS NULL") })
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import "time"
+
+// Registry served on /metrics
+var Default = NewRegistry()
+
+// HTTP, recorded by the api logger middleware
+var (
+	HTTPRequests = Default.NewCounterVec("lm_http_requests_total",
+		"HTTP requests by method, route pattern and status.", "method", "route", "status")
+	HTTPDuration = Default.NewHistogramVec("lm_http_request_duration_seconds",
+		"HTTP request latency by method, route pattern and status.", DefBuckets, "method", "route", "status")
+)
+
+// SQLite, recorded by the gorm callbacks from InstrumentDB
+var (
+	DBQueryDuration = Default.NewHistogramVec("lm_db_query_duration_seconds",
+		"Query latency by gorm operation and table, pool wait included.", DefBuckets, "op", "table")
+	DBErrors = Default.NewCounterVec("lm_db_errors_total",
+		"Failed queries by gorm operation, not found is not an error.", "op")
+)
+
+// Object store, recorded by the decorator from InstrumentStore
+var (
+	StoreDuration = Default.NewHistogramVec("lm_storage_operation_duration_seconds",
+		"Object store call latency by backend and operation.", DefBuckets, "backend", "op")
+	StoreErrors = Default.NewCounterVec("lm_storage_operation_errors_total",
+		"Failed object store calls by backend and operation, not found is not an error.", "backend", "op")
+)
+
+func since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
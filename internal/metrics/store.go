@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+)
+
+// Wraps a store so every call is timed and failures are counted. The
+// filesystem store keeps serving its signed URLs through the wrapper.
+func InstrumentStore(s storage.ObjectStore) storage.ObjectStore {
+	backend := "s3"
+	if _, ok := s.(*storage.FS); ok {
+		backend = "fs"
+	}
+	is := &instrumentedStore{next: s, backend: backend}
+	if h, ok := s.(http.Handler); ok {
+		return handlerStore{is, h}
+	}
+	return is
+}
+
+type handlerStore struct {
+	*instrumentedStore
+	http.Handler
+}
+
+type instrumentedStore struct {
+	next    storage.ObjectStore
+	backend string
+}
+
+func (s *instrumentedStore) done(op string, start time.Time, err error) {
+	StoreDuration.Observe(since(start), s.backend, op)
+	if err != nil && !storage.IsNotFound(err) {
+		StoreErrors.Inc(s.backend, op)
+	}
+}
+
+func (s *instrumentedStore) PhotosBucket() string { return s.next.PhotosBucket() }
+
+func (s *instrumentedStore) Health(ctx context.Context) (err error) {
+	defer func(start time.Time) { s.done("health", start, err) }(time.Now())
+	return s.next.Health(ctx)
+}
+
+func (s *instrumentedStore) EnsureBucket(ctx context.Context, bucket string) (err error) {
+	defer func(start time.Time) { s.done("ensure_bucket", start, err) }(time.Now())
+	return s.next.EnsureBucket(ctx, bucket)
+}
+
+func (s *instrumentedStore) PresignPut(ctx context.Context, bucket, key, contentType string, size int64, expires time.Duration) (url string, headers map[string]string, err error) {
+	defer func(start time.Time) { s.done("presign_put", start, err) }(time.Now())
+	return s.next.PresignPut(ctx, bucket, key, contentType, size, expires)
+}
+
+func (s *instrumentedStore) PresignGetObject(ctx context.Context, bucket, key string, ttl time.Duration) (url string, err error) {
+	defer func(start time.Time) { s.done("presign_get", start, err) }(time.Now())
+	return s.next.PresignGetObject(ctx, bucket, key, ttl)
+}
+
+func (s *instrumentedStore) Head(ctx context.Context, bucket, key string) (info storage.ObjectInfo, err error) {
+	defer func(start time.Time) { s.done("head", start, err) }(time.Now())
+	return s.next.Head(ctx, bucket, key)
+}
+
+// Reads are timed to the first byte, the body is the caller's to drain
+func (s *instrumentedStore) GetObject(ctx context.Context, bucket, key string) (body io.ReadCloser, err error) {
+	defer func(start time.Time) { s.done("get", start, err) }(time.Now())
+	return s.next.GetObject(ctx, bucket, key)
+}
+
+func (s *instrumentedStore) GetObjectRange(ctx context.Context, bucket, key string, offset, length int64) (body io.ReadCloser, err error) {
+	defer func(start time.Time) { s.done("get_range", start, err) }(time.Now())
+	return s.next.GetObjectRange(ctx, bucket, key, offset, length)
+}
+
+func (s *instrumentedStore) PutObject(ctx context.Context, bucket, key, contentType string, body []byte) (err error) {
+	defer func(start time.Time) { s.done("put", start, err) }(time.Now())
+	return s.next.PutObject(ctx, bucket, key, contentType, body)
+}
+
+func (s *instrumentedStore) PutObjectFrom(ctx context.Context, bucket, key, contentType string, body io.ReaderAt, size int64) (err error) {
+	defer func(start time.Time) { s.done("put", start, err) }(time.Now())
+	return s.next.PutObjectFrom(ctx, bucket, key, contentType, body, size)
+}
+
+func (s *instrumentedStore) DeleteObject(ctx context.Context, bucket, key string) (err error) {
+	defer func(start time.Time) { s.done("delete", start, err) }(time.Now())
+	return s.next.DeleteObject(ctx, bucket, key)
+}
+
+func (s *instrumentedStore) ListObjects(ctx context.Context, bucket, prefix string, fn func(storage.ObjectInfo) error) (err error) {
+	defer func(start time.Time) { s.done("list", start, err) }(time.Now())
+	return s.next.ListObjects(ctx, bucket, prefix, fn)
+}
+
+func (s *instrumentedStore) CreateMultipart(ctx context.Context, bucket, key, contentType string) (id string, err error) {
+	defer func(start time.Time) { s.done("multipart_create", start, err) }(time.Now())
+	return s.next.CreateMultipart(ctx, bucket, key, contentType)
+}
+
+func (s *instrumentedStore) PresignPart(ctx context.Context, bucket, key, uploadID string, part int32, expires time.Duration) (url string, err error) {
+	defer func(start time.Time) { s.done("presign_part", start, err) }(time.Now())
+	return s.next.PresignPart(ctx, bucket, key, uploadID, part, expires)
+}
+
+func (s *instrumentedStore) ListParts(ctx context.Context, bucket, key, uploadID string) (parts []storage.Part, err error) {
+	defer func(start time.Time) { s.done("list_parts", start, err) }(time.Now())
+	return s.next.ListParts(ctx, bucket, key, uploadID)
+}
+
+func (s *instrumentedStore) CompleteMultipart(ctx context.Context, bucket, key, uploadID string, parts []storage.Part) (err error) {
+	defer func(start time.Time) { s.done("multipart_complete", start, err) }(time.Now())
+	return s.next.CompleteMultipart(ctx, bucket, key, uploadID, parts)
+}
+
+func (s *instrumentedStore) AbortMultipart(ctx context.Context, bucket, key, uploadID string) (err error) {
+	defer func(start time.Time) { s.done("multipart_abort", start, err) }(time.Now())
+	return s.next.AbortMultipart(ctx, bucket, key, uploadID)
+}
+
+func (s *instrumentedStore) ListMultipartUploads(ctx context.Context, bucket string, fn func(storage.MultipartUpload) error) (err error) {
+	defer func(start time.Time) { s.done("list_uploads", start, err) }(time.Now())
+	return s.next.ListMultipartUploads(ctx, bucket, fn)
+}
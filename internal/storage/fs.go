@@ -0,0 +1,434 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/media"
+)
+
+// Path the Go server serves signed blob URLs from
+const BlobPathPrefix = "/blob/"
+
+type FSConfig struct {
+	// Directory blobs are stored under, one sub directory per bucket
+	Root string
+	// HMAC key for signed URLs
+	Secret string
+	// Base the signed URLs are built on, e.g. http://localhost:8173
+	PublicBase   string
+	BucketPhotos string
+}
+
+// FS stores blobs on the local filesystem and serves HMAC signed
+// upload/download URLs itself, so no MinIO is needed
+type FS struct {
+	Config FSConfig
+	secret []byte
+}
+
+func NewFSStore(c FSConfig) (*FS, error) {
+	if c.Root == "" {
+		return nil, errors.New("fs store: root is required")
+	}
+	if c.Secret == "" {
+		return nil, errors.New("fs store: secret is required")
+	}
+	if err := os.MkdirAll(c.Root, 0o750); err != nil {
+		return nil, err
+	}
+	c.PublicBase = strings.TrimSuffix(c.PublicBase, "/")
+	return &FS{Config: c, secret: []byte(c.Secret)}, nil
+}
+
+func (f *FS) PhotosBucket() string { return f.Config.BucketPhotos }
+
+func (f *FS) Health(ctx context.Context) error {
+	_, err := os.Stat(filepath.Join(f.Config.Root, f.Config.BucketPhotos))
+	return err
+}
+
+// Creates the bucket directory if missing
+func (f *FS) EnsureBucket(ctx context.Context, bucket string) error {
+	if bucket == "" {
+		return nil
+	}
+	if !validBucket(bucket) {
+		return fmt.Errorf("fs store: bad bucket %q", bucket)
+	}
+	return os.MkdirAll(filepath.Join(f.Config.Root, bucket), 0o750)
+}
+
+func (f *FS) PresignPut(ctx context.Context, bucket, key, contentType string, size int64, expires time.Duration) (string, map[string]string, error) {
+	length := ""
+	if size > 0 {
+		length = strconv.FormatInt(size, 10)
+	}
+	u, err := f.signedURL(http.MethodPut, bucket, key, contentType, length, "", "", expires)
+	if err != nil {
+		return "", nil, err
+	}
+	return u, map[string]string{"Content-Type": contentType}, nil
+}
+
+func (f *FS) PresignGetObject(ctx context.Context, bucket, key string, ttl time.Duration) (string, error) {
+	return f.signedURL(http.MethodGet, bucket, key, "", "", "", "", ttl)
+}
+
+func (f *FS) Head(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	p, err := f.objectPath(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, notFound(err)
+	}
+	if st.IsDir() {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         st.Size(),
+		ContentType:  contentTypeFor(key),
+		ETag:         fsETag(st),
+		LastModified: st.ModTime(),
+	}, nil
+}
+
+func (f *FS) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	p, err := f.objectPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return file, nil
+}
+
+func (f *FS) GetObjectRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error) {
+	p, err := f.objectPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, offset, length), file}, nil
+}
+
+func (f *FS) PutObject(ctx context.Context, bucket, key, contentType string, body []byte) error {
+	return f.writeObject(bucket, key, bytes.NewReader(body))
+}
+
+func (f *FS) PutObjectFrom(ctx context.Context, bucket, key, contentType string, body io.ReaderAt, size int64) error {
+	return f.writeObject(bucket, key, io.NewSectionReader(body, 0, size))
+}
+
+func (f *FS) DeleteObject(ctx context.Context, bucket, key string) error {
+	p, err := f.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// Prunes directories left empty under the bucket (variants/{id}/ etc.)
+	top := filepath.Join(f.Config.Root, bucket)
+	for dir := filepath.Dir(p); dir != top && strings.HasPrefix(dir, top); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Walks the bucket directory, temp files from in-flight writes are skipped
+func (f *FS) ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error {
+	if !validBucket(bucket) {
+		return fmt.Errorf("fs store: bad bucket %q", bucket)
+	}
+	top := filepath.Join(f.Config.Root, bucket)
+	return filepath.WalkDir(top, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == top && errors.Is(err, fs.ErrNotExist) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != top {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(top, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		st, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{
+			Key:          key,
+			Size:         st.Size(),
+			ContentType:  contentTypeFor(key),
+			ETag:         fsETag(st),
+			LastModified: st.ModTime(),
+		})
+	})
+}
+
+// Serves the signed URLs from PresignPut and PresignGetObject,
+// mounted by the router under BlobPathPrefix
+func (f *FS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, BlobPathPrefix)
+	bucket, key, ok := strings.Cut(rest, "/")
+	if !ok || bucket == "" || key == "" {
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	q := r.URL.Query()
+	if !f.verify(method, bucket, key, q.Get("ct"), q.Get("len"), q.Get("upload"), q.Get("part"), q.Get("exp"), q.Get("sig")) {
+		http.Error(w, "signature invalid or expired", http.StatusForbidden)
+		return
+	}
+
+	// Blobs can be large, transfers are not cut off by the server timeouts
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	// Parts of a multipart upload are staged until it is completed
+	if upload := q.Get("upload"); upload != "" && method == http.MethodPut {
+		etag, err := f.writePart(bucket, key, upload, q.Get("part"), r.Body)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				http.Error(w, "no such upload", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "write failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	switch method {
+	case http.MethodPut:
+		if ct := q.Get("ct"); ct != "" && r.Header.Get("Content-Type") != ct {
+			http.Error(w, "content type does not match signature", http.StatusForbidden)
+			return
+		}
+		// The server reads exactly Content-Length bytes, so checking the header is enough
+		if n := q.Get("len"); n != "" && strconv.FormatInt(r.ContentLength, 10) != n {
+			http.Error(w, "content length does not match signature", http.StatusForbidden)
+			return
+		}
+		if err := f.writeObject(bucket, key, r.Body); err != nil {
+			http.Error(w, "write failed", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		p, err := f.objectPath(bucket, key)
+		if err != nil {
+			http.Error(w, "bad key", http.StatusBadRequest)
+			return
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer file.Close()
+		st, err := file.Stat()
+		if err != nil || st.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		// The type comes from the bytes, not the key, and is never guessed
+		// again by the browser. Blobs are served on the API's origin, so
+		// anything that isn't a photo or video is only ever a download.
+		head := make([]byte, media.SniffBytes)
+		n, _ := io.ReadFull(file, head)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "read failed", http.StatusInternalServerError)
+			return
+		}
+		h := w.Header()
+		if ct := media.Sniff(head[:n]); media.Allowed(ct) {
+			h.Set("Content-Type", ct)
+			h.Set("Content-Disposition", "inline")
+		} else {
+			h.Set("Content-Type", "application/octet-stream")
+			h.Set("Content-Disposition", "attachment")
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("ETag", fsETag(st))
+		http.ServeContent(w, r, "", st.ModTime(), file)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// length is only set for uploads of a known size, upload and part for the
+// parts of a multipart upload
+func (f *FS) signedURL(method, bucket, key, contentType, length, upload, part string, ttl time.Duration) (string, error) {
+	if _, err := f.objectPath(bucket, key); err != nil {
+		return "", err
+	}
+	exp := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+
+	q := url.Values{}
+	q.Set("exp", exp)
+	if contentType != "" {
+		q.Set("ct", contentType)
+	}
+	if length != "" {
+		q.Set("len", length)
+	}
+	if upload != "" {
+		q.Set("upload", upload)
+		q.Set("part", part)
+	}
+	q.Set("sig", f.sign(method, bucket, key, contentType, length, upload, part, exp))
+
+	p := BlobPathPrefix + url.PathEscape(bucket) + "/" + escapeKey(key)
+	return f.Config.PublicBase + p + "?" + q.Encode(), nil
+}
+
+func (f *FS) sign(method, bucket, key, contentType, length, upload, part, exp string) string {
+	msg := method + "\n" + bucket + "\n" + key + "\n" + contentType + "\n" + exp
+	// Plain URLs keep the message they were always signed with
+	if upload != "" {
+		msg += "\n" + upload + "\n" + part
+	}
+	if length != "" {
+		msg += "\nlen=" + length
+	}
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *FS) verify(method, bucket, key, contentType, length, upload, part, exp, sig string) bool {
+	n, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > n {
+		return false
+	}
+	want := f.sign(method, bucket, key, contentType, length, upload, part, exp)
+	return hmac.Equal([]byte(want), []byte(sig))
+}
+
+// Writes to a temp file first so readers never see a partial object
+func (f *FS) writeObject(bucket, key string, r io.Reader) error {
+	p, err := f.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Maps bucket/key to a path under Root, refusing anything that escapes it
+func (f *FS) objectPath(bucket, key string) (string, error) {
+	if !validBucket(bucket) {
+		return "", fmt.Errorf("fs store: bad bucket %q", bucket)
+	}
+	clean := path.Clean("/" + key)
+	if key == "" || clean == "/" || clean != "/"+key || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("fs store: bad key %q", key)
+	}
+	return filepath.Join(f.Config.Root, bucket, filepath.FromSlash(clean)), nil
+}
+
+func validBucket(bucket string) bool {
+	return bucket != "" && bucket != "." && bucket != ".." &&
+		!strings.ContainsAny(bucket, `/\`)
+}
+
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+func contentTypeFor(key string) string {
+	if ct := mime.TypeByExtension(strings.ToLower(path.Ext(key))); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+func fsETag(st fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, st.ModTime().UnixNano(), st.Size())
+}
+
+func notFound(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parts of unfinished uploads are staged in <root>/<bucket>/.multipart/<id>/,
+// ListObjects skips dot directories so they never show up as objects
+const multipartDir = ".multipart"
+
+// upload.json in the staging directory
+type fsUpload struct {
+	Key         string    `json:"key"`
+	ContentType string    `json:"content_type"`
+	Initiated   time.Time `json:"initiated"`
+}
+
+func (f *FS) uploadDir(bucket, uploadID string) (string, error) {
+	if !validBucket(bucket) {
+		return "", fmt.Errorf("fs store: bad bucket %q", bucket)
+	}
+	if len(uploadID) != 32 || strings.Trim(uploadID, "0123456789abcdef") != "" {
+		return "", ErrNotFound
+	}
+	return filepath.Join(f.Config.Root, bucket, multipartDir, uploadID), nil
+}
+
+// Loads the upload and checks it belongs to key
+func (f *FS) readUpload(bucket, key, uploadID string) (string, fsUpload, error) {
+	dir, err := f.uploadDir(bucket, uploadID)
+	if err != nil {
+		return "", fsUpload{}, err
+	}
+	var up fsUpload
+	b, err := os.ReadFile(filepath.Join(dir, "upload.json"))
+	if err != nil {
+		return "", up, notFound(err)
+	}
+	if err := json.Unmarshal(b, &up); err != nil {
+		return "", up, err
+	}
+	if up.Key != key {
+		return "", up, ErrNotFound
+	}
+	return dir, up, nil
+}
+
+func partName(n int32) string { return fmt.Sprintf("part-%05d", n) }
+
+func (f *FS) CreateMultipart(ctx context.Context, bucket, key, contentType string) (string, error) {
+	if _, err := f.objectPath(bucket, key); err != nil {
+		return "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	dir, err := f.uploadDir(bucket, id)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", err
+	}
+	meta, _ := json.Marshal(fsUpload{Key: key, ContentType: contentType, Initiated: time.Now().UTC()})
+	if err := os.WriteFile(filepath.Join(dir, "upload.json"), meta, 0o640); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	return id, nil
+}
+
+func (f *FS) PresignPart(ctx context.Context, bucket, key, uploadID string, part int32, expires time.Duration) (string, error) {
+	if _, _, err := f.readUpload(bucket, key, uploadID); err != nil {
+		return "", err
+	}
+	if part < 1 || part > MaxParts {
+		return "", fmt.Errorf("fs store: bad part number %d", part)
+	}
+	return f.signedURL(http.MethodPut, bucket, key, "", "", uploadID, strconv.Itoa(int(part)), expires)
+}
+
+// Stores one part, returns its ETag (the MD5 of the bytes, like S3)
+func (f *FS) writePart(bucket, key, uploadID, part string, r io.Reader) (string, error) {
+	dir, _, err := f.readUpload(bucket, key, uploadID)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(part)
+	if err != nil || n < 1 || n > MaxParts {
+		return "", fmt.Errorf("fs store: bad part number %q", part)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".part-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, partName(int32(n)))); err != nil {
+		return "", err
+	}
+	// The ETag is kept next to the part so ListParts doesn't rehash
+	return etag, os.WriteFile(filepath.Join(dir, partName(int32(n))+".etag"), []byte(etag), 0o640)
+}
+
+func (f *FS) ListParts(ctx context.Context, bucket, key, uploadID string) ([]Part, error) {
+	dir, _, err := f.readUpload(bucket, key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	parts := []Part{}
+	for _, e := range entries {
+		name := e.Name()
+		num, ok := strings.CutPrefix(name, "part-")
+		if !ok || strings.Contains(num, ".") {
+			continue
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			continue
+		}
+		st, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		etag, err := os.ReadFile(filepath.Join(dir, name+".etag"))
+		if err != nil {
+			// Written between the rename and the etag file, not finished yet
+			continue
+		}
+		parts = append(parts, Part{Number: int32(n), ETag: string(etag), Size: st.Size()})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, nil
+}
+
+// Joins the parts in the given order into the object, then drops the staging directory
+func (f *FS) CompleteMultipart(ctx context.Context, bucket, key, uploadID string, parts []Part) error {
+	dir, _, err := f.readUpload(bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return errors.New("fs store: no parts to complete")
+	}
+
+	var readers []io.Reader
+	for i, p := range parts {
+		if i > 0 && p.Number <= parts[i-1].Number {
+			return errors.New("fs store: parts must be in ascending order")
+		}
+		name := filepath.Join(dir, partName(p.Number))
+		if p.ETag != "" {
+			etag, err := os.ReadFile(name + ".etag")
+			if err != nil || string(etag) != p.ETag {
+				return fmt.Errorf("fs store: part %d does not match its etag", p.Number)
+			}
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("fs store: part %d: %w", p.Number, err)
+		}
+		defer file.Close()
+		readers = append(readers, file)
+	}
+
+	if err := f.writeObject(bucket, key, io.MultiReader(readers...)); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (f *FS) AbortMultipart(ctx context.Context, bucket, key, uploadID string) error {
+	dir, _, err := f.readUpload(bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (f *FS) ListMultipartUploads(ctx context.Context, bucket string, fn func(MultipartUpload) error) error {
+	if !validBucket(bucket) {
+		return fmt.Errorf("fs store: bad bucket %q", bucket)
+	}
+	entries, err := os.ReadDir(filepath.Join(f.Config.Root, bucket, multipartDir))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(f.Config.Root, bucket, multipartDir, e.Name(), "upload.json"))
+		if err != nil {
+			continue
+		}
+		var up fsUpload
+		if json.Unmarshal(b, &up) != nil {
+			continue
+		}
+		if err := fn(MultipartUpload{Key: up.Key, UploadID: e.Name(), Initiated: up.Initiated}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -54,6 +57,8 @@ func NewS3Client(ctx context.Context, c S3Config) (*S3, error) {
 	}, nil
 }
 
+func (s *S3) PhotosBucket() string { return s.Config.BucketPhotos }
+
 func (s *S3) Health(ctx context.Context) error {
 	_, err := s.raw.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &s.Config.BucketPhotos})
 	return err
@@ -114,12 +119,17 @@ func (s *S3) SetBucketCORS(ctx context.Context, bucket string) error {
 	return err
 }
 
-func (s *S3) PresignPut(ctx context.Context, bucket, key, contentType string, expires time.Duration) (string, map[string]string, error) {
-	out, err := s.presign.PresignPutObject(ctx, &s3.PutObjectInput{
+func (s *S3) PresignPut(ctx context.Context, bucket, key, contentType string, size int64, expires time.Duration) (string, map[string]string, error) {
+	in := &s3.PutObjectInput{
 		Bucket:      &bucket,
 		Key:         &key,
 		ContentType: &contentType,
-	}, s3.WithPresignExpires(expires))
+	}
+	// Content-Length becomes a signed header, browsers send it on their own
+	if size > 0 {
+		in.ContentLength = aws.Int64(size)
+	}
+	out, err := s.presign.PresignPutObject(ctx, in, s3.WithPresignExpires(expires))
 	if err != nil {
 		return "", nil, err
 	}
@@ -127,8 +137,41 @@ func (s *S3) PresignPut(ctx context.Context, bucket, key, contentType string, ex
 }
 
 // Confirms an object exists in MinIO
-func (s *S3) Head(ctx context.Context, bucket, key string) (*s3.HeadObjectOutput, error) {
-	return s.raw.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &bucket, Key: &key})
+func (s *S3) Head(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	out, err := s.raw.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		ETag:         aws.ToString(out.ETag),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+// Reports whether err means the object or bucket does not exist
+func IsNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrNotFound) {
+		return true
+	}
+	var nf *types.NotFound
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nf) || errors.As(err, &nsk) {
+		return true
+	}
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "NotFound", "NoSuchKey", "NoSuchBucket":
+			return true
+		}
+	}
+	return false
 }
 
 // Funtion returns a time limited URL to read an object
@@ -152,3 +195,221 @@ func (s *S3) DeleteObject(ctx context.Context, bucket, key string) error {
 	})
 	return err
 }
+
+// Opens an object for reading, caller must close the body
+func (s *S3) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	out, err := s.raw.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Reads length bytes starting at offset, short objects return what they have
+func (s *S3) GetObjectRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error) {
+	rng := fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	out, err := s.raw.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Range:  &rng,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Uploads a small in-memory object, used for server generated files like thumbnails
+func (s *S3) PutObject(ctx context.Context, bucket, key, contentType string, body []byte) error {
+	_, err := s.raw.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        &bucket,
+		Key:           &key,
+		ContentType:   &contentType,
+		ContentLength: aws.Int64(int64(len(body))),
+		Body:          bytes.NewReader(body),
+	})
+	return err
+}
+
+// Largest object sent in one PUT, S3 refuses more than 5GiB
+const maxSinglePut = 1 << 30
+
+// Part size for objects above maxSinglePut, 10000 parts of it cover 640GiB
+const putPartSize = 64 << 20
+
+func (s *S3) PutObjectFrom(ctx context.Context, bucket, key, contentType string, body io.ReaderAt, size int64) error {
+	if size <= maxSinglePut {
+		_, err := s.raw.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        &bucket,
+			Key:           &key,
+			ContentType:   &contentType,
+			ContentLength: aws.Int64(size),
+			Body:          io.NewSectionReader(body, 0, size),
+		})
+		return err
+	}
+
+	uploadID, err := s.CreateMultipart(ctx, bucket, key, contentType)
+	if err != nil {
+		return err
+	}
+	var parts []Part
+	for off, n := int64(0), int32(1); off < size; off, n = off+putPartSize, n+1 {
+		length := min(putPartSize, size-off)
+		out, err := s.raw.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        &bucket,
+			Key:           &key,
+			UploadId:      &uploadID,
+			PartNumber:    aws.Int32(n),
+			ContentLength: aws.Int64(length),
+			Body:          io.NewSectionReader(body, off, length),
+		})
+		if err != nil {
+			_ = s.AbortMultipart(context.WithoutCancel(ctx), bucket, key, uploadID)
+			return err
+		}
+		parts = append(parts, Part{Number: n, ETag: aws.ToString(out.ETag), Size: length})
+	}
+	if err := s.CompleteMultipart(ctx, bucket, key, uploadID, parts); err != nil {
+		_ = s.AbortMultipart(context.WithoutCancel(ctx), bucket, key, uploadID)
+		return err
+	}
+	return nil
+}
+
+// Pages through every object under prefix
+func (s *S3) ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error {
+	in := &s3.ListObjectsV2Input{Bucket: &bucket}
+	if prefix != "" {
+		in.Prefix = &prefix
+	}
+	pages := s3.NewListObjectsV2Paginator(s.raw, in)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, o := range page.Contents {
+			if err := fn(ObjectInfo{
+				Key:          aws.ToString(o.Key),
+				Size:         aws.ToInt64(o.Size),
+				ETag:         aws.ToString(o.ETag),
+				LastModified: aws.ToTime(o.LastModified),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *S3) CreateMultipart(ctx context.Context, bucket, key, contentType string) (string, error) {
+	out, err := s.raw.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		ContentType: &contentType,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.UploadId), nil
+}
+
+func (s *S3) PresignPart(ctx context.Context, bucket, key, uploadID string, part int32, expires time.Duration) (string, error) {
+	out, err := s.presign.PresignUploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     &bucket,
+		Key:        &key,
+		UploadId:   &uploadID,
+		PartNumber: aws.Int32(part),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return out.URL, nil
+}
+
+func (s *S3) ListParts(ctx context.Context, bucket, key, uploadID string) ([]Part, error) {
+	parts := []Part{}
+	pages := s3.NewListPartsPaginator(s.raw, &s3.ListPartsInput{
+		Bucket:   &bucket,
+		Key:      &key,
+		UploadId: &uploadID,
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, multipartNotFound(err)
+		}
+		for _, p := range page.Parts {
+			parts = append(parts, Part{
+				Number: aws.ToInt32(p.PartNumber),
+				ETag:   aws.ToString(p.ETag),
+				Size:   aws.ToInt64(p.Size),
+			})
+		}
+	}
+	return parts, nil
+}
+
+func (s *S3) CompleteMultipart(ctx context.Context, bucket, key, uploadID string, parts []Part) error {
+	done := make([]types.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		done = append(done, types.CompletedPart{PartNumber: aws.Int32(p.Number), ETag: aws.String(p.ETag)})
+	}
+	_, err := s.raw.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &bucket,
+		Key:             &key,
+		UploadId:        &uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: done},
+	})
+	return multipartNotFound(err)
+}
+
+func (s *S3) AbortMultipart(ctx context.Context, bucket, key, uploadID string) error {
+	_, err := s.raw.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &bucket,
+		Key:      &key,
+		UploadId: &uploadID,
+	})
+	return multipartNotFound(err)
+}
+
+func (s *S3) ListMultipartUploads(ctx context.Context, bucket string, fn func(MultipartUpload) error) error {
+	in := &s3.ListMultipartUploadsInput{Bucket: &bucket}
+	for {
+		out, err := s.raw.ListMultipartUploads(ctx, in)
+		if err != nil {
+			return err
+		}
+		for _, u := range out.Uploads {
+			if err := fn(MultipartUpload{
+				Key:       aws.ToString(u.Key),
+				UploadID:  aws.ToString(u.UploadId),
+				Initiated: aws.ToTime(u.Initiated),
+			}); err != nil {
+				return err
+			}
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			return nil
+		}
+		in.KeyMarker = out.NextKeyMarker
+		in.UploadIdMarker = out.NextUploadIdMarker
+	}
+}
+
+// An upload that was completed or aborted answers NoSuchUpload
+func multipartNotFound(err error) error {
+	var nsu *types.NoSuchUpload
+	if errors.As(err, &nsu) {
+		return ErrNotFound
+	}
+	var ae smithy.APIError
+	if errors.As(err, &ae) && ae.ErrorCode() == "NoSuchUpload" {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// Returned by stores when an object or bucket does not exist
+var ErrNotFound = errors.New("storage: not found")
+
+// ObjectInfo is what a HEAD tells us about an object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
+// ObjectStore is the blob storage the API needs, S3/MinIO or a local directory
+type ObjectStore interface {
+	// Bucket holding photo originals and renditions
+	PhotosBucket() string
+
+	Health(ctx context.Context) error
+	EnsureBucket(ctx context.Context, bucket string) error
+
+	// Time limited URLs the client uses to upload and read objects directly.
+	// A size above 0 is signed too, the store refuses a body of any other length.
+	PresignPut(ctx context.Context, bucket, key, contentType string, size int64, expires time.Duration) (string, map[string]string, error)
+	PresignGetObject(ctx context.Context, bucket, key string, ttl time.Duration) (string, error)
+
+	Head(ctx context.Context, bucket, key string) (ObjectInfo, error)
+	GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error)
+	GetObjectRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error)
+	PutObject(ctx context.Context, bucket, key, contentType string, body []byte) error
+	// Uploads size bytes of body without holding them in memory, e.g. a spooled temp file
+	PutObjectFrom(ctx context.Context, bucket, key, contentType string, body io.ReaderAt, size int64) error
+	DeleteObject(ctx context.Context, bucket, key string) error
+
+	// Calls fn for every object under prefix, Size/ETag/LastModified are filled in
+	ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error
+
+	// Multipart uploads: the client PUTs each part to its own presigned URL
+	// and the parts become one object on complete
+	CreateMultipart(ctx context.Context, bucket, key, contentType string) (uploadID string, err error)
+	PresignPart(ctx context.Context, bucket, key, uploadID string, part int32, expires time.Duration) (string, error)
+	ListParts(ctx context.Context, bucket, key, uploadID string) ([]Part, error)
+	CompleteMultipart(ctx context.Context, bucket, key, uploadID string, parts []Part) error
+	AbortMultipart(ctx context.Context, bucket, key, uploadID string) error
+	// Calls fn for every upload in the bucket that was neither completed nor aborted
+	ListMultipartUploads(ctx context.Context, bucket string, fn func(MultipartUpload) error) error
+}
+
+// Part is one uploaded piece of a multipart upload
+type Part struct {
+	Number int32  `json:"part_number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+type MultipartUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+// S3 rejects parts smaller than this, except the last one
+const MinPartSize = 5 << 20
+
+// Highest part number S3 accepts
+const MaxParts = 10000
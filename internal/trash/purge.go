@@ -0,0 +1,152 @@
+package trash
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
+	"github.com/AJMerr/little-moments-offline/internal/storage"
+	"gorm.io/gorm"
+)
+
+// ErrNotTrashed is returned by the purges when the item was restored (or
+// already purged) since it was looked up
+var ErrNotTrashed = errors.New("not in the trash")
+
+// Permanently removes a trashed photo: every row that points at it, then its
+// blobs once that is committed. The photo row is only deleted while it is
+// still trashed, a restore that gets in first keeps the photo and its blobs.
+// A blob that can't be deleted is only logged, the rows are gone by then.
+func PurgePhoto(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, p db.Photo) error {
+	var variants []db.PhotoVariant
+	if err := gdb.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("photo_id = ?", p.ID).Find(&variants).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&db.Album{}).Unscoped().
+			Where("cover_photo_id = ?", p.ID).
+			Update("cover_photo_id", nil).Error; err != nil {
+			return err
+		}
+		for _, m := range []any{&db.AlbumPhoto{}, &db.PhotoTag{}, &db.PhotoVariant{}, &db.PhotoExif{}} {
+			if err := tx.Where("photo_id = ?", p.ID).Delete(m).Error; err != nil {
+				return err
+			}
+		}
+		// Rolls the rest back when a restore got in first
+		res := tx.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", p.ID).Delete(&db.Photo{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return ErrNotTrashed
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	keys := []string{p.OriginKey}
+	for _, v := range variants {
+		keys = append(keys, v.Key)
+	}
+	for _, key := range keys {
+		if err := store.DeleteObject(ctx, store.PhotosBucket(), key); err != nil && !storage.IsNotFound(err) {
+			log.Printf("trash: purge photo %s: delete %s: %v", p.ID, key, err)
+		}
+	}
+	publishPurged(ctx, gdb, p.OwnerID, events.PhotoPurged, p.ID)
+	return nil
+}
+
+// Permanently removes a trashed album with its memberships and share links, the photos stay
+func PurgeAlbum(ctx context.Context, gdb *gorm.DB, a db.Album) error {
+	if err := gdb.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, m := range []any{&db.AlbumPhoto{}, &db.AlbumShare{}} {
+			if err := tx.Where("album_id = ?", a.ID).Delete(m).Error; err != nil {
+				return err
+			}
+		}
+		res := tx.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", a.ID).Delete(&db.Album{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return ErrNotTrashed
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	publishPurged(ctx, gdb, a.OwnerID, events.AlbumPurged, a.ID)
+	return nil
+}
+
+// The rows are gone either way, a lost event is only logged
+func publishPurged(ctx context.Context, gdb *gorm.DB, owner, typ, id string) {
+	if _, err := events.Default.Publish(context.WithoutCancel(ctx), gdb, owner, typ, id, map[string]any{"id": id}); err != nil {
+		log.Printf("trash: publish %s %s: %v", typ, id, err)
+	}
+}
+
+// Purges everything trashed before cutoff, returns how many items were removed
+func PurgeExpired(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, cutoff time.Time) (int, error) {
+	purged := 0
+
+	var photos []db.Photo
+	if err := gdb.WithContext(ctx).Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).
+		Find(&photos).Error; err != nil {
+		return purged, err
+	}
+	for _, p := range photos {
+		if err := PurgePhoto(ctx, gdb, store, p); err != nil {
+			if !errors.Is(err, ErrNotTrashed) {
+				log.Printf("trash: purge photo %s: %v", p.ID, err)
+			}
+			continue
+		}
+		purged++
+	}
+
+	var albums []db.Album
+	if err := gdb.WithContext(ctx).Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).
+		Find(&albums).Error; err != nil {
+		return purged, err
+	}
+	for _, a := range albums {
+		if err := PurgeAlbum(ctx, gdb, a); err != nil {
+			if !errors.Is(err, ErrNotTrashed) {
+				log.Printf("trash: purge album %s: %v", a.ID, err)
+			}
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// Runs PurgeExpired every interval until ctx is cancelled
+func RunPurger(ctx context.Context, gdb *gorm.DB, store storage.ObjectStore, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := PurgeExpired(ctx, gdb, store, time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("trash: purge: %v", err)
+		} else if n > 0 {
+			log.Printf("trash: purged %d items older than %s", n, retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
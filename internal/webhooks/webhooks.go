@@ -0,0 +1,406 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/AJMerr/little-moments-offline/internal/config"
+	db "github.com/AJMerr/little-moments-offline/internal/db"
+	"github.com/AJMerr/little-moments-offline/internal/events"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Headers sent with every delivery
+const (
+	HeaderEvent     = "X-LM-Event"
+	HeaderDelivery  = "X-LM-Delivery"
+	HeaderTimestamp = "X-LM-Timestamp"
+	HeaderSignature = "X-LM-Signature"
+)
+
+// Type of the deliveries made by SendTest, never published on the bus
+const TestEvent = "webhook.test"
+
+// The first retry waits this long, every one after twice the last
+const (
+	firstRetry = 30 * time.Second
+	maxRetry   = 6 * time.Hour
+)
+
+// Deliveries sent per query while working through the queue
+const dispatchBatch = 20
+
+// Longest error kept in the delivery log
+const maxErrorLen = 512
+
+// Response body read before the connection is reused, the rest is dropped
+const maxDrain = 64 << 10
+
+// Wakes the dispatcher when a delivery is queued
+var wake = make(chan struct{}, 1)
+
+func nudge() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Payload is the JSON body POSTed to the webhook
+type Payload struct {
+	// The delivery, the same on every retry so receivers can drop repeats
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	EventID   *int64          `json:"event_id"`
+	SubjectID string          `json:"subject_id,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Splits a stored event_types column
+func SplitTypes(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// Builds a pending delivery of one event to one webhook
+func newDelivery(webhookID string, eventID *int64, typ, subject string, at time.Time, data json.RawMessage) (db.WebhookDelivery, error) {
+	d := db.WebhookDelivery{
+		ID:        uuid.NewString(),
+		WebhookID: webhookID,
+		EventID:   eventID,
+		EventType: typ,
+		Status:    db.DeliveryPending,
+		CreatedAt: time.Now(),
+	}
+	body, err := json.Marshal(Payload{
+		ID:        d.ID,
+		Type:      typ,
+		EventID:   eventID,
+		SubjectID: subject,
+		CreatedAt: at,
+		Data:      data,
+	})
+	if err != nil {
+		return d, err
+	}
+	d.Payload = string(body)
+	d.NextAttemptAt = &d.CreatedAt
+	return d, nil
+}
+
+// Queue is the events.Hook that queues a delivery for every active webhook
+// of the owner that wants the event, in the transaction that records it
+type Queue struct{}
+
+func (Queue) Record(tx *gorm.DB, ev events.Event) error {
+	var hooks []db.Webhook
+	if err := tx.Where("owner_id = ? AND active = ?", ev.OwnerID, true).Find(&hooks).Error; err != nil {
+		return err
+	}
+	var rows []db.WebhookDelivery
+	for _, h := range hooks {
+		if !events.Match(SplitTypes(h.EventTypes), ev.Type) {
+			continue
+		}
+		d, err := newDelivery(h.ID, &ev.ID, ev.Type, ev.SubjectID, ev.CreatedAt, ev.Data)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, d)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return tx.Create(&rows).Error
+}
+
+func (Queue) Committed(events.Event) { nudge() }
+
+// Sign returns the X-LM-Signature value: HMAC-SHA256 of "timestamp.body"
+// keyed with the webhook secret, hex encoded
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Delay before the retry that follows attempt n, with some jitter so a
+// receiver coming back up isn't hit by every delivery at once
+func backoff(n int) time.Duration {
+	d := maxRetry
+	if n < 16 {
+		d = min(firstRetry<<(n-1), maxRetry)
+	}
+	return d - time.Duration(rand.Int64N(int64(d/10)))
+}
+
+// ErrBlocked is the error of a delivery to an address webhooks may not reach
+var ErrBlocked = errors.New("address not allowed")
+
+// Ranges not covered by the netip predicates: "this network", carrier-grade
+// NAT and benchmarking
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+}
+
+// Loopback, private, link-local and anything else that isn't a public unicast address
+func blocked(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs on the address about to be dialled, after DNS, so a hostname can't be
+// pointed somewhere private once the webhook has been saved
+func dialControl(_, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil || blocked(ap.Addr()) {
+		return ErrBlocked
+	}
+	return nil
+}
+
+// Sender makes the HTTP requests and records their outcome
+type Sender struct {
+	client       *http.Client
+	maxAttempts  int
+	allowPrivate bool
+}
+
+func NewSender(cfg config.Webhooks) *Sender {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	if !cfg.AllowPrivate {
+		dialer.Control = dialControl
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Straight to the receiver, through a proxy the check would see the proxy
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &Sender{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout.D(),
+			// A redirect is an answer, not a success
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		maxAttempts:  cfg.MaxAttempts,
+		allowPrivate: cfg.AllowPrivate,
+	}
+}
+
+// AllowsHost is false for hosts the sender would refuse to connect to. Only
+// literal addresses and localhost are known up front, names are checked
+// again when they are dialled.
+func (s *Sender) AllowsHost(host string) bool {
+	if s.allowPrivate {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return !blocked(ip)
+	}
+	return true
+}
+
+// Makes one attempt and saves the outcome on d: succeeded, failed once the
+// attempts run out, otherwise pending with the next attempt scheduled. An
+// attempt cut off by ctx isn't counted.
+func (s *Sender) Attempt(ctx context.Context, gdb *gorm.DB, h db.Webhook, d *db.WebhookDelivery) error {
+	status, err := s.post(ctx, h, d)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	now := time.Now()
+	d.Attempts++
+	d.LastAttemptAt = &now
+	d.ResponseStatus = status
+	switch {
+	case err == nil:
+		d.Status, d.LastError, d.NextAttemptAt = db.DeliverySucceeded, "", nil
+	case d.Attempts >= s.maxAttempts:
+		d.Status, d.LastError, d.NextAttemptAt = db.DeliveryFailed, truncate(err.Error()), nil
+	default:
+		next := now.Add(backoff(d.Attempts))
+		d.LastError, d.NextAttemptAt = truncate(err.Error()), &next
+	}
+	return gdb.WithContext(ctx).Save(d).Error
+}
+
+// POSTs the payload, any 2xx is a success
+func (s *Sender) post(ctx context.Context, h db.Webhook, d *db.WebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "little-moments-webhooks")
+	req.Header.Set(HeaderEvent, d.EventType)
+	req.Header.Set(HeaderDelivery, d.ID)
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderSignature, Sign(h.Secret, ts, body))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		// Without the resolved address, it would tell users what names resolve to
+		if errors.Is(err, ErrBlocked) {
+			return 0, ErrBlocked
+		}
+		return 0, err
+	}
+	defer res.Body.Close()
+	// The body is never stored, receivers may be answering with anything
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, maxDrain))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+func truncate(s string) string {
+	if len(s) > maxErrorLen {
+		return s[:maxErrorLen]
+	}
+	return s
+}
+
+// Queues a webhook.test delivery and makes the first attempt right away.
+// Failures are retried like any other delivery.
+func (s *Sender) SendTest(ctx context.Context, gdb *gorm.DB, h db.Webhook) (db.WebhookDelivery, error) {
+	data, _ := json.Marshal(map[string]any{"webhook_id": h.ID})
+	d, err := newDelivery(h.ID, nil, TestEvent, h.ID, time.Now(), data)
+	if err != nil {
+		return d, err
+	}
+	// Out of the dispatcher's way while this request makes the attempt
+	later := d.CreatedAt.Add(firstRetry)
+	d.NextAttemptAt = &later
+	if err := gdb.WithContext(ctx).Create(&d).Error; err != nil {
+		return d, err
+	}
+	err = s.Attempt(ctx, gdb, h, &d)
+	return d, err
+}
+
+var errInactive = errors.New("webhook is not active")
+
+// Sends every delivery that is due
+func (s *Sender) dispatch(ctx context.Context, gdb *gorm.DB) error {
+	for ctx.Err() == nil {
+		var due []db.WebhookDelivery
+		if err := gdb.WithContext(ctx).
+			Where("status = ? AND next_attempt_at <= ?", db.DeliveryPending, time.Now()).
+			Order("next_attempt_at").Limit(dispatchBatch).
+			Find(&due).Error; err != nil {
+			return err
+		}
+		if len(due) == 0 {
+			break
+		}
+
+		ids := make([]string, 0, len(due))
+		for _, d := range due {
+			ids = append(ids, d.WebhookID)
+		}
+		var hooks []db.Webhook
+		if err := gdb.WithContext(ctx).Where("id IN ?", ids).Find(&hooks).Error; err != nil {
+			return err
+		}
+		byID := make(map[string]db.Webhook, len(hooks))
+		for _, h := range hooks {
+			byID[h.ID] = h
+		}
+
+		for i := range due {
+			d := &due[i]
+			h, ok := byID[d.WebhookID]
+			if !ok || !h.Active {
+				// Switched off since it was queued
+				d.Status, d.LastError, d.NextAttemptAt = db.DeliveryFailed, errInactive.Error(), nil
+				if err := gdb.WithContext(ctx).Save(d).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			if err := s.Attempt(ctx, gdb, h, d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Prune deletes finished deliveries created before cutoff
+func Prune(ctx context.Context, gdb *gorm.DB, cutoff time.Time) (int64, error) {
+	res := gdb.WithContext(ctx).
+		Where("status <> ? AND created_at < ?", db.DeliveryPending, cutoff).
+		Delete(&db.WebhookDelivery{})
+	return res.RowsAffected, res.Error
+}
+
+// Sends due deliveries whenever one is queued and at least every interval,
+// and prunes the delivery log hourly, until ctx is cancelled
+func RunDispatcher(ctx context.Context, gdb *gorm.DB, s *Sender, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var pruned time.Time
+	for {
+		if err := s.dispatch(ctx, gdb); err != nil && ctx.Err() == nil {
+			log.Printf("webhooks: dispatch: %v", err)
+		}
+		if time.Since(pruned) > time.Hour {
+			if n, err := Prune(ctx, gdb, time.Now().Add(-retention)); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("webhooks: prune: %v", err)
+				}
+			} else if n > 0 {
+				log.Printf("webhooks: pruned %d deliveries older than %s", n, retention)
+			}
+			pruned = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
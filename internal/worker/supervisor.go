@@ -0,0 +1,101 @@
+// Package worker runs the server's background jobs (trash purger, variant
+// generation, ...) under one context so shutdown can stop them together.
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Wait before restarting a worker that panicked
+const restartDelay = 5 * time.Second
+
+// Supervisor starts workers and stops them all on Stop
+type Supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]int
+}
+
+func New() *Supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Supervisor{ctx: ctx, cancel: cancel, running: map[string]int{}}
+}
+
+// Runs fn in its own goroutine until it returns or Stop cancels ctx.
+// A panic is logged and fn is started again after a short delay.
+func (s *Supervisor) Go(name string, fn func(ctx context.Context)) {
+	s.wg.Add(1)
+	s.track(name, 1)
+	go func() {
+		defer s.wg.Done()
+		defer s.track(name, -1)
+		for {
+			if !s.run(name, fn) {
+				return
+			}
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(restartDelay):
+				log.Printf("worker %s: restarting", name)
+			}
+		}
+	}()
+}
+
+// Reports whether fn panicked
+func (s *Supervisor) run(name string, fn func(ctx context.Context)) (panicked bool) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("worker %s: panic: %v\n%s", name, rec, debug.Stack())
+			panicked = true
+		}
+	}()
+	fn(s.ctx)
+	return false
+}
+
+func (s *Supervisor) track(name string, delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running[name] += delta
+	if s.running[name] <= 0 {
+		delete(s.running, name)
+	}
+}
+
+// Cancels every worker and waits for them to return. If ctx ends first the
+// error names the workers still running.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		names := make([]string, 0, len(s.running))
+		for name := range s.running {
+			names = append(names, name)
+		}
+		s.mu.Unlock()
+		sort.Strings(names)
+		return fmt.Errorf("workers still running: %s", strings.Join(names, ", "))
+	}
+}
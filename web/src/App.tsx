@@ -1,10 +1,20 @@
-import { useState } from "react";
+import { useEffect, useState } from "react";
 import Photos from "./Photos";
 import Albums from "./Albums"; 
+import Login from "./Login";
+import { me, logout, type User } from "./api";
 import "./index.css";
 
 export default function App() {
   const [tab, setTab] = useState<"photos" | "albums">("photos");
+  const [user, setUser] = useState<User | null | undefined>(undefined);
+
+  useEffect(() => {
+    me().then(setUser).catch(() => setUser(null));
+  }, []);
+
+  if (user === undefined) return <div className="min-h-screen bg-black" />;
+  if (user === null) return <Login onLogin={setUser} />;
 
   return (
     <div className="min-h-screen bg-black text-gray-100">
@@ -50,6 +60,13 @@ export default function App() {
               Albums
             </button>
           </div>
+
+          <button
+            onClick={() => logout().finally(() => setUser(null))}
+            className="px-4 py-3 text-sm text-gray-400 hover:text-gray-200"
+          >
+            Sign out
+          </button>
         </div>
 
         {/* Content */}
@@ -0,0 +1,72 @@
+import { useState, type FormEvent } from "react";
+import { login, register, type User } from "./api";
+
+export default function Login({ onLogin }: { onLogin: (u: User) => void }) {
+  const [mode, setMode] = useState<"login" | "register">("login");
+  const [email, setEmail] = useState("");
+  const [password, setPassword] = useState("");
+  const [error, setError] = useState("");
+  const [busy, setBusy] = useState(false);
+
+  async function submit(e: FormEvent) {
+    e.preventDefault();
+    setBusy(true);
+    setError("");
+    try {
+      if (mode === "register") {
+        await register(email, password);
+      }
+      onLogin(await login(email, password));
+    } catch (err: any) {
+      setError(err.message);
+    } finally {
+      setBusy(false);
+    }
+  }
+
+  return (
+    <div className="min-h-screen bg-black text-gray-100 flex items-center justify-center p-6">
+      <form
+        onSubmit={submit}
+        className="w-full max-w-sm bg-gray-900/50 border border-gray-800 rounded-2xl p-8 space-y-4"
+      >
+        <h1 className="text-2xl font-bold">Little Moments</h1>
+        <p className="text-sm text-gray-500">
+          {mode === "login" ? "Sign in to your library" : "Create the first account"}
+        </p>
+        <input
+          type="email"
+          value={email}
+          onChange={(e) => setEmail(e.target.value)}
+          placeholder="Email"
+          className="w-full px-4 py-3 bg-black border border-gray-700 rounded-lg"
+          required
+        />
+        <input
+          type="password"
+          value={password}
+          onChange={(e) => setPassword(e.target.value)}
+          placeholder="Password"
+          className="w-full px-4 py-3 bg-black border border-gray-700 rounded-lg"
+          minLength={8}
+          required
+        />
+        {error && <p className="text-sm text-red-400">{error}</p>}
+        <button
+          type="submit"
+          disabled={busy}
+          className="w-full px-6 py-3 bg-purple-600 hover:bg-purple-500 disabled:bg-gray-700 text-white font-medium rounded-lg"
+        >
+          {mode === "login" ? "Sign in" : "Create account"}
+        </button>
+        <button
+          type="button"
+          onClick={() => setMode(mode === "login" ? "register" : "login")}
+          className="w-full text-sm text-gray-400 hover:text-gray-200"
+        >
+          {mode === "login" ? "First time here? Create the admin account" : "Back to sign in"}
+        </button>
+      </form>
+    </div>
+  );
+}
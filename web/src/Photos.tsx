@@ -85,7 +85,7 @@ export default function Photos() {
     try {
       setBusy(true);
 
-      const pre: PresignRes = await presign(file.name, file.type);   
+      const pre: PresignRes = await presign(file.name, file.type, file.size);   
               await uploadToS3(pre.url, file);                          
               const meta = await confirmPhoto(pre.key, file.size, file.type, title || file.name, description);
 
@@ -2,21 +2,8 @@ import axios from "axios";
 
 export const API = import.meta.env.VITE_API_BASE as string;
 
-// Simple request deduplication to prevent duplicate API calls
-const pendingRequests = new Map<string, Promise<any>>();
-
-function deduplicateRequest<T>(key: string, requestFn: () => Promise<T>): Promise<T> {
-  if (pendingRequests.has(key)) {
-    return pendingRequests.get(key)!;
-  }
-  
-  const promise = requestFn().finally(() => {
-    pendingRequests.delete(key);
-  });
-  
-  pendingRequests.set(key, promise);
-  return promise;
-}
+// Session cookie has to ride along on every request
+axios.defaults.withCredentials = true;
 
 export type Photo = {
   id: string;
@@ -45,11 +32,12 @@ export async function listPhotos(cursor?: string, limit = 24) {
   }
 }
 
-export async function presign(filename: string, contentType: string) {
+export async function presign(filename: string, contentType: string, bytes: number) {
   try {
     const { data } = await axios.post(`${API}/photos/presign`, {
       filename,
       content_type: contentType,
+      bytes,
     });
     return data as { url: string; key: string; headers: Record<string, string> };
   } catch (error: any) {
@@ -86,24 +74,20 @@ export async function confirmPhoto(
 
 function toS3Proxy(url: string) {
   const u = new URL(url);
+  // Filesystem storage: blobs are served by the API itself
+  if (u.pathname.startsWith("/blob/")) {
+    return `${API}${u.pathname}${u.search}`;
+  }
   return `${window.location.origin}/s3${u.pathname}${u.search}`;
 }
 
-export async function photoUrl(id: string) {
-  return deduplicateRequest(`photoUrl:${id}`, async () => {
-    try {
-      const { data } = await axios.get<{ url: string; expires_at: string }>(
-        `${API}/photos/${id}/url`,
-        { params: { ttl: 300 } }
-      );
-      return {
-        url: toS3Proxy(data.url),   
-        expires_at: data.expires_at 
-      };
-    } catch (error: any) {
-      throw new Error(`Failed to get photo URL: ${error.response?.data?.message || error.message}`);
-    }
-  });
+/** Stable URL streamed by the API with the session cookie, it doesn't expire */
+export async function photoUrl(id: string, variant?: "thumb" | "preview") {
+  const q = variant ? `?variant=${variant}` : "";
+  return {
+    url: `${API}/photos/${encodeURIComponent(id)}/content${q}`,
+    expires_at: new Date(Date.now() + 24 * 60 * 60 * 1000).toISOString(),
+  };
 }
 
 export async function patchPhoto(
@@ -129,8 +113,7 @@ export async function deletePhoto(id: string) {
 /** Upload file to presigned S3 URL with proxy support */
 export async function uploadToS3(presignedUrl: string, file: File) {
   try {
-    const u = new URL(presignedUrl);
-    const proxied = `${window.location.origin}/s3${u.pathname}${u.search}`;
+    const proxied = toS3Proxy(presignedUrl);
     const contentType = file.type || 'application/octet-stream';
     
     await axios.put(proxied, file, {
@@ -239,4 +222,44 @@ export async function addPhotosToAlbum(id: string, photo_ids: string[]) {
   } catch (error: any) {
     throw new Error(`Failed to add photos to album: ${error.response?.data?.message || error.message}`);
   }
-}
\ No newline at end of file
+}
+// --- Auth ---
+export type User = {
+  id: string;
+  email: string;
+  user_name: string;
+  is_admin: boolean;
+  created_at: string;
+};
+
+export async function me(): Promise<User | null> {
+  try {
+    const { data } = await axios.get(`${API}/me`);
+    return data as User;
+  } catch (error: any) {
+    if (error.response?.status === 401) return null;
+    throw new Error(`Failed to load session: ${error.response?.data?.error || error.message}`);
+  }
+}
+
+export async function login(email: string, password: string) {
+  try {
+    const { data } = await axios.post(`${API}/auth/login`, { email, password });
+    return data as User;
+  } catch (error: any) {
+    throw new Error(error.response?.data?.error || error.message);
+  }
+}
+
+export async function register(email: string, password: string, user_name?: string) {
+  try {
+    const { data } = await axios.post(`${API}/auth/register`, { email, password, user_name });
+    return data as User;
+  } catch (error: any) {
+    throw new Error(error.response?.data?.error || error.message);
+  }
+}
+
+export async function logout() {
+  await axios.post(`${API}/auth/logout`);
+}